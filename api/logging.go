@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Registro estructurado con niveles. LOG_LEVEL elige el nivel mínimo
+// (debug, info, warn o error) y LOG_FORMAT el formato: text (por defecto) o
+// json, para enviar los registros a un agregador. La API asigna el ID de
+// cada solicitud, o toma el de la cabecera X-Request-ID; los registros
+// hechos con su contexto lo llevan junto con el ID de la traza.
+
+type requestIDKey struct{}
+
+// Crea el registro de este servicio según la configuración
+func newLogger() *slog.Logger {
+	options := &slog.HandlerOptions{Level: parseLogLevel(getEnv("LOG_LEVEL", "info"))}
+	var handler slog.Handler
+	if strings.EqualFold(getEnv("LOG_FORMAT", "text"), "json") {
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, options)
+	}
+	return slog.New(contextHandler{handler}).With("service", serviceName)
+}
+
+// Nivel de LOG_LEVEL; si no es válido, info
+func parseLogLevel(value string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// Contexto que lleva el ID de la solicitud para los registros y los
+// mensajes al servidor
+func withRequestID(ctx context.Context, requestID string) context.Context {
+	if requestID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// ID de la solicitud de ctx, o "" si no tiene
+func requestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// Agrega a cada registro el ID de la solicitud y el de la traza del contexto
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID := requestIDFrom(ctx); requestID != "" {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		record.AddAttrs(slog.String("trace_id", spanContext.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -1,27 +1,262 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Recomendaciones que la API envía por WebSocket a la sesión que las pidió:
+// el ranking final de una solicitud
 type Message struct {
-	// Aquí solo guardamos los IDs de las películas seleccionadas por el usuario
-	MovieIDs []int `json:"movieIds"`
+	Type      string         `json:"type"` // Siempre "recommendations"
+	RequestID string         `json:"requestId"`
+	MovieIDs  []int          `json:"movieIds"`
+	Degraded  bool           `json:"degraded,omitempty"`
+	Warnings  []ServiceError `json:"warnings,omitempty"`
 }
 
+// Mensaje con las recomendaciones de una respuesta del servidor. Se arma
+// igual para las solicitudes WebSocket y para las HTTP con X-Session-ID.
+func recommendationsMessage(requestID string, response RecommendationResponse) Message {
+	return Message{
+		Type:      MessageRecommendations,
+		RequestID: requestID,
+		MovieIDs:  response.MovieIDs,
+		Degraded:  response.Degraded,
+		Warnings:  response.Warnings,
+	}
+}
+
+// Primer mensaje de cada conexión WebSocket, con el ID de su sesión
+type SessionMessage struct {
+	Type      string `json:"type"` // Siempre "session"
+	SessionID string `json:"sessionId"`
+}
+
+// Solicitud de recomendaciones que un cliente envía por WebSocket
+type WebSocketRequest struct {
+	Type string `json:"type"` // Siempre "recommend"
+	RecommendationRequest
+}
+
+// Confirmación de que la API recibió una solicitud enviada por WebSocket
+type AckMessage struct {
+	Type      string `json:"type"` // Siempre "ack"
+	RequestID string `json:"requestId"`
+}
+
+// Resultado de un shard que el coordinador envía apenas responde su nodo,
+// antes de la respuesta final, y que la API reenvía por WebSocket
+type PartialResult struct {
+	Type      string        `json:"type"` // Siempre "partial"
+	RequestID string        `json:"requestId"`
+	Shard     int           `json:"shard"`
+	Node      string        `json:"node,omitempty"` // Nodo que respondió
+	MovieIDs  []int         `json:"movieIds"`       // Mejores películas del shard
+	Error     *ServiceError `json:"error,omitempty"`
+}
+
+// Error de una solicitud enviada por WebSocket
+type WebSocketError struct {
+	Type      string       `json:"type"` // Siempre "error"
+	RequestID string       `json:"requestId,omitempty"`
+	Error     ServiceError `json:"error"`
+}
+
+// Tipos de mensaje WebSocket
+const (
+	MessageSession         = "session"
+	MessageRecommend       = "recommend"
+	MessageAck             = "ack"
+	MessagePartial         = "partial"
+	MessageRecommendations = "recommendations"
+	MessageError           = "error"
+)
+
+// Solicitud de recomendaciones que recibe la API y reenvía al servidor
+type RecommendationRequest struct {
+	RequestID string `json:"requestId"`
+	MovieIDs  []int  `json:"movieIds"`
+	// Algoritmo: "item-knn" (por defecto), "user-knn", "popularity", "bayesian",
+	// "trending" o "ensemble"
+	Algorithm string `json:"algorithm,omitempty"`
+	// Pesos por algoritmo en modo ensamble; si se omiten se usan los del servidor
+	Weights map[string]float64 `json:"weights,omitempty"`
+	// Ventana del algoritmo trending, en días
+	WindowDays int `json:"windowDays,omitempty"`
+	// Vida media, en días, del peso de las calificaciones (0 = sin decaimiento)
+	HalfLifeDays float64 `json:"halfLifeDays,omitempty"`
+	// Estrategia de arranque en frío: "bayesian", "popularity", "trending" o "none".
+	// Si se omite se usa la configurada en el servidor.
+	ColdStart string `json:"coldStart,omitempty"`
+	// Diversidad del resultado final, entre 0 (sin reordenar) y 1
+	Diversity float64 `json:"diversity,omitempty"`
+	// Búsqueda de películas similares en item-knn: "exact" (por defecto) o
+	// "approximate" (índice LSH en los nodos)
+	Search string `json:"search,omitempty"`
+}
+
+// Solicitud que la API reenvía al servidor, con el plazo que le queda
+type RecommendationMessage struct {
+	RecommendationRequest
+	CacheDirectives
+	TimeoutMs   int64  `json:"timeoutMs"`
+	TraceParent string `json:"traceparent,omitempty"` // Contexto de la traza (W3C traceparent)
+	Stream      bool   `json:"stream,omitempty"`      // Pedir el resultado de cada shard antes del final
+}
+
+// Directivas de la cabecera Cache-Control que la API reenvía al servidor
+type CacheDirectives struct {
+	NoCache bool `json:"noCache,omitempty"` // No responder desde la caché
+	NoStore bool `json:"noStore,omitempty"` // No guardar la respuesta en la caché
+}
+
+// Error tipado devuelto por el servidor de recomendaciones
+type ServiceError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Node    string `json:"node,omitempty"`
+	Leader  string `json:"leader,omitempty"` // Coordinador líder conocido (not_leader)
+}
+
+// Respuesta del servidor de recomendaciones. También es el cuerpo que la API
+// devuelve a sus clientes HTTP.
+type RecommendationResponse struct {
+	RequestID       string             `json:"requestId"`
+	Algorithm       string             `json:"algorithm,omitempty"`
+	Weights         map[string]float64 `json:"weights,omitempty"` // Pesos usados en modo ensamble
+	MovieIDs        []int              `json:"movieIds"`
+	UnknownMovieIDs []int              `json:"unknownMovieIds,omitempty"`
+	ColdStart       string             `json:"coldStart,omitempty"` // Estrategia de respaldo usada, si hubo
+	Cached          bool               `json:"cached,omitempty"`    // La respuesta salió de la caché del servidor
+	Degraded        bool               `json:"degraded"`
+	Warnings        []ServiceError     `json:"warnings,omitempty"`
+	Error           *ServiceError      `json:"error,omitempty"`
+}
+
+// Calificación nueva enviada a POST /ratings
+type RatingInput struct {
+	UserID  int     `json:"userId"`
+	MovieID int     `json:"movieId"`
+	Rating  float64 `json:"rating"`
+	// Fecha "2005-09-06" o segundos Unix; si se omite se usa la actual
+	Date string `json:"date,omitempty"`
+}
+
+// Cuerpo de POST /ratings: una calificación suelta o un lote en "ratings"
+type RatingsBody struct {
+	RatingInput
+	Ratings []RatingInput `json:"ratings,omitempty"`
+}
+
+// Calificaciones que la API reenvía al servidor
+type RatingsRequest struct {
+	Type        string        `json:"type"`
+	RequestID   string        `json:"requestId"`
+	Ratings     []RatingInput `json:"ratings"`
+	TraceParent string        `json:"traceparent,omitempty"` // Contexto de la traza (W3C traceparent)
+}
+
+// Respuesta del servidor a una carga de calificaciones
+type RatingsResponse struct {
+	RequestID string         `json:"requestId"`
+	Accepted  int            `json:"accepted"`
+	Version   int64          `json:"version"` // Versión del dataset después de la carga
+	Degraded  bool           `json:"degraded"`
+	Warnings  []ServiceError `json:"warnings,omitempty"`
+	Error     *ServiceError  `json:"error,omitempty"`
+}
+
+// Pedido del estado del clúster al coordinador líder
+type ClusterRequest struct {
+	Type        string `json:"type"`
+	RequestID   string `json:"requestId"`
+	TraceParent string `json:"traceparent,omitempty"` // Contexto de la traza (W3C traceparent)
+}
+
+// Cuerpo JSON de las respuestas de error de la API
+type ErrorResponse struct {
+	RequestID string       `json:"requestId"`
+	Error     ServiceError `json:"error"`
+}
+
+// Códigos de error que la API traduce a estados HTTP
+const (
+	ErrBadRequest             = "bad_request"
+	ErrUnknownMovie           = "unknown_movie"
+	ErrNodeTimeout            = "node_timeout"
+	ErrNodeUnavailable        = "node_unavailable"
+	ErrNodeBusy               = "node_busy"
+	ErrDatasetNotLoaded       = "dataset_not_loaded"
+	ErrDatesNotLoaded         = "dates_not_loaded"
+	ErrCoordinatorUnavailable = "coordinator_unavailable"
+	ErrStorageUnavailable     = "storage_unavailable"
+	ErrDeadlineExceeded       = "deadline_exceeded"
+	ErrNotLeader              = "not_leader"
+	ErrShuttingDown           = "shutting_down"
+)
+
+// Estado HTTP correspondiente a cada código de error
+var errorStatus = map[string]int{
+	ErrBadRequest:             http.StatusBadRequest,
+	ErrUnknownMovie:           http.StatusUnprocessableEntity,
+	ErrNodeTimeout:            http.StatusGatewayTimeout,
+	ErrNodeUnavailable:        http.StatusServiceUnavailable,
+	ErrNodeBusy:               http.StatusServiceUnavailable,
+	ErrDatasetNotLoaded:       http.StatusServiceUnavailable,
+	ErrDatesNotLoaded:         http.StatusUnprocessableEntity,
+	ErrCoordinatorUnavailable: http.StatusBadGateway,
+	ErrStorageUnavailable:     http.StatusServiceUnavailable,
+	ErrDeadlineExceeded:       http.StatusGatewayTimeout,
+	ErrNotLeader:              http.StatusServiceUnavailable,
+	ErrShuttingDown:           http.StatusServiceUnavailable,
+}
+
+// Plazo de la consulta al líder en /readyz
+const readinessTimeout = 2 * time.Second
+
+// Plazo máximo de una solicitud de recomendaciones. El cliente puede pedir
+// uno menor, en segundos, con la cabecera X-Request-Timeout.
+const requestTimeout = 600 * time.Second
+
+// Coordinadores a los que la API puede enviar las solicitudes. Solo el líder
+// las atiende; los demás responden not_leader con el líder que conocen.
+var coordinators = parseCoordinators(os.Getenv("COORDINATORS"))
+
+const (
+	failoverTimeout    = 10 * time.Second       // Tiempo máximo buscando un líder, por ejemplo durante una elección
+	failoverRetryDelay = 250 * time.Millisecond // Pausa antes de probar el siguiente coordinador
+)
+
+// Último coordinador que respondió como líder
+var (
+	leaderMu   sync.Mutex
+	leaderAddr string
+)
+
 var (
-	clients   = make(map[*websocket.Conn]bool) // Mapa para los clientes WebSocket conectados
-	broadcast = make(chan Message)             // Canal para transmitir mensajes
-	upgrader  = websocket.Upgrader{
+	clients  = make(map[string]*wsClient) // Clientes WebSocket conectados, por ID de sesión
+	upgrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true }, // Permite cualquier origen
 	}
 	mu sync.Mutex // Mutex para sincronizar el acceso a la variable clients
@@ -29,134 +264,623 @@ var (
 
 // Maneja las conexiones WebSocket
 func handleConnections(w http.ResponseWriter, r *http.Request) {
+	// Durante el apagado no se aceptan clientes nuevos
+	if shuttingDown.Load() {
+		http.Error(w, "la API se está apagando", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Actualiza la conexión HTTP a WebSocket
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("Error al actualizar a WebSocket: %v\n", err)
+		slog.Warn("Error al actualizar a WebSocket", "error", err)
 		return
 	}
 	defer ws.Close()
+	wsClients.Add(1)
+	defer wsClients.Done()
+
+	// Cada conexión es una sesión. El cliente envía su ID en X-Session-ID con
+	// sus solicitudes y recibe solo sus recomendaciones.
+	sessionID := newRequestID()
+	client := newWSClient(sessionID, ws)
+	client.enqueue(SessionMessage{Type: MessageSession, SessionID: sessionID})
+	go client.writePump()
+	defer client.stop()
+	client.startReading()
 
 	// Agrega el cliente a la lista de clientes conectados
 	mu.Lock()
-	clients[ws] = true
+	clients[sessionID] = client
 	mu.Unlock()
+	slog.Info("Cliente WebSocket conectado", "session_id", sessionID)
+
+	// Las solicitudes de la sesión se cancelan cuando se desconecta
+	sessionCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// Lee los mensajes del WebSocket (aunque en este caso solo estamos esperando las recomendaciones)
+	// Lee las solicitudes de recomendaciones del cliente. Cada una se atiende
+	// en su propia goroutine, así el cliente puede enviar varias a la vez.
 	for {
-		var msg Message
-		err := ws.ReadJSON(&msg)
+		_, data, err := ws.ReadMessage()
 		if err != nil {
-			// Si hay un error (por ejemplo, la conexión se cierra), eliminamos al cliente de la lista
+			// Si hay un error (por ejemplo, la conexión se cierra o no respondió
+			// los pings), eliminamos al cliente de la lista
 			mu.Lock()
-			delete(clients, ws)
+			if clients[sessionID] == client {
+				delete(clients, sessionID)
+			}
 			mu.Unlock()
+			slog.Info("Cliente WebSocket desconectado", "session_id", sessionID, "error", err)
 			break
 		}
+		client.extendReadDeadline()
+
+		var request WebSocketRequest
+		if err := json.Unmarshal(data, &request); err != nil || request.Type != MessageRecommend {
+			client.enqueue(WebSocketError{Type: MessageError, RequestID: request.RequestID, Error: ServiceError{
+				Code:    ErrBadRequest,
+				Message: `se esperaba {"type": "recommend", "movieIds": [...]}`,
+			}})
+			continue
+		}
+		if !pendingWSRequests.start() {
+			client.enqueue(WebSocketError{Type: MessageError, RequestID: request.RequestID, Error: ServiceError{
+				Code:    ErrShuttingDown,
+				Message: "la API se está apagando",
+			}})
+			continue
+		}
+		go func() {
+			defer pendingWSRequests.done()
+			handleWebSocketRequest(sessionCtx, sessionID, request.RecommendationRequest)
+		}()
 	}
 }
 
+// Atiende una solicitud de recomendaciones recibida por WebSocket. La sesión
+// recibe la confirmación, el resultado de cada shard apenas responde su nodo
+// y el ranking final, así la interfaz muestra los resultados a medida que
+// llegan.
+func handleWebSocketRequest(ctx context.Context, sessionID string, request RecommendationRequest) {
+	start := time.Now()
+	if request.RequestID == "" {
+		request.RequestID = newRequestID()
+	}
+	requestID := request.RequestID
+	ctx, span := tracer.Start(withRequestID(ctx, requestID), "WS recommend", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	send := func(message any) {
+		deliver(sessionID, message)
+	}
+	result := "ok"
+	defer func() {
+		span.SetAttributes(attribute.String("result", result))
+		wsRequests.WithLabelValues(result).Inc()
+		slog.InfoContext(ctx, "Solicitud WebSocket atendida", "session_id", sessionID, "result", result, "duration", time.Since(start))
+	}()
+
+	send(AckMessage{Type: MessageAck, RequestID: requestID})
+	slog.InfoContext(ctx, "Solicitud de recomendaciones recibida por WebSocket", "session_id", sessionID, "favorites", len(request.MovieIDs))
+	slog.DebugContext(ctx, "Películas favoritas", "movie_ids", request.MovieIDs)
+
+	response, err := requestRecommendations(ctx, request, CacheDirectives{}, func(partial PartialResult) {
+		partial.RequestID = requestID
+		send(partial)
+	})
+	var serviceErr *ServiceError
+	switch {
+	case errors.Is(err, context.Canceled):
+		// La sesión se desconectó: nadie espera la respuesta
+		slog.InfoContext(ctx, "La sesión WebSocket se cerró; se cancela la solicitud", "session_id", sessionID)
+		result = "canceled"
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		serviceErr = &ServiceError{Code: ErrDeadlineExceeded, Message: fmt.Sprintf("El servidor no respondió en %v", requestTimeout)}
+	case err != nil:
+		serviceErr = &ServiceError{Code: ErrCoordinatorUnavailable, Message: "Error al obtener recomendaciones del servidor"}
+	default:
+		serviceErr = response.Error
+	}
+	if serviceErr != nil {
+		result = serviceErr.Code
+		span.SetStatus(codes.Error, serviceErr.Message)
+		send(WebSocketError{Type: MessageError, RequestID: requestID, Error: *serviceErr})
+		return
+	}
+
+	slog.InfoContext(ctx, "Recomendaciones recibidas del servidor", "movies", len(response.MovieIDs), "degraded", response.Degraded, "cached", response.Cached)
+	slog.DebugContext(ctx, "Películas recomendadas", "movie_ids", response.MovieIDs)
+	send(recommendationsMessage(requestID, response))
+}
+
 // handleAPI maneja las solicitudes de recomendaciones
 func handleAPI(w http.ResponseWriter, r *http.Request) {
-	var msg Message
-	err := json.NewDecoder(r.Body).Decode(&msg)
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	w.Header().Set("X-Request-ID", requestID)
+
+	var request RecommendationRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
-		http.Error(w, "Error al decodificar el mensaje", http.StatusBadRequest)
+		writeError(w, requestID, ServiceError{Code: ErrBadRequest, Message: "Error al decodificar el mensaje"})
+		return
+	}
+	request.RequestID = requestID
+
+	timeout, ok := parseRequestTimeout(r.Header.Get("X-Request-Timeout"))
+	if !ok {
+		writeError(w, requestID, ServiceError{Code: ErrBadRequest, Message: "X-Request-Timeout debe ser una cantidad positiva de segundos"})
 		return
 	}
+	// Si el cliente se desconecta, el contexto se cancela y el servidor deja
+	// de calcular en los nodos
+	ctx, cancel := context.WithTimeout(withRequestID(r.Context(), requestID), timeout)
+	defer cancel()
 
-	fmt.Printf("Películas recibidas en la API: %v\n", msg.MovieIDs)
+	slog.InfoContext(ctx, "Solicitud de recomendaciones recibida", "favorites", len(request.MovieIDs))
+	slog.DebugContext(ctx, "Películas favoritas", "movie_ids", request.MovieIDs)
 
 	// Envía los IDs de películas favoritas al servidor de recomendaciones
-	recommendations, err := requestRecommendations(msg.MovieIDs)
+	response, err := requestRecommendations(ctx, request, parseCacheControl(r.Header.Get("Cache-Control")), nil)
+	if r.Context().Err() != nil {
+		slog.InfoContext(ctx, "El cliente cerró la conexión; se cancela la solicitud")
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeError(w, requestID, ServiceError{
+			Code:    ErrDeadlineExceeded,
+			Message: fmt.Sprintf("El servidor no respondió en %v", timeout),
+		})
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error al obtener recomendaciones", http.StatusInternalServerError)
+		writeError(w, requestID, ServiceError{
+			Code:    ErrCoordinatorUnavailable,
+			Message: "Error al obtener recomendaciones del servidor",
+		})
+		return
+	}
+	response.RequestID = requestID
+	if response.Error != nil {
+		writeError(w, requestID, *response.Error)
 		return
 	}
 
-	fmt.Printf("Recomendaciones enviadas por el nodo servidor: %v\n", recommendations)
+	slog.InfoContext(ctx, "Recomendaciones recibidas del servidor", "movies", len(response.MovieIDs), "degraded", response.Degraded, "cached", response.Cached)
+	slog.DebugContext(ctx, "Películas recomendadas", "movie_ids", response.MovieIDs)
 
-	// Enviamos las recomendaciones a los clientes conectados por WebSocket
-	broadcast <- Message{MovieIDs: recommendations}
+	// Enviamos las recomendaciones también a la sesión WebSocket que las pidió
+	if sessionID := r.Header.Get("X-Session-ID"); sessionID != "" {
+		deliver(sessionID, recommendationsMessage(requestID, response))
+	}
 
+	if response.Cached {
+		w.Header().Set("X-Cache", "HIT")
+		cacheResponses.WithLabelValues("hit").Inc()
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+		cacheResponses.WithLabelValues("miss").Inc()
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(Message{MovieIDs: recommendations})
+	json.NewEncoder(w).Encode(response)
 }
 
-// requestRecommendations conecta al servidor en el puerto TCP 9002 y obtiene recomendaciones
-func requestRecommendations(favoriteIDs []int) ([]int, error) {
-	// Conecta al servidor de recomendaciones en el puerto 9002
-	conn, err := net.Dial("tcp", "172.20.0.5:9002")
+// handleRatings recibe calificaciones nuevas y las reenvía al servidor, que
+// las agrega al dataset sin reiniciar el clúster
+func handleRatings(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	w.Header().Set("X-Request-ID", requestID)
+
+	if r.Method != http.MethodPost {
+		writeError(w, requestID, ServiceError{Code: ErrBadRequest, Message: "Se esperaba POST"})
+		return
+	}
+
+	var body RatingsBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, requestID, ServiceError{Code: ErrBadRequest, Message: "Error al decodificar el mensaje"})
+		return
+	}
+	ratings := body.Ratings
+	if ratings == nil {
+		ratings = []RatingInput{body.RatingInput}
+	}
+
+	ctx, cancel := context.WithTimeout(withRequestID(r.Context(), requestID), requestTimeout)
+	defer cancel()
+
+	slog.InfoContext(ctx, "Calificaciones recibidas", "ratings", len(ratings))
+
+	var response RatingsResponse
+	message := RatingsRequest{Type: "ratings", RequestID: requestID, Ratings: ratings, TraceParent: traceParent(ctx)}
+	err := callServer(ctx, message, &response)
 	if err != nil {
-		log.Printf("Error al conectar con el servidor de recomendaciones: %v", err)
-		return nil, err
+		writeError(w, requestID, ServiceError{
+			Code:    ErrCoordinatorUnavailable,
+			Message: "Error al enviar las calificaciones al servidor",
+		})
+		return
 	}
-	defer conn.Close()
+	response.RequestID = requestID
+	if response.Error != nil {
+		writeError(w, requestID, *response.Error)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleCluster devuelve el estado del clúster según el coordinador líder:
+// nodos, shards, versiones, último chequeo y trabajo en curso
+func handleCluster(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	w.Header().Set("X-Request-ID", requestID)
+
+	if r.Method != http.MethodGet {
+		writeError(w, requestID, ServiceError{Code: ErrBadRequest, Message: "Se esperaba GET"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withRequestID(r.Context(), requestID), failoverTimeout)
+	defer cancel()
+
+	var status json.RawMessage
+	message := ClusterRequest{Type: "cluster", RequestID: requestID, TraceParent: traceParent(ctx)}
+	if err := callServer(ctx, message, &status); err != nil {
+		writeError(w, requestID, ServiceError{
+			Code:    ErrCoordinatorUnavailable,
+			Message: "Error al obtener el estado del clúster",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(append(status, '\n'))
+}
+
+// handleHealthz indica que el proceso está vivo y atiende HTTP
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// handleReadyz indica si la API puede atender solicitudes: hay un
+// coordinador líder que responde y tiene el dataset cargado
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "shutting_down"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	var status struct {
+		Leader string `json:"leader"`
+		Ready  bool   `json:"ready"`
+	}
+	if err := callServer(ctx, ClusterRequest{Type: "cluster"}, &status); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "not_ready", "reason": "ningún coordinador respondió como líder"})
+		return
+	}
+	if !status.Ready {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "not_ready", "reason": "el dataset no está cargado", "leader": status.Leader})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ready", "leader": status.Leader})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError responde con el estado HTTP asociado al código y un cuerpo JSON
+func writeError(w http.ResponseWriter, requestID string, serviceErr ServiceError) {
+	status, ok := errorStatus[serviceErr.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{RequestID: requestID, Error: serviceErr})
+}
+
+// parseRequestTimeout lee el plazo pedido en X-Request-Timeout (segundos),
+// que no puede superar requestTimeout
+func parseRequestTimeout(header string) (time.Duration, bool) {
+	if header == "" {
+		return requestTimeout, true
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	return min(time.Duration(seconds*float64(time.Second)), requestTimeout), true
+}
+
+// newRequestID genera un identificador aleatorio para correlacionar la solicitud
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// parseCacheControl lee las directivas de Cache-Control que afectan a la
+// caché del servidor: "no-cache" o "max-age=0" calculan de nuevo la
+// respuesta y "no-store" evita que se guarde
+func parseCacheControl(header string) CacheDirectives {
+	var directives CacheDirectives
+	for _, directive := range strings.Split(header, ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache", "max-age=0":
+			directives.NoCache = true
+		case "no-store":
+			directives.NoStore = true
+		}
+	}
+	return directives
+}
+
+// requestRecommendations conecta al servidor en el puerto TCP 9002 y obtiene
+// recomendaciones. El servidor recibe el plazo que le queda a la solicitud.
+// Si se pasa onPartial, recibe el resultado de cada shard a medida que
+// responden los nodos.
+func requestRecommendations(ctx context.Context, request RecommendationRequest, cache CacheDirectives, onPartial func(PartialResult)) (RecommendationResponse, error) {
+	message := RecommendationMessage{RecommendationRequest: request, CacheDirectives: cache, TraceParent: traceParent(ctx), Stream: onPartial != nil}
+	if deadline, ok := ctx.Deadline(); ok {
+		message.TimeoutMs = time.Until(deadline).Milliseconds()
+	}
+	var response RecommendationResponse
+	if err := streamServer(ctx, message, &response, onPartial); err != nil {
+		return RecommendationResponse{}, err
+	}
+	return response, nil
+}
+
+// callServer envía un mensaje JSON al coordinador líder y decodifica su
+// respuesta. Si el coordinador no es el líder se reintenta en el que indica
+// y, si no responde, en el siguiente de la lista; reintentar es seguro
+// porque volver a calcular recomendaciones o a cargar las mismas
+// calificaciones no cambia el resultado. Si ctx se cancela o vence, se
+// cierra la conexión y el servidor cancela el trabajo pendiente.
+func callServer(ctx context.Context, request any, response any) error {
+	return streamServer(ctx, request, response, nil)
+}
 
-	// Envía los IDs de películas favoritas como JSON
-	data, err := json.Marshal(favoriteIDs)
+// streamServer es callServer que además pasa a onPartial los resultados
+// parciales que el coordinador envía antes de la respuesta final. Si se
+// reintenta en otro coordinador, un shard puede llegar más de una vez.
+func streamServer(ctx context.Context, request any, response any, onPartial func(PartialResult)) error {
+	_, encodeSpan := tracer.Start(ctx, "api.encode")
+	data, err := json.Marshal(request)
+	encodeSpan.End()
 	if err != nil {
-		log.Printf("Error al serializar los IDs de películas favoritas: %v", err)
+		slog.ErrorContext(ctx, "Error al serializar la solicitud", "error", err)
+		return err
+	}
+
+	kind := messageKind(request)
+	address := currentLeader()
+	deadline := time.Now().Add(failoverTimeout)
+	for {
+		raw, err := callCoordinator(ctx, kind, address, data, onPartial)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		hint := ""
+		if err == nil {
+			var reply struct {
+				Error *ServiceError `json:"error"`
+			}
+			json.Unmarshal(raw, &reply)
+			if reply.Error == nil || reply.Error.Code != ErrNotLeader {
+				setLeader(address)
+				_, decodeSpan := tracer.Start(ctx, "api.decode")
+				defer decodeSpan.End()
+				return json.Unmarshal(raw, response)
+			}
+			err = errors.New(reply.Error.Message)
+			hint = reply.Error.Leader
+			coordinatorRetries.WithLabelValues("not_leader").Inc()
+		} else {
+			coordinatorRetries.WithLabelValues("unavailable").Inc()
+		}
+		if time.Now().After(deadline) {
+			slog.ErrorContext(ctx, "Ningún coordinador respondió como líder", "timeout", failoverTimeout, "error", err)
+			return err
+		}
+
+		next := hint
+		if next == "" || next == address {
+			// Sin líder conocido, por ejemplo durante una elección, se prueba
+			// el siguiente coordinador después de una pausa
+			next = nextCoordinator(address)
+			select {
+			case <-time.After(failoverRetryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		slog.WarnContext(ctx, "El coordinador no atendió la solicitud; se reintenta", "coordinator", address, "error", err, "next", next)
+		address = next
+	}
+}
+
+// callCoordinator envía el mensaje ya serializado a un coordinador y
+// devuelve su respuesta final sin decodificar. Los resultados parciales que
+// llegan antes se pasan a onPartial.
+func callCoordinator(ctx context.Context, kind, address string, data []byte, onPartial func(PartialResult)) (raw json.RawMessage, err error) {
+	start := time.Now()
+	defer func() {
+		serverRequestDuration.WithLabelValues(kind, address).Observe(time.Since(start).Seconds())
+	}()
+
+	// Tramo del intento: red y atención en el coordinador
+	_, span := tracer.Start(ctx, "api.server_call", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("coordinator", address)))
+	defer func() {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	// Conecta al servidor de recomendaciones en el puerto 9002
+	var dialer net.Dialer
+	rawConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		slog.WarnContext(ctx, "Error al conectar con el servidor de recomendaciones", "coordinator", address, "error", err)
 		return nil, err
 	}
+	conn := &meteredConn{Conn: rawConn}
+	defer func() {
+		serverPayloadBytes.WithLabelValues("sent").Add(float64(conn.sent.Load()))
+		serverPayloadBytes.WithLabelValues("received").Add(float64(conn.received.Load()))
+	}()
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 
 	_, err = conn.Write(data)
 	if err != nil {
-		log.Printf("Error al enviar los datos al servidor: %v", err)
+		slog.WarnContext(ctx, "Error al enviar los datos al servidor", "coordinator", address, "error", err)
 		return nil, err
 	}
 
-	// Configura un tiempo de espera para la respuesta
-	conn.SetReadDeadline(time.Now().Add(600 * time.Second))
-
 	// Lee la respuesta del servidor como JSON
-	var recommendedIDs []int
 	decoder := json.NewDecoder(conn) // Usamos json.NewDecoder para leer directamente de la conexión
-	err = decoder.Decode(&recommendedIDs)
-	if err != nil {
-		log.Printf("Error al decodificar la respuesta: %v", err)
-		return nil, err
+	for {
+		if err := decoder.Decode(&raw); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			slog.WarnContext(ctx, "Error al decodificar la respuesta", "coordinator", address, "error", err)
+			return nil, err
+		}
+		var partial PartialResult
+		if onPartial == nil || json.Unmarshal(raw, &partial) != nil || partial.Type != MessagePartial {
+			return raw, nil
+		}
+		onPartial(partial)
 	}
+}
 
-	return recommendedIDs, nil
+// Tipo de un mensaje para las métricas
+func messageKind(request any) string {
+	switch request.(type) {
+	case RatingsRequest:
+		return "ratings"
+	case ClusterRequest:
+		return "cluster"
+	}
+	return "recommend"
 }
 
-// Envía los mensajes (recomendaciones) a todos los clientes WebSocket conectados
-func handleMessages() {
-	for {
-		// Esperamos a que llegue un mensaje del canal "broadcast"
-		msg := <-broadcast
-
-		mu.Lock()
-		// Enviamos el mensaje a todos los clientes conectados
-		for client := range clients {
-			err := client.WriteJSON(msg)
-			if err != nil {
-				log.Printf("Error al enviar mensaje: %v", err)
-				client.Close()
-				delete(clients, client)
-			}
+// Coordinador al que se envían las solicitudes: el último que respondió
+// como líder o, si ninguno respondió todavía, el primero de la lista
+func currentLeader() string {
+	leaderMu.Lock()
+	defer leaderMu.Unlock()
+	if leaderAddr == "" {
+		return coordinators[0]
+	}
+	return leaderAddr
+}
+
+func setLeader(address string) {
+	leaderMu.Lock()
+	defer leaderMu.Unlock()
+	if leaderAddr != address {
+		slog.Info("Nuevo coordinador líder", "leader", address)
+		leaderAddr = address
+	}
+}
+
+// Coordinador que sigue al dado en la lista
+func nextCoordinator(address string) string {
+	index := slices.Index(coordinators, address)
+	return coordinators[(index+1)%len(coordinators)]
+}
+
+// parseCoordinators separa la lista de COORDINATORS; sin ella se usa el
+// servidor de siempre
+func parseCoordinators(value string) []string {
+	var addresses []string
+	for _, address := range strings.Split(value, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
 		}
-		mu.Unlock()
 	}
+	if len(addresses) == 0 {
+		return []string{"172.20.0.5:9002"}
+	}
+	return addresses
+}
+
+// Lee una variable de entorno o devuelve el valor por defecto
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Lee una variable de entorno entera o devuelve el valor por defecto
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
 }
 
 func main() {
-	// Configuración de CORS usando la configuración predeterminada (permitir todos los orígenes)
+	slog.SetDefault(newLogger())
+
+	// Rutas de la API
 	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", handleConnections) // Conexión WebSocket
-	mux.HandleFunc("/api", handleAPI)        // API REST para recibir los IDs de películas seleccionadas
+	mux.HandleFunc("/ws", handleConnections)                         // Conexión WebSocket
+	mux.HandleFunc("/api", instrument("api", handleAPI))             // API REST para recibir los IDs de películas seleccionadas
+	mux.HandleFunc("/ratings", instrument("ratings", handleRatings)) // Calificaciones nuevas (una o un lote)
+	mux.HandleFunc("/cluster", instrument("cluster", handleCluster)) // Estado del clúster según el coordinador líder
+	mux.Handle("/metrics", promhttp.Handler())                       // Métricas para Prometheus
+	mux.HandleFunc("/healthz", handleHealthz)                        // El proceso está vivo
+	mux.HandleFunc("/readyz", handleReadyz)                          // Hay un líder con el dataset cargado
 
-	// Aplica CORS a todas las rutas
-	handler := cors.Default().Handler(mux)
+	// Aplica CORS a todas las rutas. Los navegadores pueden enviar las
+	// cabeceras propias de la API y leer las de la respuesta.
+	handler := cors.New(cors.Options{
+		AllowedHeaders: []string{"Content-Type", "Cache-Control", "X-Request-ID", "X-Request-Timeout", "X-Session-ID", "traceparent"},
+		ExposedHeaders: []string{"X-Request-ID", "X-Cache", "traceparent"},
+	}).Handler(mux)
 
-	// Inicia la goroutine que maneja los mensajes
-	go handleMessages()
+	// Exporta los tramos de las trazas
+	initTracing()
 
-	// Inicia el servidor en el puerto 8080
-	fmt.Println("Servidor iniciado en :8080")
-	err := http.ListenAndServe(":8080", handler)
+	// Inicia el servidor en el puerto 8080 y lo apaga de forma ordenada al
+	// recibir SIGTERM o SIGINT
+	slog.Info("Servidor iniciado", "address", ":8080")
+	err := serveUntilSignal(&http.Server{Addr: ":8080", Handler: handler})
 	if err != nil {
-		log.Fatal("Error en el servidor: ", err)
+		slog.Error("Error en el servidor", "error", err)
+		os.Exit(1)
 	}
 }
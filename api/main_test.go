@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Coordinador simulado: responde cada mensaje con lo que devuelve reply y
+// cuenta los mensajes recibidos
+type fakeCoordinator struct {
+	address  string
+	received atomic.Int64
+}
+
+func startFakeCoordinator(t *testing.T, reply func(address string) any) *fakeCoordinator {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	coordinator := &fakeCoordinator{address: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var message json.RawMessage
+				if err := json.NewDecoder(conn).Decode(&message); err != nil {
+					return
+				}
+				coordinator.received.Add(1)
+				json.NewEncoder(conn).Encode(reply(coordinator.address))
+			}()
+		}
+	}()
+	return coordinator
+}
+
+// Usa los coordinadores dados, sin líder conocido, y restaura la
+// configuración al terminar
+func useCoordinators(t *testing.T, addresses ...string) {
+	t.Helper()
+	previous := coordinators
+	coordinators = addresses
+	setLeaderForTest("")
+	t.Cleanup(func() {
+		coordinators = previous
+		setLeaderForTest("")
+	})
+}
+
+func setLeaderForTest(address string) {
+	leaderMu.Lock()
+	leaderAddr = address
+	leaderMu.Unlock()
+}
+
+func recommend(t *testing.T) RecommendationResponse {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	response, err := requestRecommendations(ctx, RecommendationRequest{RequestID: "prueba", MovieIDs: []int{1, 2}}, CacheDirectives{}, nil)
+	if err != nil {
+		t.Fatalf("la solicitud falló: %v", err)
+	}
+	return response
+}
+
+// Un coordinador que no es el líder responde not_leader con el líder; la
+// API reintenta allí y lo recuerda para las solicitudes siguientes
+func TestCallServerFollowsNotLeaderHint(t *testing.T) {
+	leader := startFakeCoordinator(t, func(string) any {
+		return RecommendationResponse{RequestID: "prueba", MovieIDs: []int{7, 8}}
+	})
+	follower := startFakeCoordinator(t, func(address string) any {
+		return RecommendationResponse{Error: &ServiceError{Code: ErrNotLeader, Message: "el coordinador " + address + " no es el líder", Leader: leader.address}}
+	})
+	// El líder es el último de la lista: sin la indicación habría que
+	// probar antes el otro seguidor
+	other := startFakeCoordinator(t, func(address string) any {
+		return RecommendationResponse{Error: &ServiceError{Code: ErrNotLeader, Message: "el coordinador " + address + " no es el líder"}}
+	})
+	useCoordinators(t, follower.address, other.address, leader.address)
+
+	start := time.Now()
+	response := recommend(t)
+	if len(response.MovieIDs) != 2 || response.MovieIDs[0] != 7 {
+		t.Fatalf("respuesta %+v, se esperaba la del líder", response)
+	}
+	if elapsed := time.Since(start); elapsed >= failoverRetryDelay {
+		t.Errorf("la solicitud tardó %v: con la indicación del líder no hace falta esperar", elapsed)
+	}
+	if follower.received.Load() != 1 || other.received.Load() != 0 || leader.received.Load() != 1 {
+		t.Fatalf("mensajes recibidos: seguidor %d, otro %d, líder %d; se esperaba 1, 0 y 1",
+			follower.received.Load(), other.received.Load(), leader.received.Load())
+	}
+	if current := currentLeader(); current != leader.address {
+		t.Fatalf("la API recuerda al líder %s, se esperaba %s", current, leader.address)
+	}
+
+	// La siguiente va directo al líder
+	recommend(t)
+	if follower.received.Load() != 1 || leader.received.Load() != 2 {
+		t.Fatalf("la segunda solicitud no fue directo al líder: seguidor %d, líder %d", follower.received.Load(), leader.received.Load())
+	}
+}
+
+// Sin líder conocido, o si el coordinador no responde, se prueba el
+// siguiente de la lista
+func TestCallServerTriesNextCoordinator(t *testing.T) {
+	// Una dirección en la que nadie escucha
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := listener.Addr().String()
+	listener.Close()
+
+	electing := startFakeCoordinator(t, func(address string) any {
+		return RecommendationResponse{Error: &ServiceError{Code: ErrNotLeader, Message: "el coordinador " + address + " no es el líder"}}
+	})
+	leader := startFakeCoordinator(t, func(string) any {
+		return RecommendationResponse{RequestID: "prueba", MovieIDs: []int{9}}
+	})
+	useCoordinators(t, down, electing.address, leader.address)
+
+	response := recommend(t)
+	if len(response.MovieIDs) != 1 || response.MovieIDs[0] != 9 {
+		t.Fatalf("respuesta %+v, se esperaba la del líder", response)
+	}
+	if electing.received.Load() != 1 || leader.received.Load() != 1 {
+		t.Fatalf("mensajes recibidos: en elección %d, líder %d; se esperaba 1 y 1", electing.received.Load(), leader.received.Load())
+	}
+	if current := currentLeader(); current != leader.address {
+		t.Fatalf("la API recuerda al líder %s, se esperaba %s", current, leader.address)
+	}
+}
+
+// Los errores que no son not_leader se devuelven sin reintentar
+func TestCallServerDoesNotRetryOtherErrors(t *testing.T) {
+	busy := startFakeCoordinator(t, func(string) any {
+		return RecommendationResponse{Error: &ServiceError{Code: ErrNodeBusy, Message: "los nodos están ocupados"}}
+	})
+	other := startFakeCoordinator(t, func(string) any {
+		return RecommendationResponse{MovieIDs: []int{1}}
+	})
+	useCoordinators(t, busy.address, other.address)
+
+	response := recommend(t)
+	if response.Error == nil || response.Error.Code != ErrNodeBusy {
+		t.Fatalf("respuesta %+v, se esperaba node_busy", response)
+	}
+	if other.received.Load() != 0 {
+		t.Fatal("se reintentó en otro coordinador un error que no es not_leader")
+	}
+}
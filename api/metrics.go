@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Métricas de Prometheus, expuestas en /metrics con client_golang. Además
+// de las de la API se exportan las del proceso y del runtime de Go.
+
+// Límites de los histogramas de latencia, en segundos. Las solicitudes con
+// los datasets completos pueden tardar varios minutos.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// Conexión que cuenta los bytes enviados y recibidos
+type meteredConn struct {
+	net.Conn
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Add(int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+// Respuesta HTTP que recuerda el estado enviado
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Registra la cantidad, el estado y la duración de las solicitudes de un
+// handler. Si el cliente se desconectó antes de la respuesta, el estado es
+// "canceled". Cada solicitud es además el tramo raíz de su traza, o continúa
+// la del cliente si envía la cabecera traceparent.
+func instrument(handler string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		propagator.Inject(ctx, propagation.HeaderCarrier(w.Header()))
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r.WithContext(ctx))
+
+		status := strconv.Itoa(recorder.status)
+		if recorder.status == 0 {
+			status = strconv.Itoa(http.StatusOK)
+			if r.Context().Err() != nil {
+				status = "canceled"
+			}
+		}
+		span.SetAttributes(attribute.String("http.status_code", status))
+		httpRequests.WithLabelValues(handler, status).Inc()
+		httpRequestDuration.WithLabelValues(handler).Observe(time.Since(start).Seconds())
+		slog.InfoContext(withRequestID(ctx, w.Header().Get("X-Request-ID")), "Solicitud HTTP atendida",
+			"method", r.Method, "path", r.URL.Path, "status", status, "duration", time.Since(start))
+	}
+}
+
+// Métricas de la API
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_requests_total",
+		Help: "Solicitudes HTTP atendidas, por handler y estado",
+	}, []string{"handler", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "api_request_duration_seconds",
+		Help:    "Duración de las solicitudes HTTP, por handler",
+		Buckets: latencyBuckets,
+	}, []string{"handler"})
+	serverRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "api_server_request_duration_seconds",
+		Help:    "Duración de cada intento de llamada a un coordinador (API → servidor), por tipo y coordinador",
+		Buckets: latencyBuckets,
+	}, []string{"type", "coordinator"})
+	serverPayloadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_server_payload_bytes_total",
+		Help: "Bytes intercambiados con los coordinadores",
+	}, []string{"direction"})
+	coordinatorRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_coordinator_retries_total",
+		Help: "Reintentos en otro coordinador, por motivo",
+	}, []string{"reason"})
+	cacheResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_cache_responses_total",
+		Help: "Respuestas de recomendaciones según salieron o no de la caché del servidor",
+	}, []string{"result"})
+	wsRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_websocket_requests_total",
+		Help: "Solicitudes de recomendaciones recibidas por WebSocket, por resultado",
+	}, []string{"result"})
+	wsEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_websocket_evictions_total",
+		Help: "Clientes WebSocket desconectados por no leer a tiempo o por un error de escritura, por motivo",
+	}, []string{"reason"})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "api_websocket_clients",
+		Help: "Clientes WebSocket conectados",
+	}, func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return float64(len(clients))
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "api_websocket_queued_messages",
+		Help: "Mensajes en las colas de envío de los clientes WebSocket",
+	}, func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		queued := 0
+		for _, client := range clients {
+			queued += len(client.send)
+		}
+		return float64(queued)
+	})
+}
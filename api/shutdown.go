@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Apagado ordenado. Con SIGTERM o SIGINT la API deja de aceptar conexiones,
+// espera hasta shutdownTimeout a que terminen las solicitudes HTTP y
+// WebSocket en curso y cierra los WebSocket con un frame de cierre, así los
+// clientes saben que deben reconectarse. Las solicitudes que no terminan a
+// tiempo se cancelan, y con ellas el trabajo en el coordinador.
+var shutdownTimeout = time.Duration(getEnvInt("SHUTDOWN_TIMEOUT", 20)) * time.Second
+
+// Espera a que los clientes WebSocket respondan el cierre
+const webSocketCloseTimeout = 2 * time.Second
+
+var (
+	shuttingDown      atomic.Bool
+	wsClients         sync.WaitGroup // Conexiones WebSocket abiertas
+	pendingWSRequests requestTracker // Solicitudes recibidas por WebSocket en curso
+)
+
+// Solicitudes en curso que el apagado espera. Registrar una solicitud y
+// cerrar el registro se excluyen con mu: ninguna se agrega al WaitGroup
+// después de que el apagado empezó a esperarlo.
+type requestTracker struct {
+	mu      sync.Mutex
+	closed  bool
+	pending sync.WaitGroup
+}
+
+// Registra una solicitud nueva; false si la API ya se está apagando
+func (r *requestTracker) start() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	r.pending.Add(1)
+	return true
+}
+
+// Indica que terminó una solicitud registrada con start
+func (r *requestTracker) done() {
+	r.pending.Done()
+}
+
+// No admite más solicitudes
+func (r *requestTracker) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+}
+
+// Espera hasta el plazo las solicitudes en curso; indica si terminaron
+func (r *requestTracker) wait(timeout time.Duration) bool {
+	r.close()
+	return waitTimeout(&r.pending, timeout)
+}
+
+// Atiende HTTP hasta recibir la señal de apagado y entonces drena las
+// solicitudes en curso
+func serveUntilSignal(server *http.Server) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.ListenAndServe() }()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		slog.Info("Señal de apagado recibida; no se aceptan más conexiones", "signal", sig.String())
+	}
+	shuttingDown.Store(true)
+	pendingWSRequests.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); errors.Is(err, context.DeadlineExceeded) {
+		// Cerrar las conexiones cancela el contexto de sus solicitudes
+		slog.Warn("Venció el plazo del apagado; se cancelan las solicitudes en curso", "timeout", shutdownTimeout)
+		server.Close()
+	}
+	// Las solicitudes WebSocket que no terminen se cancelan al cerrar su sesión
+	if deadline, _ := ctx.Deadline(); !pendingWSRequests.wait(time.Until(deadline)) {
+		slog.Warn("Venció el plazo del apagado con solicitudes WebSocket en curso", "timeout", shutdownTimeout)
+	}
+
+	closeWebSockets()
+	flushTraces()
+	slog.Info("API apagada")
+	return nil
+}
+
+// Envía un frame de cierre a cada cliente WebSocket y espera que respondan.
+// handleConnections cierra cada conexión al recibir la respuesta. Los frames
+// se envían en paralelo para que un cliente lento no demore a los demás.
+func closeWebSockets() {
+	mu.Lock()
+	closing := make([]*wsClient, 0, len(clients))
+	for sessionID, client := range clients {
+		closing = append(closing, client)
+		delete(clients, sessionID)
+	}
+	mu.Unlock()
+	for _, client := range closing {
+		go client.closeWith(websocket.CloseGoingAway, "la API se está apagando")
+	}
+
+	if len(closing) > 0 && !waitTimeout(&wsClients, webSocketCloseTimeout) {
+		slog.Warn("Algunos clientes WebSocket no respondieron el cierre", "clients", len(closing))
+		for _, client := range closing {
+			client.conn.Close()
+		}
+	}
+}
+
+// Espera al grupo hasta el plazo; indica si terminó a tiempo
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// El apagado espera las solicitudes registradas y no admite nuevas desde
+// que empieza a esperar
+func TestRequestTrackerWaitsAndRejects(t *testing.T) {
+	var tracker requestTracker
+	if !tracker.start() {
+		t.Fatal("se rechazó una solicitud antes del apagado")
+	}
+	finished := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(finished)
+		tracker.done()
+	}()
+
+	if !tracker.wait(5 * time.Second) {
+		t.Fatal("venció el plazo con la solicitud ya terminada")
+	}
+	select {
+	case <-finished:
+	default:
+		t.Fatal("wait volvió antes de que terminara la solicitud en curso")
+	}
+	if tracker.start() {
+		t.Fatal("se admitió una solicitud después del apagado")
+	}
+}
+
+// Registrar solicitudes mientras el apagado empieza a esperar no es un uso
+// indebido del WaitGroup; con -race se detectaría
+func TestRequestTrackerConcurrentStart(t *testing.T) {
+	var tracker requestTracker
+	var accepted sync.WaitGroup
+	for range 50 {
+		accepted.Add(1)
+		go func() {
+			defer accepted.Done()
+			if tracker.start() {
+				tracker.done()
+			}
+		}()
+	}
+	if !tracker.wait(5 * time.Second) {
+		t.Fatal("venció el plazo esperando solicitudes que terminan enseguida")
+	}
+	accepted.Wait()
+}
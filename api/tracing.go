@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Trazas distribuidas con el SDK de OpenTelemetry. La API empieza la traza
+// de cada solicitud, o continúa la del cliente, y envía su contexto al
+// coordinador en el campo traceparent de los mensajes, con el formato de
+// W3C Trace Context.
+
+var (
+	traceExporter = getEnv("TRACE_EXPORTER", "none") // "none", "stdout" u "otlp"
+	serviceName   = getEnv("OTEL_SERVICE_NAME", "api")
+)
+
+const (
+	traceQueueSize     = 4096            // Tramos en espera de exportarse; si se llena se descartan
+	traceBatchSize     = 256             // Tramos por envío al colector
+	traceFlushInterval = 2 * time.Second // Espera máxima antes de exportar
+	traceFlushTimeout  = 5 * time.Second // Espera máxima de la exportación final al apagarse
+)
+
+var (
+	tracer         = otel.Tracer("recomendaciones")
+	propagator     = propagation.TraceContext{}
+	tracerProvider *sdktrace.TracerProvider
+)
+
+// Instala el proveedor de tramos. Aunque no se exporten, los tramos se
+// crean para propagar el contexto al coordinador. OTEL_RESOURCE_ATTRIBUTES
+// agrega atributos al servicio.
+func initTracing() {
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK())
+	if err != nil {
+		slog.Warn("Error al leer los atributos del servicio para las trazas", "error", err)
+	}
+	options := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if exporter := newSpanExporter(); exporter != nil {
+		slog.Info("Exportador de trazas", "exporter", traceExporter)
+		options = append(options, sdktrace.WithBatcher(exporter,
+			sdktrace.WithMaxQueueSize(traceQueueSize),
+			sdktrace.WithMaxExportBatchSize(traceBatchSize),
+			sdktrace.WithBatchTimeout(traceFlushInterval)))
+	}
+	tracerProvider = sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(tracerProvider)
+}
+
+// Exportador elegido con TRACE_EXPORTER, o nil si no se exportan tramos
+func newSpanExporter() sdktrace.SpanExporter {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch traceExporter {
+	case "none":
+		return nil
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	case "otlp":
+		// El exportador lee OTEL_EXPORTER_OTLP_ENDPOINT y las demás variables
+		// estándar; sin ellas envía al colector local
+		var options []otlptracehttp.Option
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+			options = append(options, otlptracehttp.WithEndpointURL("http://localhost:4318/v1/traces"))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	default:
+		slog.Warn("Exportador de trazas desconocido; no se exportan tramos", "exporter", traceExporter)
+		return nil
+	}
+	if err != nil {
+		slog.Warn("Error al crear el exportador de trazas; no se exportan tramos", "exporter", traceExporter, "error", err)
+		return nil
+	}
+	return exporter
+}
+
+// traceparent del tramo actual de ctx, para enviarlo en un mensaje
+func traceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// Exporta los tramos pendientes antes de que termine el proceso
+func flushTraces() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), traceFlushTimeout)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		slog.Warn("No se pudieron exportar los últimos tramos", "error", err)
+	}
+}
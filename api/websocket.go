@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Envío a los clientes WebSocket. Cada conexión tiene su propia goroutine
+// escritora y una cola acotada, así un navegador lento no demora a los demás
+// ni a las solicitudes HTTP. Si la cola de un cliente se llena, el cliente
+// no está leyendo y se lo desconecta.
+var (
+	sendQueueSize = 64               // Mensajes en espera por cliente
+	writeWait     = 10 * time.Second // Plazo de cada escritura
+	pongWait      = 60 * time.Second // Plazo para recibir el pong, o cualquier mensaje, del cliente
+	pingPeriod    = pongWait * 9 / 10
+)
+
+// Tamaño máximo de un mensaje del cliente
+const maxMessageSize = 64 << 10
+
+// Cliente WebSocket conectado. Los plazos se fijan al conectarse.
+type wsClient struct {
+	sessionID  string
+	conn       *websocket.Conn
+	send       chan any      // Mensajes en espera de la goroutine escritora
+	done       chan struct{} // Se cierra cuando el escritor debe terminar
+	writeWait  time.Duration
+	pongWait   time.Duration
+	pingPeriod time.Duration
+	stopOnce   sync.Once
+	closeOnce  sync.Once
+	evictOnce  sync.Once
+}
+
+func newWSClient(sessionID string, conn *websocket.Conn) *wsClient {
+	return &wsClient{
+		sessionID:  sessionID,
+		conn:       conn,
+		send:       make(chan any, sendQueueSize),
+		done:       make(chan struct{}),
+		writeWait:  writeWait,
+		pongWait:   pongWait,
+		pingPeriod: pingPeriod,
+	}
+}
+
+// Encola un mensaje sin bloquear. Si la cola está llena el cliente se
+// desconecta; devuelve false si el mensaje no se encoló.
+func (c *wsClient) enqueue(message any) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- message:
+		return true
+	default:
+		slog.Warn("Cliente WebSocket lento: se llenó su cola; se desconecta", "session_id", c.sessionID, "queue", cap(c.send))
+		c.evict("slow_consumer", websocket.CloseTryAgainLater, "el cliente no lee los mensajes a tiempo")
+		return false
+	}
+}
+
+// Escribe los mensajes de la cola y envía un ping cada pingPeriod. Termina
+// si una escritura falla o vence, o cuando se detiene el cliente.
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(c.pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeWait))
+			if err := c.conn.WriteJSON(message); err != nil {
+				slog.Warn("Error al enviar mensaje por WebSocket; se desconecta", "session_id", c.sessionID, "error", err)
+				c.evict("write_error", websocket.CloseGoingAway, "")
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.writeWait)); err != nil {
+				slog.Warn("Error al enviar ping por WebSocket; se desconecta", "session_id", c.sessionID, "error", err)
+				c.evict("write_error", websocket.CloseGoingAway, "")
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Prepara la lectura: limita el tamaño de los mensajes y desconecta al
+// cliente si pasa pongWait sin responder los pings ni enviar nada
+func (c *wsClient) startReading() {
+	c.conn.SetReadLimit(maxMessageSize)
+	c.extendReadDeadline()
+	c.conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
+}
+
+// Cada pong o mensaje del cliente renueva el plazo de lectura
+func (c *wsClient) extendReadDeadline() {
+	c.conn.SetReadDeadline(time.Now().Add(c.pongWait))
+}
+
+// Detiene la goroutine escritora
+func (c *wsClient) stop() {
+	c.stopOnce.Do(func() { close(c.done) })
+}
+
+// Detiene el escritor y envía el frame de cierre. El cliente responde y la
+// lectura en handleConnections termina y cierra la conexión.
+func (c *wsClient) closeWith(code int, reason string) {
+	c.stop()
+	c.closeOnce.Do(func() {
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(c.writeWait))
+	})
+}
+
+// Quita al cliente de la lista y lo desconecta sin esperar su respuesta al
+// cierre. No bloquea: el frame de cierre puede demorar si el cliente no lee.
+func (c *wsClient) evict(reason string, code int, message string) {
+	c.evictOnce.Do(func() {
+		mu.Lock()
+		if clients[c.sessionID] == c {
+			delete(clients, c.sessionID)
+		}
+		mu.Unlock()
+		wsEvictions.WithLabelValues(reason).Inc()
+		c.stop()
+		// La conexión sigue abierta hasta enviar el cierre; el apagado la espera
+		wsClients.Add(1)
+		go func() {
+			defer wsClients.Done()
+			c.closeWith(code, message)
+			c.conn.Close()
+		}()
+	})
+}
+
+// Encola un mensaje para una sesión sin bloquear a quien lo envía
+func deliver(sessionID string, message any) {
+	mu.Lock()
+	client, ok := clients[sessionID]
+	mu.Unlock()
+	if !ok {
+		slog.Info("La sesión WebSocket no está conectada; se descarta el mensaje", "session_id", sessionID)
+		return
+	}
+	client.enqueue(message)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Levanta la API WebSocket con plazos y colas de prueba y los restaura al
+// terminar
+func startWebSocketServer(t *testing.T, queue int, write, pong time.Duration) *httptest.Server {
+	t.Helper()
+	previous := []any{sendQueueSize, writeWait, pongWait, pingPeriod, slog.Default()}
+	sendQueueSize, writeWait, pongWait, pingPeriod = queue, write, pong, pong*9/10
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	server := httptest.NewServer(http.HandlerFunc(handleConnections))
+	t.Cleanup(func() {
+		// Los clientes ya se cerraron; se espera a que terminen sus handlers
+		server.Close()
+		if !waitTimeout(&wsClients, 5*time.Second) {
+			t.Errorf("las conexiones WebSocket no terminaron")
+		}
+		sendQueueSize, writeWait, pongWait, pingPeriod = previous[0].(int), previous[1].(time.Duration), previous[2].(time.Duration), previous[3].(time.Duration)
+		slog.SetDefault(previous[4].(*slog.Logger))
+	})
+	return server
+}
+
+// Conecta un cliente simulado y lee el ID de su sesión
+func dialWebSocket(t *testing.T, server *httptest.Server) (*websocket.Conn, string) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("no se pudo conectar el cliente WebSocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var session SessionMessage
+	if err := conn.ReadJSON(&session); err != nil || session.Type != MessageSession || session.SessionID == "" {
+		t.Fatalf("se esperaba el mensaje de sesión, se recibió %+v (error %v)", session, err)
+	}
+	return conn, session.SessionID
+}
+
+// Desconexiones registradas por un motivo
+func evictions(reason string) float64 {
+	return testutil.ToFloat64(wsEvictions.WithLabelValues(reason))
+}
+
+func connected(sessionID string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := clients[sessionID]
+	return ok
+}
+
+// Espera hasta el plazo a que se cumpla la condición
+func eventually(timeout time.Duration, condition func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+// Muchos clientes reciben sus mensajes en orden mientras los que no leen
+// llenan su cola y se desconectan, sin demorar los envíos a los demás
+func TestDeliverDoesNotBlockOnSlowClients(t *testing.T) {
+	const (
+		fastClients = 50
+		slowClients = 5
+		rounds      = 200
+	)
+	server := startWebSocketServer(t, 16, time.Second, time.Minute)
+
+	// Los clientes rápidos leen todo y avisan cada mensaje recibido
+	received := make(chan error, fastClients*rounds)
+	fast := make([]string, fastClients)
+	var readers sync.WaitGroup
+	for i := range fast {
+		conn, sessionID := dialWebSocket(t, server)
+		fast[i] = sessionID
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for round := 0; round < rounds; round++ {
+				var message Message
+				if err := conn.ReadJSON(&message); err != nil {
+					received <- fmt.Errorf("sesión %s: error en el mensaje %d: %v", sessionID, round, err)
+					return
+				}
+				if message.RequestID != fmt.Sprint(round) {
+					received <- fmt.Errorf("sesión %s: se esperaba el mensaje %d y llegó %s", sessionID, round, message.RequestID)
+					return
+				}
+				received <- nil
+			}
+		}()
+	}
+	// Los lentos nunca leen y reciben mensajes grandes, que llenan el buffer
+	// del socket y luego la cola
+	slow := make([]string, slowClients)
+	for i := range slow {
+		_, slow[i] = dialWebSocket(t, server)
+	}
+	large := make([]int, 100000)
+	evicted := evictions("slow_consumer")
+
+	var slowest time.Duration
+	for round := 0; round < rounds; round++ {
+		requestID := fmt.Sprint(round)
+		for _, sessionID := range slow {
+			start := time.Now()
+			deliver(sessionID, Message{Type: MessageRecommendations, RequestID: requestID, MovieIDs: large})
+			slowest = max(slowest, time.Since(start))
+		}
+		for _, sessionID := range fast {
+			start := time.Now()
+			deliver(sessionID, Message{Type: MessageRecommendations, RequestID: requestID, MovieIDs: []int{round}})
+			slowest = max(slowest, time.Since(start))
+		}
+		for range fast {
+			select {
+			case err := <-received:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("los clientes rápidos no recibieron el mensaje %d", round)
+			}
+		}
+	}
+	readers.Wait()
+
+	if slowest > writeWait/2 {
+		t.Errorf("deliver tardó %v; no debería esperar a los clientes", slowest)
+	}
+	for _, sessionID := range slow {
+		if connected(sessionID) {
+			t.Errorf("el cliente lento %s sigue conectado", sessionID)
+		}
+	}
+	for _, sessionID := range fast {
+		if !connected(sessionID) {
+			t.Errorf("el cliente rápido %s fue desconectado", sessionID)
+		}
+	}
+	if got := evictions("slow_consumer") - evicted; got != slowClients {
+		t.Errorf("se desconectaron %v clientes lentos; se esperaban %d", got, slowClients)
+	}
+}
+
+// Los clientes que leen responden los pings y siguen conectados; los que no
+// responden se desconectan al vencer pongWait
+func TestKeepaliveDisconnectsUnresponsiveClients(t *testing.T) {
+	server := startWebSocketServer(t, 16, time.Second, 200*time.Millisecond)
+
+	alive, aliveID := dialWebSocket(t, server)
+	pings := make(chan struct{}, 100)
+	alive.SetPingHandler(func(data string) error {
+		pings <- struct{}{}
+		return alive.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go func() {
+		// Leer procesa los pings y responde con pongs
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	_, silentID := dialWebSocket(t, server)
+
+	if !eventually(2*time.Second, func() bool { return !connected(silentID) }) {
+		t.Errorf("el cliente que no responde los pings sigue conectado")
+	}
+	time.Sleep(4 * pongWait)
+	if !connected(aliveID) {
+		t.Errorf("el cliente que responde los pings fue desconectado")
+	}
+	if len(pings) < 2 {
+		t.Errorf("el cliente recibió %d pings; se esperaban varios", len(pings))
+	}
+}
+
+// Lee mensajes de la sesión hasta recibir uno del tipo dado
+func readMessageOfType(t *testing.T, conn *websocket.Conn, messageType string) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("no llegó el mensaje %s: %v", messageType, err)
+		}
+		if strings.Contains(string(data), `"type":"`+messageType+`"`) {
+			return data
+		}
+	}
+}
+
+// Un resultado degradado llega igual a la sesión si se pidió por WebSocket o
+// por HTTP con X-Session-ID
+func TestSessionReceivesDegradedResult(t *testing.T) {
+	warnings := []ServiceError{{Code: "partial_results", Message: "respondieron 2 de 3 shards"}}
+	coordinator := startFakeCoordinator(t, func(string) any {
+		return RecommendationResponse{MovieIDs: []int{7, 8}, Degraded: true, Warnings: warnings}
+	})
+	useCoordinators(t, coordinator.address)
+	server := startWebSocketServer(t, 16, time.Second, time.Minute)
+	conn, sessionID := dialWebSocket(t, server)
+
+	if err := conn.WriteJSON(WebSocketRequest{Type: MessageRecommend, RecommendationRequest: RecommendationRequest{MovieIDs: []int{1, 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	var viaWebSocket Message
+	if err := json.Unmarshal(readMessageOfType(t, conn, MessageRecommendations), &viaWebSocket); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api", strings.NewReader(`{"movieIds":[1,2]}`))
+	request.Header.Set("X-Session-ID", sessionID)
+	recorder := httptest.NewRecorder()
+	handleAPI(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("la solicitud HTTP respondió %d", recorder.Code)
+	}
+	var viaHTTP Message
+	if err := json.Unmarshal(readMessageOfType(t, conn, MessageRecommendations), &viaHTTP); err != nil {
+		t.Fatal(err)
+	}
+
+	if !viaHTTP.Degraded || !reflect.DeepEqual(viaHTTP.Warnings, warnings) {
+		t.Fatalf("la sesión recibió %+v por HTTP, se esperaba el resultado degradado con sus advertencias", viaHTTP)
+	}
+	viaWebSocket.RequestID, viaHTTP.RequestID = "", ""
+	if !reflect.DeepEqual(viaWebSocket, viaHTTP) {
+		t.Fatalf("por WebSocket llegó %+v y por HTTP %+v", viaWebSocket, viaHTTP)
+	}
+}
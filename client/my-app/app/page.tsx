@@ -1,6 +1,6 @@
 'use client'
 
-import { useState, useEffect } from 'react'
+import { useState, useEffect, useRef } from 'react'
 import Papa from 'papaparse'
 import { Input } from "@/components/ui/input"
 import { Button } from "@/components/ui/button"
@@ -36,6 +36,9 @@ export default function MovieRecommender() {
   const [recommendations, setRecommendations] = useState<Movie[]>([])
   const [searchTerm, setSearchTerm] = useState('')
   const [socket, setSocket] = useState<WebSocket | null>(null)
+  const sessionId = useRef<string | null>(null) // Sesión WebSocket que recibe nuestras recomendaciones
+  const pendingRequest = useRef<string | null>(null) // Solicitud enviada por WebSocket que esperamos
+  const [partialResults, setPartialResults] = useState<Record<number, Movie[]>>({}) // Resultados por shard mientras llega el final
   const [currentPage, setCurrentPage] = useState(1)
   const [isLoading, setIsLoading] = useState(false)
   const [totalPages, setTotalPages] = useState(1);
@@ -75,6 +78,48 @@ export default function MovieRecommender() {
     ws.onmessage = (event) => {
       const data = JSON.parse(event.data)
       console.log('WebSocket message:', data)
+      const toMovies = (ids: number[]) =>
+        ids.map((id) => allMovies.find((movie) => movie.id === id.toString())).filter((movie): movie is Movie => !!movie)
+      // El primer mensaje trae el ID de la sesión, que se envía con cada solicitud
+      if (data.type === 'session') {
+        sessionId.current = data.sessionId
+        return
+      }
+      // Las respuestas a las solicitudes enviadas por WebSocket: confirmación,
+      // resultado de cada shard y ranking final, o un error
+      if (data.requestId && data.requestId === pendingRequest.current) {
+        if (data.type === 'ack') {
+          return
+        }
+        if (data.type === 'partial') {
+          setPartialResults(prev => ({ ...prev, [data.shard]: toMovies(data.movieIds ?? []) }))
+          return
+        }
+        if (data.type === 'error') {
+          pendingRequest.current = null
+          setPartialResults({})
+          setIsSubmitting(false)
+          toast({
+            title: 'Error',
+            description: data.error?.message ?? 'Hubo un error al obtener las recomendaciones',
+            variant: 'destructive',
+          })
+          return
+        }
+        if (data.type === 'recommendations') {
+          pendingRequest.current = null
+          setPartialResults({})
+          toast({
+            title: 'Éxito',
+            description: 'Películas recomendadas recibidas con éxito',
+            variant: 'default',
+          })
+        }
+      }
+      // Los mensajes de solicitudes anteriores se ignoran
+      if (data.type !== 'recommendations' || (pendingRequest.current && data.requestId !== pendingRequest.current)) {
+        return
+      }
       console.log('Movie IDs:', data.movieIds)
       console.log('All Movies:', allMovies)
       if (Array.isArray(data.movieIds)) {
@@ -90,7 +135,10 @@ export default function MovieRecommender() {
       }
     }
     ws.onerror = (error) => console.log('WebSocket error:', error)
-    ws.onclose = () => console.log('WebSocket connection closed')
+    ws.onclose = () => {
+      console.log('WebSocket connection closed')
+      sessionId.current = null
+    }
     setSocket(ws)
   }
 
@@ -124,10 +172,26 @@ export default function MovieRecommender() {
   const handleSubmit = async () => {
     if (selectedMovies.length === 5) {
       setIsSubmitting(true)
+      // Con el WebSocket abierto, la solicitud va por él y los resultados se
+      // muestran a medida que responden los nodos
+      if (socket && socket.readyState === WebSocket.OPEN) {
+        const requestId = crypto.randomUUID()
+        pendingRequest.current = requestId
+        setPartialResults({})
+        socket.send(JSON.stringify({
+          type: 'recommend',
+          requestId,
+          movieIds: selectedMovies.map(m => parseInt(m.id, 10)),
+        }))
+        return
+      }
       try {
         const response = await fetch('http://localhost:5902/api', {
           method: 'POST',
-          headers: { 'Content-Type': 'application/json' },
+          headers: {
+            'Content-Type': 'application/json',
+            ...(sessionId.current ? { 'X-Session-ID': sessionId.current } : {}),
+          },
           body: JSON.stringify({ movieIds: selectedMovies.map(m => parseInt(m.id, 10)) }),
         })
         const data = await response.json()
@@ -309,6 +373,21 @@ export default function MovieRecommender() {
         </TabsContent>
 
         <TabsContent value="recommendations">
+          {isSubmitting && Object.keys(partialResults).length > 0 && (
+            <div className="mb-6">
+              <h2 className="text-xl font-semibold mb-4">Resultados parciales</h2>
+              {Object.entries(partialResults).map(([shard, shardMovies]) => (
+                <div key={shard} className="mb-2">
+                  <p className="text-sm text-gray-500 mb-1">Shard {shard}</p>
+                  <div className="flex flex-wrap gap-2">
+                    {shardMovies.map((movie) => (
+                      <Badge key={movie.id} variant="outline" className="text-sm py-1 px-2">{movie.name}</Badge>
+                    ))}
+                  </div>
+                </div>
+              ))}
+            </div>
+          )}
           <h2 className="text-xl font-semibold mb-4">Peliculas Recomendadas</h2>
           <div className="grid grid-cols-1 md:grid-cols-2 lg:grid-cols-3 gap-4">
             {recommendations.map((movie) => (
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trazas del nodo con el SDK de OpenTelemetry, como en la API y el
+// coordinador. Cada mensaje del coordinador trae en traceparent el tramo
+// que lo envió, y los tramos del nodo cuelgan de él.
+
+var (
+	traceExporter = getEnv("TRACE_EXPORTER", "none") // "none", "stdout" u "otlp"
+	serviceName   = getEnv("OTEL_SERVICE_NAME", "nodo-172.20.0.2")
+)
+
+const (
+	traceQueueSize     = 4096            // Tramos en espera de exportarse; si se llena se descartan
+	traceBatchSize     = 256             // Tramos por envío al colector
+	traceFlushInterval = 2 * time.Second // Espera máxima antes de exportar
+	traceFlushTimeout  = 5 * time.Second // Espera máxima de la exportación final al apagarse
+)
+
+var (
+	tracer         = otel.Tracer("recomendaciones")
+	propagator     = propagation.TraceContext{}
+	tracerProvider *sdktrace.TracerProvider
+)
+
+// Instala el proveedor de tramos; con TRACE_EXPORTER=none los tramos no se
+// exportan, pero el ID de la traza sigue llegando a los registros
+func initTracing() {
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK())
+	if err != nil {
+		slog.Warn("Error al leer los atributos del servicio para las trazas", "error", err)
+	}
+	options := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if exporter := newSpanExporter(); exporter != nil {
+		slog.Info("Exportador de trazas", "exporter", traceExporter)
+		options = append(options, sdktrace.WithBatcher(exporter,
+			sdktrace.WithMaxQueueSize(traceQueueSize),
+			sdktrace.WithMaxExportBatchSize(traceBatchSize),
+			sdktrace.WithBatchTimeout(traceFlushInterval)))
+	}
+	tracerProvider = sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(tracerProvider)
+}
+
+// Exportador elegido con TRACE_EXPORTER, o nil si no se exportan tramos
+func newSpanExporter() sdktrace.SpanExporter {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch traceExporter {
+	case "none":
+		return nil
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	case "otlp":
+		// Sin OTEL_EXPORTER_OTLP_ENDPOINT se envía al colector local
+		var options []otlptracehttp.Option
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+			options = append(options, otlptracehttp.WithEndpointURL("http://localhost:4318/v1/traces"))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	default:
+		slog.Warn("Exportador de trazas desconocido; no se exportan tramos", "exporter", traceExporter)
+		return nil
+	}
+	if err != nil {
+		slog.Warn("Error al crear el exportador de trazas; no se exportan tramos", "exporter", traceExporter, "error", err)
+		return nil
+	}
+	return exporter
+}
+
+// Registra un tramo que ya terminó, para etapas medidas antes de conocer
+// el contexto, como decodificar el mensaje que lo trae
+func recordSpan(ctx context.Context, name string, start, end time.Time) {
+	_, span := tracer.Start(ctx, name, trace.WithTimestamp(start))
+	span.End(trace.WithTimestamp(end))
+}
+
+// Contexto cuyo tramo actual es el remoto que indica traceparent. Si el
+// valor no es válido, los tramos siguientes empiezan una traza nueva.
+func contextWithTraceParent(ctx context.Context, traceparent string) context.Context {
+	return propagator.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+}
+
+// Exporta los tramos pendientes antes de que termine el proceso
+func flushTraces() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), traceFlushTimeout)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		slog.Warn("No se pudieron exportar los últimos tramos", "error", err)
+	}
+}
@@ -1,17 +1,479 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"math"
+	"math/rand"
 	"net"
 	"os"
+	"os/signal"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Estructura para almacenar la matriz de calificaciones
 type RatingData struct {
 	Ratings map[int]map[int]float64
+	Dates   map[int]map[int]int64 // Fecha (Unix) de cada calificación; vacío si el dataset no la incluye
+}
+
+// Calificación individual que llega con las actualizaciones del servidor
+type Rating struct {
+	UserID  int
+	MovieID int
+	Rating  float64
+	Date    int64 // Segundos Unix; 0 si no se conoce
+}
+
+// Películas de un shard con sus calificaciones, tal como las envía el servidor
+type ShardData struct {
+	Shard   int
+	Version int64
+	Vectors map[int]map[int]float64 // Película → usuario → calificación
+	Dates   map[int]map[int]int64   // Película → usuario → fecha
+}
+
+// Calificaciones nuevas de un shard. Solo se aplican si la copia del shard
+// está en BaseVersion; Version es la versión resultante.
+type RatingDelta struct {
+	Shard       int
+	BaseVersion int64
+	Version     int64
+	Ratings     []Rating
+}
+
+// Tipos de mensaje que el servidor envía al nodo
+const (
+	MessageRecommend = "recommend"  // Solicitud de recomendaciones sobre un shard
+	MessageLoadShard = "load_shard" // Carga (o recarga) completa de un shard
+	MessageRatings   = "ratings"    // Calificaciones nuevas de un shard
+	MessageCancel    = "cancel"     // El servidor ya no espera la respuesta en curso
+	MessageHealth    = "health"     // Chequeo de salud: el nodo informa sus shards y su carga
+	MessageDropShard = "drop_shard" // El shard se asignó a otros nodos y se borra
+)
+
+// Mensaje que el servidor envía al nodo; solo viene el campo de su tipo
+type NodeMessage struct {
+	Type        string
+	RequestID   string // Solicitud de la API que originó el mensaje, para los registros
+	TraceParent string // Contexto de la traza del mensaje (W3C traceparent)
+	Recommend   *NodeRequest
+	Shard       *ShardData
+	Delta       *RatingDelta
+}
+
+// Códigos de error que el nodo devuelve al servidor
+const (
+	ErrDatasetNotLoaded = "dataset_not_loaded"
+	ErrDatesNotLoaded   = "dates_not_loaded"
+	ErrBadRequest       = "bad_request"
+	ErrStaleShard       = "stale_shard"
+	ErrNodeBusy         = "node_busy"
+	ErrCanceled         = "canceled"
+	ErrDeadlineExceeded = "deadline_exceeded"
+)
+
+// Algoritmos de recomendación disponibles en el nodo
+const (
+	AlgorithmItemKNN    = "item-knn"   // Similitud de cosenos entre películas
+	AlgorithmUserKNN    = "user-knn"   // Películas de los usuarios más parecidos
+	AlgorithmPopularity = "popularity" // Películas con más calificaciones
+	AlgorithmBayesian   = "bayesian"   // Mayor promedio bayesiano
+	AlgorithmTrending   = "trending"   // Más calificadas en la ventana de tiempo reciente
+)
+
+// Error tipado que viaja junto con la respuesta del nodo
+type NodeError struct {
+	Code    string
+	Message string
+}
+
+// Solicitudes de recomendaciones que el nodo calcula a la vez
+var maxWorkers = getEnvInt("NODE_WORKERS", runtime.NumCPU())
+
+// Solicitudes que pueden esperar a un trabajador libre; las demás se
+// rechazan como ocupado para que el servidor las envíe a otro nodo
+var maxQueue = getEnvInt("NODE_QUEUE", 2*maxWorkers)
+
+// Tiempo máximo para recibir un mensaje completo del servidor. Alcanza para
+// recibir un shard grande.
+const receiveTimeout = 10 * time.Minute
+
+// Búsqueda de películas similares en item-knn
+const (
+	SearchExact       = "exact"       // Se compara con todas las películas del shard
+	SearchApproximate = "approximate" // Solo con las cercanas según el índice LSH
+)
+
+// Cada cuántas películas los recorridos revisan si la solicitud se canceló
+const cancelCheckInterval = 256
+
+// Número de recomendaciones que devuelve el nodo si el servidor no pide otro
+const recommendationLimit = 5
+
+// Años alrededor de las favoritas que se consideran en el arranque en frío
+const coldStartYearWindow = 3
+
+// Ventana por defecto del algoritmo trending, en días
+const defaultTrendingWindowDays = 30
+
+// Película con su puntuación según un algoritmo
+type ScoredMovie struct {
+	MovieID int
+	Score   float64
+}
+
+// Solicitud que el servidor envía al nodo. El nodo puntúa solo las películas
+// del shard pedido; lo que depende del dataset completo (vectores de las
+// favoritas, vecinos, promedio global, fecha más reciente) lo calcula el
+// servidor y viaja en la solicitud.
+type NodeRequest struct {
+	Shard            int
+	FavoriteMovieIDs []int
+	FavoriteVectors  map[int]map[int]float64 // Vectores de las favoritas que aportan señal
+	FavoriteDates    map[int]map[int]int64   // Película → usuario → fecha de las favoritas
+	Neighbors        map[int]float64         // Usuarios más parecidos y su similitud (user-knn)
+	RatingData       RatingData              // Datos propios de la solicitud (evaluación); reemplazan al shard
+	Algorithm        string                  // Algoritmo de recomendación
+	Algorithms       []string                // Algoritmos a puntuar en modo ensamble
+	CandidateLimit   int                     // Candidatos a devolver por algoritmo
+	WindowDays       int                     // Ventana del algoritmo trending, en días
+	HalfLifeDays     float64                 // Vida media del peso de las calificaciones (0 = sin decaimiento)
+	LatestDate       int64                   // Fecha de la calificación más reciente del dataset
+	GlobalMean       float64                 // Promedio global de las calificaciones (bayesian)
+	BayesianPrior    float64                 // Peso del promedio global (bayesian)
+	FavoriteYears    map[int]int             // Año de las favoritas según el catálogo (puede estar vacío)
+	MovieYears       map[int]int             // Año de las películas del shard según el catálogo
+	Fallback         string                  // Algoritmo de arranque en frío que reemplaza a los personalizados
+	Search           string                  // Búsqueda de item-knn: exacta (por defecto) o aproximada
+	Timeout          time.Duration           // Plazo para responder; al vencer se abandona el cálculo
+}
+
+// Respuesta del nodo al servidor: candidatos puntuados o un error tipado
+type NodeResponse struct {
+	Shard   int
+	Version int64                    // Versión del shard usada o cargada
+	Scores  map[string][]ScoredMovie // Candidatos puntuados por algoritmo
+	Report  *NodeReport              // Respuesta a un chequeo de salud
+	Error   *NodeError
+}
+
+// Estado que el nodo informa en los chequeos de salud
+type NodeReport struct {
+	ShardVersions map[int]int64 // Shards cargados y su versión
+	Workers       int           // Trabajadores del nodo
+	Busy          int           // Trabajadores calculando recomendaciones
+	Queued        int           // Solicitudes esperando un trabajador
+}
+
+// Películas de un shard en memoria. Las normas de los vectores sirven de
+// índice para la similitud de cosenos y se actualizan con cada calificación.
+type shardStore struct {
+	version int64
+	vectors map[int]map[int]float64 // Película → usuario → calificación
+	dates   map[int]map[int]int64   // Película → usuario → fecha
+	norms   map[int]float64         // Suma de cuadrados de cada vector
+
+	annMu sync.Mutex
+	ann   *lshIndex // Índice para la búsqueda aproximada; se crea en la primera que se pide
+}
+
+// Shards cargados en el nodo
+var (
+	storeMu sync.RWMutex
+	shards  = make(map[int]*shardStore)
+)
+
+// Crea el almacén de un shard y calcula las normas de sus vectores
+func newShardStore(version int64, vectors map[int]map[int]float64, dates map[int]map[int]int64) *shardStore {
+	if dates == nil {
+		dates = make(map[int]map[int]int64)
+	}
+	store := &shardStore{
+		version: version,
+		vectors: vectors,
+		dates:   dates,
+		norms:   make(map[int]float64, len(vectors)),
+	}
+	for movieID, vector := range vectors {
+		for _, rating := range vector {
+			store.norms[movieID] += rating * rating
+		}
+	}
+	return store
+}
+
+// Crea un almacén con todas las películas de RatingData
+func storeFromRatingData(data RatingData) *shardStore {
+	dates := make(map[int]map[int]int64)
+	for userID, movies := range data.Dates {
+		for movieID, date := range movies {
+			if dates[movieID] == nil {
+				dates[movieID] = make(map[int]int64)
+			}
+			dates[movieID][userID] = date
+		}
+	}
+	return newShardStore(0, buildMovieVectors(data), dates)
+}
+
+// Agrega o reemplaza calificaciones sin reconstruir el shard: solo se
+// corrigen el vector y la norma de las películas afectadas
+func (s *shardStore) addRatings(ratings []Rating) {
+	for _, r := range ratings {
+		vector := s.vectors[r.MovieID]
+		if vector == nil {
+			vector = make(map[int]float64)
+			s.vectors[r.MovieID] = vector
+		}
+		previous := vector[r.UserID]
+		vector[r.UserID] = r.Rating
+		s.norms[r.MovieID] += r.Rating*r.Rating - previous*previous
+		if s.ann != nil {
+			s.ann.addRating(r.MovieID, r.UserID, r.Rating-previous)
+		}
+
+		if r.Date != 0 {
+			if s.dates[r.MovieID] == nil {
+				s.dates[r.MovieID] = make(map[int]int64)
+			}
+			s.dates[r.MovieID][r.UserID] = r.Date
+		}
+	}
+}
+
+// Índice LSH del shard, creado la primera vez que se necesita. Varias
+// solicitudes pueden pedirlo a la vez mientras leen el shard.
+func (s *shardStore) annIndex() *lshIndex {
+	s.annMu.Lock()
+	defer s.annMu.Unlock()
+	if s.ann == nil {
+		s.ann = newLSHIndex(s.vectors)
+	}
+	return s.ann
+}
+
+// Índice de vecinos aproximados (LSH con hiperplanos aleatorios). Cada
+// película se representa con un embedding denso: la proyección aleatoria de
+// su vector de calificaciones, que conserva aproximadamente la similitud de
+// cosenos. Las películas cuyo embedding cae del mismo lado de los
+// hiperplanos de una tabla comparten cubeta en esa tabla.
+type lshIndex struct {
+	embeddings map[int]*[embeddingSize]float64
+	signatures map[int]*[lshTables]uint32
+	buckets    [lshTables]map[uint32]map[int]bool
+}
+
+// Parámetros del índice LSH
+const (
+	embeddingSize = 64 // Dimensiones de los embeddings
+	lshTables     = 8  // Tablas hash
+	lshBits       = 12 // Hiperplanos por tabla
+)
+
+// Hiperplanos de cada tabla. La semilla es fija para que el índice sea
+// reproducible.
+var lshPlanes = newLSHPlanes(1)
+
+func newLSHPlanes(seed int64) *[lshTables][lshBits][embeddingSize]float64 {
+	random := rand.New(rand.NewSource(seed))
+	planes := new([lshTables][lshBits][embeddingSize]float64)
+	for table := range planes {
+		for bit := range planes[table] {
+			for i := range planes[table][bit] {
+				planes[table][bit][i] = random.NormFloat64()
+			}
+		}
+	}
+	return planes
+}
+
+// Signos (±1) de un usuario en cada dimensión de la proyección, uno por bit.
+// Se derivan del ID para no guardar una matriz por usuario.
+func userProjection(userID int) uint64 {
+	x := uint64(userID) + 0x9E3779B97F4A7C15
+	x = (x ^ (x >> 30)) * 0xBF58476D1CE4E5B9
+	x = (x ^ (x >> 27)) * 0x94D049BB133111EB
+	return x ^ (x >> 31)
+}
+
+// Suma al embedding la contribución de una calificación
+func addProjection(embedding *[embeddingSize]float64, userID int, rating float64) {
+	signs := userProjection(userID)
+	for i := range embedding {
+		if signs>>i&1 == 1 {
+			embedding[i] += rating
+		} else {
+			embedding[i] -= rating
+		}
+	}
+}
+
+// Embedding denso de un vector de calificaciones
+func embedVector(vector map[int]float64) *[embeddingSize]float64 {
+	embedding := new([embeddingSize]float64)
+	for userID, rating := range vector {
+		addProjection(embedding, userID, rating)
+	}
+	return embedding
+}
+
+// Firma de un embedding en cada tabla: un bit por hiperplano
+func lshSignatures(embedding *[embeddingSize]float64) *[lshTables]uint32 {
+	signatures := new([lshTables]uint32)
+	for table := range lshPlanes {
+		for bit, plane := range lshPlanes[table] {
+			var dot float64
+			for i, value := range embedding {
+				dot += plane[i] * value
+			}
+			if dot >= 0 {
+				signatures[table] |= 1 << bit
+			}
+		}
+	}
+	return signatures
+}
+
+// Crea el índice con todas las películas del shard
+func newLSHIndex(vectors map[int]map[int]float64) *lshIndex {
+	index := &lshIndex{
+		embeddings: make(map[int]*[embeddingSize]float64, len(vectors)),
+		signatures: make(map[int]*[lshTables]uint32, len(vectors)),
+	}
+	for table := range index.buckets {
+		index.buckets[table] = make(map[uint32]map[int]bool)
+	}
+	for movieID, vector := range vectors {
+		index.embeddings[movieID] = embedVector(vector)
+		index.insert(movieID)
+	}
+	return index
+}
+
+// Agrega la película a las cubetas de su firma actual
+func (idx *lshIndex) insert(movieID int) {
+	signatures := lshSignatures(idx.embeddings[movieID])
+	idx.signatures[movieID] = signatures
+	for table, signature := range signatures {
+		bucket := idx.buckets[table][signature]
+		if bucket == nil {
+			bucket = make(map[int]bool)
+			idx.buckets[table][signature] = bucket
+		}
+		bucket[movieID] = true
+	}
+}
+
+// Actualiza el embedding de una película con el cambio de una calificación
+// y la mueve de cubeta si cambió su firma
+func (idx *lshIndex) addRating(movieID, userID int, change float64) {
+	embedding := idx.embeddings[movieID]
+	if embedding == nil {
+		embedding = new([embeddingSize]float64)
+		idx.embeddings[movieID] = embedding
+	}
+	addProjection(embedding, userID, change)
+
+	if signatures := idx.signatures[movieID]; signatures != nil {
+		for table, signature := range signatures {
+			delete(idx.buckets[table][signature], movieID)
+			if len(idx.buckets[table][signature]) == 0 {
+				delete(idx.buckets[table], signature)
+			}
+		}
+	}
+	idx.insert(movieID)
+}
+
+// Películas que comparten cubeta con alguna favorita en alguna tabla. También
+// se revisan las cubetas que difieren en un solo hiperplano, lo que mejora el
+// recall con pocas tablas.
+func (idx *lshIndex) candidates(favoriteVectors map[int]map[int]float64) map[int]bool {
+	candidates := make(map[int]bool)
+	for _, vector := range favoriteVectors {
+		signatures := lshSignatures(embedVector(vector))
+		for table, signature := range signatures {
+			for probe := -1; probe < lshBits; probe++ {
+				key := signature
+				if probe >= 0 {
+					key ^= 1 << probe
+				}
+				for movieID := range idx.buckets[table][key] {
+					candidates[movieID] = true
+				}
+			}
+		}
+	}
+	return candidates
+}
+
+// Guarda un shard completo enviado por el servidor
+func loadShard(data *ShardData) NodeResponse {
+	store := newShardStore(data.Version, data.Vectors, data.Dates)
+
+	storeMu.Lock()
+	shards[data.Shard] = store
+	storeMu.Unlock()
+
+	slog.Info("Shard cargado", "shard", data.Shard, "version", data.Version, "movies", len(data.Vectors))
+	return NodeResponse{Shard: data.Shard, Version: data.Version}
+}
+
+// Borra un shard que el servidor asignó a otros nodos. Espera a que
+// terminen las solicitudes que están leyendo los shards.
+func dropShard(shard int) NodeResponse {
+	storeMu.Lock()
+	_, loaded := shards[shard]
+	delete(shards, shard)
+	storeMu.Unlock()
+
+	if loaded {
+		slog.Info("Shard borrado", "shard", shard)
+	}
+	return NodeResponse{Shard: shard}
+}
+
+// Aplica calificaciones nuevas a un shard cargado. Si el nodo no tiene el
+// shard o se perdió alguna actualización, el servidor debe recargarlo.
+func applyDelta(delta *RatingDelta) NodeResponse {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	store, ok := shards[delta.Shard]
+	if !ok {
+		return NodeResponse{Shard: delta.Shard, Error: &NodeError{
+			Code:    ErrDatasetNotLoaded,
+			Message: fmt.Sprintf("el nodo no tiene el shard %d", delta.Shard),
+		}}
+	}
+	if delta.BaseVersion != store.version {
+		return NodeResponse{Shard: delta.Shard, Version: store.version, Error: &NodeError{
+			Code:    ErrStaleShard,
+			Message: fmt.Sprintf("el shard %d está en la versión %d y la actualización parte de la %d", delta.Shard, store.version, delta.BaseVersion),
+		}}
+	}
+	store.addRatings(delta.Ratings)
+	store.version = delta.Version
+
+	slog.Info("Shard actualizado", "shard", delta.Shard, "version", delta.Version, "ratings", len(delta.Ratings))
+	return NodeResponse{Shard: delta.Shard, Version: delta.Version}
 }
 
 // Calcular similitud de cosenos entre dos películas
@@ -51,126 +513,803 @@ func buildMovieVectors(data RatingData) map[int]map[int]float64 {
 	return movieVectors
 }
 
-// Buscar películas similares a las favoritas
-func findSimilarMovies(favoriteMovieIDs []int, data RatingData) []int {
-	movieRatings := buildMovieVectors(data)
-	similarities := make(map[int]float64)
+// Peso de cada calificación según su antigüedad: pierde la mitad de su peso
+// cada HalfLifeDays días, contados desde la calificación más reciente
+type timeDecay struct {
+	latest   int64
+	halfLife float64 // En segundos
+}
+
+// Crea el decaimiento pedido en la solicitud; devuelve nil si no se pidió o
+// si el dataset no tiene fechas, en cuyo caso todas las calificaciones pesan 1
+func newTimeDecay(request NodeRequest) *timeDecay {
+	if request.HalfLifeDays <= 0 || request.LatestDate == 0 {
+		return nil
+	}
+	return &timeDecay{
+		latest:   request.LatestDate,
+		halfLife: request.HalfLifeDays * 24 * 60 * 60,
+	}
+}
+
+// Peso de la calificación de un usuario a una película, con las fechas
+// indexadas por película
+func (d *timeDecay) weight(dates map[int]map[int]int64, movieID, userID int) float64 {
+	if d == nil {
+		return 1
+	}
+	date, ok := dates[movieID][userID]
+	if !ok {
+		return 1
+	}
+	return math.Pow(0.5, float64(d.latest-date)/d.halfLife)
+}
+
+// Multiplica cada calificación de los vectores por su peso temporal
+func applyTimeDecay(movieRatings map[int]map[int]float64, dates map[int]map[int]int64, decay *timeDecay) map[int]map[int]float64 {
+	if decay == nil {
+		return movieRatings
+	}
+	decayed := make(map[int]map[int]float64, len(movieRatings))
+	for movieID, vector := range movieRatings {
+		decayed[movieID] = make(map[int]float64, len(vector))
+		for userID, rating := range vector {
+			decayed[movieID][userID] = rating * decay.weight(dates, movieID, userID)
+		}
+	}
+	return decayed
+}
+
+// Suma de cuadrados de cada vector
+func vectorNorms(movieRatings map[int]map[int]float64) map[int]float64 {
+	norms := make(map[int]float64, len(movieRatings))
+	for movieID, vector := range movieRatings {
+		for _, rating := range vector {
+			norms[movieID] += rating * rating
+		}
+	}
+	return norms
+}
+
+// Similitud de cosenos con las sumas de cuadrados ya calculadas. Solo se
+// recorre el vector más corto.
+func cosineWithNorms(movie1 map[int]float64, norm1 float64, movie2 map[int]float64, norm2 float64) float64 {
+	if norm1 == 0 || norm2 == 0 {
+		return 0
+	}
+	if len(movie2) < len(movie1) {
+		movie1, movie2 = movie2, movie1
+	}
+	var dotProduct float64
+	for userID, rating1 := range movie1 {
+		if rating2, exists := movie2[userID]; exists {
+			dotProduct += rating1 * rating2
+		}
+	}
+	return dotProduct / (math.Sqrt(norm1) * math.Sqrt(norm2))
+}
+
+// Buscar películas similares a las favoritas entre las del shard
+func findSimilarMovies(ctx context.Context, favoriteVectors map[int]map[int]float64, movieRatings map[int]map[int]float64, norms map[int]float64) map[int]float64 {
+	return scanSimilarMovies(ctx, favoriteVectors, movieRatings, norms, runtime.GOMAXPROCS(0))
+}
+
+// Recorre los candidatos repartidos entre workers goroutines. Cada una
+// acumula las similitudes de su parte en su propio mapa y al final se juntan.
+// Si ctx se cancela, las goroutines se detienen y el resultado queda parcial.
+func scanSimilarMovies(ctx context.Context, favoriteVectors map[int]map[int]float64, movieRatings map[int]map[int]float64, norms map[int]float64, workers int) map[int]float64 {
+	favoriteNorms := vectorNorms(favoriteVectors)
+
+	candidates := make([]int, 0, len(movieRatings))
+	for movieID := range movieRatings {
+		candidates = append(candidates, movieID)
+	}
+	workers = max(1, min(workers, len(candidates)))
+	partSize := (len(candidates) + workers - 1) / workers
+
+	partials := make([]map[int]float64, workers)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		part := candidates[min(worker*partSize, len(candidates)):min((worker+1)*partSize, len(candidates))]
+		wg.Add(1)
+		go func(worker int, part []int) {
+			defer wg.Done()
+			similarities := make(map[int]float64, len(part))
 
-	// Recorremos las películas favoritas
-	for _, favID := range favoriteMovieIDs {
-		favVector, exists := movieRatings[favID]
-		if !exists {
-			fmt.Printf("La película %d no está en los datos.\n", favID)
+			// Recorremos las películas de esta parte y calculamos similitudes
+			for i, movieID := range part {
+				if i%cancelCheckInterval == 0 && ctx.Err() != nil {
+					break
+				}
+				vector := movieRatings[movieID]
+				// Recorremos las películas favoritas
+				for favID, favVector := range favoriteVectors {
+					if movieID != favID {
+						// Calculamos la similitud entre la película favorita y otras
+						similarity := cosineWithNorms(favVector, favoriteNorms[favID], vector, norms[movieID])
+						// Acumulamos la similitud
+						similarities[movieID] += similarity
+						// Mostrar la similitud en consola (opcional)
+						// fmt.Printf("Similitud entre %d y %d: %f\n", favID, movieID, similarity)
+					}
+				}
+			}
+			partials[worker] = similarities
+		}(worker, part)
+	}
+	wg.Wait()
+
+	// Juntar los resultados parciales; cada película está en una sola parte
+	similarities := make(map[int]float64, len(candidates))
+	for _, partial := range partials {
+		for movieID, similarity := range partial {
+			similarities[movieID] = similarity
+		}
+	}
+	return similarities
+}
+
+// Puntúa las películas del shard con las calificaciones de los usuarios más
+// parecidos a las favoritas, que el servidor elige con el dataset completo
+func findNeighborMovies(ctx context.Context, neighbors map[int]float64, store *shardStore, decay *timeDecay) map[int]float64 {
+	scores := make(map[int]float64)
+	var scanned int
+	for movieID, vector := range store.vectors {
+		if scanned++; scanned%cancelCheckInterval == 0 && ctx.Err() != nil {
+			break
+		}
+		for userID, similarity := range neighbors {
+			if rating, ok := vector[userID]; ok {
+				scores[movieID] += similarity * rating * decay.weight(store.dates, movieID, userID)
+			}
+		}
+	}
+	return scores
+}
+
+// Puntúa las películas del shard con un algoritmo personalizado a partir de
+// las favoritas, aplicando el decaimiento temporal si se pidió
+func personalizedScores(ctx context.Context, algorithm string, request NodeRequest, store *shardStore) map[int]float64 {
+	search := request.Search
+	if search == "" {
+		search = SearchExact
+	}
+	defer prometheus.NewTimer(similarityScanDuration.WithLabelValues(algorithm, search)).ObserveDuration()
+	ctx, span := tracer.Start(ctx, "node.similarity_scan")
+	span.SetAttributes(attribute.String("algorithm", algorithm), attribute.String("search", search))
+	defer span.End()
+
+	decay := newTimeDecay(request)
+	if algorithm == AlgorithmUserKNN {
+		return findNeighborMovies(ctx, request.Neighbors, store, decay)
+	}
+	movieRatings := store.vectors
+	if request.Search == SearchApproximate {
+		// Solo se comparan las películas que el índice considera cercanas
+		movieRatings = make(map[int]map[int]float64)
+		for movieID := range store.annIndex().candidates(request.FavoriteVectors) {
+			movieRatings[movieID] = store.vectors[movieID]
+		}
+	}
+	if decay == nil {
+		return findSimilarMovies(ctx, request.FavoriteVectors, movieRatings, store.norms)
+	}
+	// Con decaimiento las normas guardadas no sirven y se recalculan
+	candidates := applyTimeDecay(movieRatings, store.dates, decay)
+	favorites := applyTimeDecay(request.FavoriteVectors, request.FavoriteDates, decay)
+	return findSimilarMovies(ctx, favorites, candidates, vectorNorms(candidates))
+}
+
+// Cantidad de calificaciones de cada película; con decaimiento temporal
+// las calificaciones antiguas cuentan menos
+func mostRatedScores(request NodeRequest, store *shardStore) (map[int]float64, *NodeError) {
+	decay := newTimeDecay(request)
+	scores := make(map[int]float64)
+	for movieID, vector := range store.vectors {
+		for userID := range vector {
+			scores[movieID] += decay.weight(store.dates, movieID, userID)
+		}
+	}
+	return scores, nil
+}
+
+// Promedio bayesiano de cada película: el promedio propio se acerca al
+// promedio global cuando la película tiene pocas calificaciones. El servidor
+// envía el promedio global y su peso, calculados con el dataset completo.
+// Con decaimiento temporal cada calificación pesa según su antigüedad.
+func bayesianScores(request NodeRequest, store *shardStore) (map[int]float64, *NodeError) {
+	decay := newTimeDecay(request)
+	scores := make(map[int]float64)
+	for movieID, vector := range store.vectors {
+		var sum, votes float64
+		for userID, rating := range vector {
+			weight := decay.weight(store.dates, movieID, userID)
+			sum += weight * rating
+			votes += weight
+		}
+		if votes+request.BayesianPrior == 0 {
 			continue
 		}
+		scores[movieID] = (sum + request.BayesianPrior*request.GlobalMean) / (votes + request.BayesianPrior)
+	}
+	return scores, nil
+}
+
+// Cantidad de calificaciones de cada película dentro de los últimos
+// WindowDays días, contados desde la calificación más reciente del dataset
+func trendingScores(request NodeRequest, store *shardStore) (map[int]float64, *NodeError) {
+	if request.LatestDate == 0 {
+		return nil, &NodeError{
+			Code:    ErrDatesNotLoaded,
+			Message: "el dataset no incluye las fechas de las calificaciones",
+		}
+	}
+
+	windowDays := request.WindowDays
+	if windowDays <= 0 {
+		windowDays = defaultTrendingWindowDays
+	}
+
+	since := request.LatestDate - int64(windowDays)*24*60*60
 
-		// Recorremos todas las películas y calculamos similitudes
-		for movieID, vector := range movieRatings {
-			if movieID != favID {
-				// Calculamos la similitud entre la película favorita y otras
-				similarity := calculateCosineSimilarity(favVector, vector)
-				// Acumulamos la similitud
-				similarities[movieID] += similarity
-				// Mostrar la similitud en consola (opcional)
-				// fmt.Printf("Similitud entre %d y %d: %f\n", favID, movieID, similarity)
+	scores := make(map[int]float64)
+	for movieID, users := range store.dates {
+		for _, date := range users {
+			if date >= since {
+				scores[movieID]++
 			}
 		}
 	}
+	return scores, nil
+}
+
+// Recomendador no personalizado: asigna una puntuación a cada película
+type baselineScorer func(request NodeRequest, store *shardStore) (map[int]float64, *NodeError)
+
+// Recomendadores no personalizados por nombre de algoritmo. También se usan
+// como respaldo en el arranque en frío.
+var baselineScorers = map[string]baselineScorer{
+	AlgorithmPopularity: mostRatedScores,
+	AlgorithmBayesian:   bayesianScores,
+	AlgorithmTrending:   trendingScores,
+}
+
+// Puntúa las películas con un recomendador no personalizado, sin incluir las favoritas
+func baselineRecommendations(request NodeRequest, store *shardStore, algorithm string) (map[int]float64, *NodeError) {
+	scorer, ok := baselineScorers[algorithm]
+	if !ok {
+		return nil, &NodeError{
+			Code:    ErrBadRequest,
+			Message: fmt.Sprintf("algoritmo desconocido: %s", algorithm),
+		}
+	}
+	scores, nodeErr := scorer(request, store)
+	if nodeErr != nil {
+		return nil, nodeErr
+	}
+	for _, favID := range request.FavoriteMovieIDs {
+		delete(scores, favID)
+	}
+	return scores, nil
+}
+
+// Recomendaciones no personalizadas para cuando las favoritas no aportan
+// señal. Si el catálogo conoce el año de las favoritas, se prefieren
+// películas de años cercanos.
+func coldStartRecommendations(request NodeRequest, store *shardStore) ([]ScoredMovie, *NodeError) {
+	scores, nodeErr := baselineRecommendations(request, store, request.Fallback)
+	if nodeErr != nil {
+		return nil, nodeErr
+	}
+
+	// Años de las favoritas según el catálogo
+	var favoriteYears []int
+	for _, favID := range request.FavoriteMovieIDs {
+		if year, ok := request.FavoriteYears[favID]; ok {
+			favoriteYears = append(favoriteYears, year)
+		}
+	}
+	limit := resultLimit(request)
+	if len(favoriteYears) == 0 {
+		return topScoredMovies(scores, limit), nil
+	}
 
-	// Ordenar las películas por similitud y devolver las más relevantes
-	return sortMoviesByScore(similarities, 5)
+	nearby := make(map[int]float64)
+	for movieID, score := range scores {
+		year, ok := request.MovieYears[movieID]
+		if !ok {
+			continue
+		}
+		for _, favYear := range favoriteYears {
+			if year >= favYear-coldStartYearWindow && year <= favYear+coldStartYearWindow {
+				nearby[movieID] = score
+				break
+			}
+		}
+	}
+	// Si hay muy pocas películas de esos años se usa el ranking completo
+	if len(nearby) < limit {
+		return topScoredMovies(scores, limit), nil
+	}
+	return topScoredMovies(nearby, limit), nil
 }
 
-// Ordenar películas por puntuación
-func sortMoviesByScore(scores map[int]float64, limit int) []int {
-	type movieScore struct {
-		movieID int
-		score   float64
+// Cantidad de recomendaciones a devolver: las que pide el servidor (por
+// ejemplo, para diversificar el resultado final) o las de siempre
+func resultLimit(request NodeRequest) int {
+	if request.CandidateLimit > 0 {
+		return request.CandidateLimit
 	}
+	return recommendationLimit
+}
 
+// Devuelve las películas con mayor puntuación junto con su puntuación
+func topScoredMovies(scores map[int]float64, limit int) []ScoredMovie {
 	// Crear una lista de las películas y sus puntuaciones
-	var movieList []movieScore
+	var movieList []ScoredMovie
 	for movieID, score := range scores {
-		movieList = append(movieList, movieScore{movieID, score})
+		movieList = append(movieList, ScoredMovie{movieID, score})
 	}
 
-	// Ordenar por puntuación (de mayor a menor)
+	// Ordenar por puntuación (de mayor a menor); los empates se resuelven por
+	// ID para que todos los nodos devuelvan el mismo orden
 	sort.Slice(movieList, func(i, j int) bool {
-		return movieList[i].score > movieList[j].score
+		if movieList[i].Score != movieList[j].Score {
+			return movieList[i].Score > movieList[j].Score
+		}
+		return movieList[i].MovieID < movieList[j].MovieID
 	})
 
 	// Recoger las mejores recomendaciones hasta el límite
-	var sortedMovieIDs []int
-	for i, movie := range movieList {
-		if i >= limit {
-			break
-		}
-		sortedMovieIDs = append(sortedMovieIDs, movie.movieID)
+	if len(movieList) > limit {
+		movieList = movieList[:limit]
 	}
-
-	return sortedMovieIDs
+	return movieList
 }
 
 // Función para enviar el resultado procesado al servidor
-func sendResult(conn net.Conn, result []int) error {
+func sendResult(conn net.Conn, result NodeResponse) error {
 	encoder := gob.NewEncoder(conn)
 	return encoder.Encode(result)
 }
 
+// Genera la respuesta del nodo con el shard pedido, o con los datos que
+// trae la solicitud si los tiene
+func buildResponse(ctx context.Context, request NodeRequest) NodeResponse {
+	if len(request.RatingData.Ratings) > 0 {
+		return scoreStore(ctx, request, storeFromRatingData(request.RatingData))
+	}
+
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+
+	store, ok := shards[request.Shard]
+	if !ok {
+		return NodeResponse{Shard: request.Shard, Error: &NodeError{
+			Code:    ErrDatasetNotLoaded,
+			Message: fmt.Sprintf("el nodo no tiene el shard %d", request.Shard),
+		}}
+	}
+	return scoreStore(ctx, request, store)
+}
+
+// Puntúa los candidatos de cada algoritmo pedido. En modo ensamble se piden
+// varios algoritmos; el servidor une los shards, normaliza y combina. Si la
+// solicitud se cancela a mitad, los puntajes parciales se descartan.
+func scoreStore(ctx context.Context, request NodeRequest, store *shardStore) NodeResponse {
+	algorithms := request.Algorithms
+	if len(algorithms) == 0 {
+		algorithm := request.Algorithm
+		if algorithm == "" {
+			algorithm = AlgorithmItemKNN
+		}
+		algorithms = []string{algorithm}
+	}
+
+	scores := make(map[string][]ScoredMovie)
+	for _, algorithm := range algorithms {
+		if ctx.Err() != nil {
+			break
+		}
+		personalized := algorithm == AlgorithmItemKNN || algorithm == AlgorithmUserKNN
+		switch {
+		case personalized && request.Fallback != "":
+			// Arranque en frío: las favoritas no aportan señal
+			candidates, nodeErr := coldStartRecommendations(request, store)
+			if nodeErr != nil {
+				return NodeResponse{Shard: request.Shard, Error: nodeErr}
+			}
+			scores[algorithm] = candidates
+		case personalized:
+			// Sin favoritas útiles el algoritmo no aporta candidatos
+			algorithmScores := personalizedScores(ctx, algorithm, request, store)
+			for _, favID := range request.FavoriteMovieIDs {
+				delete(algorithmScores, favID)
+			}
+			scores[algorithm] = topScoredMovies(algorithmScores, resultLimit(request))
+		default:
+			algorithmScores, nodeErr := baselineRecommendations(request, store, algorithm)
+			if nodeErr != nil {
+				return NodeResponse{Shard: request.Shard, Error: nodeErr}
+			}
+			scores[algorithm] = topScoredMovies(algorithmScores, resultLimit(request))
+		}
+	}
+
+	if ctx.Err() != nil {
+		return NodeResponse{Shard: request.Shard, Error: contextError(ctx)}
+	}
+	return NodeResponse{Shard: request.Shard, Version: store.version, Scores: scores}
+}
+
+// Traduce la cancelación o el vencimiento de una solicitud a un error tipado
+func contextError(ctx context.Context) *NodeError {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &NodeError{Code: ErrDeadlineExceeded, Message: "venció el plazo de la solicitud"}
+	}
+	return &NodeError{Code: ErrCanceled, Message: "el servidor canceló la solicitud"}
+}
+
+// Lee una variable de entorno o devuelve el valor por defecto
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Lee una variable de entorno entera o devuelve el valor por defecto
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// Solicitud de recomendaciones en espera de un trabajador
+type recommendJob struct {
+	ctx      context.Context // Se cancela si el servidor ya no espera la respuesta
+	conn     net.Conn
+	payload  NodeRequest
+	received time.Time  // Cuándo entró a la cola
+	span     trace.Span // Tramo del mensaje; termina al responder
+}
+
+// Cola de solicitudes que atienden los trabajadores
+var jobs chan recommendJob
+
+// Inicia los trabajadores que calculan recomendaciones. Todos leen los
+// shards a la vez; solo las cargas y actualizaciones los bloquean.
+func startWorkers() {
+	jobs = make(chan recommendJob, maxQueue)
+	for i := 0; i < maxWorkers; i++ {
+		go func() {
+			for job := range jobs {
+				queueWait.Observe(time.Since(job.received).Seconds())
+				recordSpan(job.ctx, "node.queue_wait", job.received, time.Now())
+				busyWorkers.Add(1)
+				code := handleRecommend(job.ctx, job.conn, job.payload)
+				busyWorkers.Add(-1)
+				job.span.SetAttributes(attribute.String("code", code))
+				job.span.End()
+			}
+		}()
+	}
+	slog.Info("Trabajadores iniciados", "workers", maxWorkers, "queue", maxQueue)
+}
+
 // Función para manejar la conexión con el servidor
 func handleServerConnection(conn net.Conn) {
-	fmt.Println("Conexión establecida con el servidor")
+	conn = &meteredConn{Conn: conn}
+	start := time.Now()
 
-	// Decodificar el paquete recibido desde el servidor
-	var payload struct {
-		FavoriteMovieIDs []int
-		RatingData       RatingData
-	}
+	// Decodificar el mensaje recibido desde el servidor
+	var message NodeMessage
 
+	conn.SetReadDeadline(time.Now().Add(receiveTimeout))
 	decoder := gob.NewDecoder(conn)
-	if err := decoder.Decode(&payload); err != nil {
-		fmt.Println("Error al recibir datos del servidor:", err)
+	if err := decoder.Decode(&message); err != nil {
+		slog.Warn("Error al recibir datos del servidor", "error", err)
 		conn.Close()
 		return
 	}
+	conn.SetReadDeadline(time.Time{})
+
+	// Los chequeos de salud se responden sin pasar por la cola ni generar
+	// tramos, para no llenar las trazas
+	if message.Type == MessageHealth {
+		defer conn.Close()
+		if err := sendResult(conn, NodeResponse{Report: healthReport()}); err != nil {
+			slog.Warn("Error al responder el chequeo de salud", "error", err)
+		}
+		return
+	}
+
+	// Tramo del mensaje, hijo del que envió el servidor. Los registros llevan
+	// el ID de la solicitud de la API que lo originó.
+	ctx, span := tracer.Start(contextWithTraceParent(requestsCtx, message.TraceParent), "node."+message.Type, trace.WithSpanKind(trace.SpanKindServer))
+	ctx = withRequestID(ctx, message.RequestID)
+	slog.DebugContext(ctx, "Mensaje recibido del servidor", "type", message.Type)
+	recordSpan(ctx, "node.decode", start, time.Now())
+
+	var response NodeResponse
+	switch {
+	case message.Type == MessageLoadShard && message.Shard != nil:
+		response = loadShard(message.Shard)
+	case message.Type == MessageRatings && message.Delta != nil:
+		response = applyDelta(message.Delta)
+	case message.Type == MessageDropShard && message.Shard != nil:
+		response = dropShard(message.Shard.Shard)
+	case message.Type == MessageRecommend && message.Recommend != nil:
+		// Si todos los trabajadores están ocupados y la cola está llena se
+		// rechaza la solicitud en lugar de hacerla esperar
+		span.SetAttributes(attribute.Int("shard", message.Recommend.Shard))
+		ctx, cancel := requestContext(ctx, *message.Recommend)
+		select {
+		case jobs <- recommendJob{ctx: ctx, conn: conn, payload: *message.Recommend, received: time.Now(), span: span}:
+			watchCancel(ctx, decoder, cancel, message.Recommend.Shard)
+			return
+		default:
+			cancel()
+			slog.WarnContext(ctx, "Nodo ocupado: se rechaza la solicitud", "shard", message.Recommend.Shard)
+			response = NodeResponse{Shard: message.Recommend.Shard, Error: &NodeError{
+				Code:    ErrNodeBusy,
+				Message: fmt.Sprintf("el nodo tiene %d solicitudes en curso y %d en espera", maxWorkers, maxQueue),
+			}}
+		}
+	default:
+		response = NodeResponse{Error: &NodeError{
+			Code:    ErrBadRequest,
+			Message: fmt.Sprintf("mensaje desconocido: %s", message.Type),
+		}}
+	}
+	if response.Error != nil {
+		slog.WarnContext(ctx, "No se pudo atender el mensaje", "type", message.Type, "code", response.Error.Code, "error", response.Error.Message)
+		span.SetStatus(codes.Error, response.Error.Message)
+	}
+	respond(ctx, conn, response)
+	nodeRequests.WithLabelValues(message.Type, responseCode(response)).Inc()
+	nodeRequestDuration.WithLabelValues(message.Type).Observe(time.Since(start).Seconds())
+	span.SetAttributes(attribute.String("code", responseCode(response)))
+	span.End()
+}
+
+// Contexto de una solicitud, que vence con el plazo que envía el servidor
+func requestContext(parent context.Context, request NodeRequest) (context.Context, context.CancelFunc) {
+	if request.Timeout > 0 {
+		return context.WithTimeout(parent, request.Timeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// Mientras un trabajador calcula, espera el aviso de cancelación del
+// servidor. Si llega, o si el servidor cierra la conexión antes de recibir
+// la respuesta, se cancela el cálculo. Al responder, el trabajador cierra la
+// conexión y la espera termina.
+func watchCancel(ctx context.Context, decoder *gob.Decoder, cancel context.CancelFunc, shard int) {
+	defer cancel()
+	var message NodeMessage
+	if err := decoder.Decode(&message); err == nil && message.Type == MessageCancel {
+		slog.InfoContext(ctx, "El servidor canceló la solicitud", "shard", shard)
+	}
+}
 
-	fmt.Printf("Películas favoritas recibidas: %v\n", payload.FavoriteMovieIDs)
-	fmt.Println("Datos de calificación recibidos exitosamente.")
+// Calcula las recomendaciones de una solicitud y responde al servidor.
+// Devuelve el resultado para las métricas y la traza.
+func handleRecommend(ctx context.Context, conn net.Conn, payload NodeRequest) string {
+	slog.InfoContext(ctx, "Solicitud de recomendaciones", "shard", payload.Shard, "favorites", len(payload.FavoriteMovieIDs), "algorithm", payload.Algorithm)
+	slog.DebugContext(ctx, "Películas favoritas", "movie_ids", payload.FavoriteMovieIDs)
+	start := time.Now()
+	defer prometheus.NewTimer(nodeRequestDuration.WithLabelValues(MessageRecommend)).ObserveDuration()
 
-	// Generar recomendaciones para las películas favoritas
-	recommendations := findSimilarMovies(payload.FavoriteMovieIDs, payload.RatingData)
+	// Generar recomendaciones para las películas favoritas. La solicitud pudo
+	// cancelarse mientras esperaba en la cola o durante el cálculo; en ese
+	// caso el servidor ya no espera la respuesta.
+	computeCtx, computeSpan := tracer.Start(ctx, "node.compute")
+	response := buildResponse(computeCtx, payload)
+	if response.Error != nil {
+		computeSpan.SetStatus(codes.Error, response.Error.Message)
+	}
+	computeSpan.End()
+	if errors.Is(ctx.Err(), context.Canceled) {
+		slog.InfoContext(ctx, "Solicitud cancelada, no se responde", "shard", payload.Shard)
+		nodeRequests.WithLabelValues(MessageRecommend, ErrCanceled).Inc()
+		conn.Close()
+		return ErrCanceled
+	}
 	// Recomendaciones de ejemplo:
-	// recommendations := []int{11, 12, 13, 14, 15}
-	fmt.Printf("Recomendaciones generadas para las películas favoritas: %v\n", recommendations)
+	// response := NodeResponse{Scores: map[string][]ScoredMovie{AlgorithmItemKNN: {{11, 5}, {12, 4}, {13, 3}, {14, 2}, {15, 1}}}}
+	if response.Error != nil {
+		slog.WarnContext(ctx, "No se pudieron generar recomendaciones", "code", response.Error.Code, "error", response.Error.Message)
+	} else {
+		for algorithm, candidates := range response.Scores {
+			slog.InfoContext(ctx, "Candidatos generados", "shard", payload.Shard, "algorithm", algorithm, "candidates", len(candidates), "duration", time.Since(start))
+		}
+	}
+	respond(ctx, conn, response)
+	nodeRequests.WithLabelValues(MessageRecommend, responseCode(response)).Inc()
+	return responseCode(response)
+}
 
-	// Enviar recomendaciones al servidor
-	if err := sendResult(conn, recommendations); err != nil {
-		fmt.Println("Error al enviar recomendaciones:", err)
+// Envía la respuesta al servidor y cierra la conexión
+func respond(ctx context.Context, conn net.Conn, response NodeResponse) {
+	defer conn.Close()
+	_, span := tracer.Start(ctx, "node.encode_response")
+	defer span.End()
+	if err := sendResult(conn, response); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		slog.WarnContext(ctx, "Error al enviar la respuesta", "error", err)
 	} else {
-		fmt.Println("Recomendaciones enviadas al servidor exitosamente.")
+		slog.DebugContext(ctx, "Respuesta enviada al servidor")
+	}
+}
+
+// Apagado ordenado. Con SIGTERM o SIGINT el nodo deja de aceptar
+// conexiones, avisa a los coordinadores que se apaga para que envíen las
+// consultas a otras copias y espera hasta shutdownTimeout a que terminen las
+// solicitudes en curso. Las que no terminan a tiempo se cancelan.
+
+// Dirección del nodo, que se informa a los coordinadores al apagarse
+const nodeAddr = "172.20.0.3:9002"
+
+// Coordinadores a los que el nodo avisa que se apaga; solo el líder lo atiende
+var coordinators = parseCoordinators(getEnv("COORDINATORS", "172.20.0.5:9002"))
+
+var shutdownTimeout = time.Duration(getEnvInt("SHUTDOWN_TIMEOUT", 20)) * time.Second
+
+const (
+	leaveTimeout      = time.Second // Plazo de cada coordinador para responder el aviso
+	cancelGracePeriod = time.Second // Espera a que las solicitudes canceladas terminen
+)
+
+var (
+	shuttingDown      atomic.Bool
+	serverConnections sync.WaitGroup // Mensajes del servidor en curso
+
+	// Contexto de todas las solicitudes; se cancela si vence el plazo del apagado
+	requestsCtx, cancelRequests = context.WithCancel(context.Background())
+)
+
+// Separa la lista de COORDINATORS
+func parseCoordinators(value string) []string {
+	var addresses []string
+	for _, address := range strings.Split(value, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// Cierra el listener al recibir la señal de apagado, para que el ciclo de
+// aceptación termine. Desde ahí los chequeos de salud fallan.
+func closeOnSignal(listener net.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	slog.Info("Señal de apagado recibida; no se aceptan más conexiones", "signal", sig.String(), "busy", busyWorkers.Load(), "queued", len(jobs))
+	shuttingDown.Store(true)
+	listener.Close()
+}
+
+// Avisa a los coordinadores, espera las solicitudes en curso y exporta los
+// últimos tramos
+func shutdown() {
+	notifyLeaving()
+
+	if !waitTimeout(&serverConnections, shutdownTimeout) {
+		slog.Warn("Venció el plazo del apagado; se cancelan las solicitudes en curso", "timeout", shutdownTimeout, "busy", busyWorkers.Load(), "queued", len(jobs))
+		cancelRequests()
+		waitTimeout(&serverConnections, cancelGracePeriod)
+	}
+
+	flushTraces()
+	slog.Info("Nodo apagado", "node", nodeAddr)
+}
+
+// Avisa a todos los coordinadores que el nodo se apaga. El líder deja de
+// enviarle consultas y copia sus shards en otros nodos; los demás responden
+// not_leader. Si ninguno lo atiende, el líder lo detecta con los chequeos.
+func notifyLeaving() {
+	var wg sync.WaitGroup
+	var accepted atomic.Bool
+	for _, address := range coordinators {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			var response struct {
+				Error *NodeError `json:"error"`
+			}
+			err := callCoordinator(address, map[string]string{"type": "leave", "node": nodeAddr}, &response)
+			if err == nil && response.Error == nil {
+				accepted.Store(true)
+				slog.Info("El coordinador líder recibió el aviso de apagado", "coordinator", address)
+			} else if err != nil {
+				slog.Warn("No se pudo avisar al coordinador", "coordinator", address, "error", err)
+			}
+		}(address)
+	}
+	wg.Wait()
+	if !accepted.Load() {
+		slog.Warn("Ningún coordinador líder recibió el aviso de apagado")
+	}
+}
+
+// Envía un mensaje JSON a un coordinador y decodifica su respuesta
+func callCoordinator(address string, message any, response any) error {
+	conn, err := net.DialTimeout("tcp", address, leaveTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(leaveTimeout))
+	if err := json.NewEncoder(conn).Encode(message); err != nil {
+		return err
+	}
+	return json.NewDecoder(conn).Decode(response)
+}
+
+// Espera al grupo hasta el plazo; indica si terminó a tiempo
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
 	}
 }
 
 func main() {
+	slog.SetDefault(newLogger())
+
+	// Crear los tramos de las trazas y exportarlos
+	initTracing()
+
 	// Iniciar el servidor y escuchar por conexiones entrantes
-	listener, err := net.Listen("tcp", "172.20.0.3:9002")
+	listener, err := net.Listen("tcp", nodeAddr)
 	if err != nil {
-		fmt.Println("Error al iniciar el cliente:", err)
+		slog.Error("Error al iniciar el cliente", "error", err)
 		os.Exit(1)
 	}
 	defer listener.Close()
 
-	fmt.Println("Esperando conexiones entrantes en el puerto 172.20.0.3:9002...")
+	slog.Info("Esperando conexiones entrantes", "address", nodeAddr)
+
+	// Iniciar los trabajadores que calculan recomendaciones
+	startWorkers()
+
+	// Exponer las métricas y la salud del nodo
+	go serveHTTP()
+
+	// Dejar de aceptar conexiones al recibir SIGTERM o SIGINT
+	go closeOnSignal(listener)
 
 	// Escuchar por conexiones entrantes desde el servidor
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println("Error al aceptar conexión:", err)
+			if shuttingDown.Load() {
+				break
+			}
+			slog.Warn("Error al aceptar conexión", "error", err)
 			continue
 		}
 
-		// Procesar la conexión en una goroutine
-		handleServerConnection(conn)
+		// Procesar la conexión en una goroutine. Las solicitudes de
+		// recomendaciones terminan cuando el trabajador responde.
+		serverConnections.Add(1)
+		go func() {
+			defer serverConnections.Done()
+			handleServerConnection(conn)
+		}()
 	}
+
+	// Terminar las solicitudes en curso antes de salir
+	shutdown()
 }
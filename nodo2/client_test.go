@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Dataset de ejemplo para las pruebas: el que indique SAMPLE_DATASET o el
+// del contenedor del servidor. Si no existe se genera uno sintético.
+var (
+	sampleOnce      sync.Once
+	sampleStore     *shardStore
+	sampleFavorites map[int]map[int]float64
+)
+
+// Carga un CSV con el formato de los datasets (MovieID, CustomerID, Rating)
+func loadSampleCSV(path string) (RatingData, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return RatingData{}, err
+	}
+	defer file.Close()
+
+	data := RatingData{Ratings: make(map[int]map[int]float64)}
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	if _, err := reader.Read(); err != nil {
+		return data, err
+	}
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			break
+		}
+		movieID, _ := strconv.Atoi(record[0])
+		userID, _ := strconv.Atoi(record[1])
+		rating, _ := strconv.ParseFloat(record[2], 64)
+		if data.Ratings[userID] == nil {
+			data.Ratings[userID] = make(map[int]float64)
+		}
+		data.Ratings[userID][movieID] = rating
+	}
+	return data, nil
+}
+
+// Dataset sintético: pocas películas muy populares y muchas con pocas
+// calificaciones, como en el dataset de Netflix
+func syntheticSample() RatingData {
+	const users, movies, ratingsPerUser = 20000, 3000, 40
+	random := rand.New(rand.NewSource(1))
+	data := RatingData{Ratings: make(map[int]map[int]float64)}
+	for userID := 1; userID <= users; userID++ {
+		data.Ratings[userID] = make(map[int]float64)
+		for i := 0; i < ratingsPerUser; i++ {
+			movieID := 1 + int(float64(movies)*math.Pow(random.Float64(), 2))
+			data.Ratings[userID][movieID] = float64(1 + random.Intn(5))
+		}
+	}
+	return data
+}
+
+// Prepara el dataset de ejemplo y toma como favoritas las 5 películas con
+// más calificaciones
+func loadSample(tb testing.TB) (*shardStore, map[int]map[int]float64) {
+	sampleOnce.Do(func() {
+		path := os.Getenv("SAMPLE_DATASET")
+		if path == "" {
+			path = "/var/my-data/dataset_1.csv"
+		}
+		data, err := loadSampleCSV(path)
+		if err != nil || len(data.Ratings) == 0 {
+			data = syntheticSample()
+		}
+		sampleStore = storeFromRatingData(data)
+
+		movieIDs := make([]int, 0, len(sampleStore.vectors))
+		for movieID := range sampleStore.vectors {
+			movieIDs = append(movieIDs, movieID)
+		}
+		sort.Slice(movieIDs, func(i, j int) bool {
+			a, b := movieIDs[i], movieIDs[j]
+			if len(sampleStore.vectors[a]) != len(sampleStore.vectors[b]) {
+				return len(sampleStore.vectors[a]) > len(sampleStore.vectors[b])
+			}
+			return a < b
+		})
+		sampleFavorites = make(map[int]map[int]float64)
+		for _, movieID := range movieIDs[:min(5, len(movieIDs))] {
+			sampleFavorites[movieID] = sampleStore.vectors[movieID]
+		}
+	})
+	tb.Logf("dataset de ejemplo: %d películas, %d favoritas", len(sampleStore.vectors), len(sampleFavorites))
+	return sampleStore, sampleFavorites
+}
+
+// El recorrido en paralelo debe dar las mismas similitudes que el secuencial
+func TestScanSimilarMoviesMatchesSequential(t *testing.T) {
+	store, favorites := loadSample(t)
+	sequential := scanSimilarMovies(context.Background(), favorites, store.vectors, store.norms, 1)
+	for _, workers := range []int{2, 3, 8, len(store.vectors) + 1} {
+		parallel := scanSimilarMovies(context.Background(), favorites, store.vectors, store.norms, workers)
+		if len(parallel) != len(sequential) {
+			t.Fatalf("%d trabajadores: %d películas, se esperaban %d", workers, len(parallel), len(sequential))
+		}
+		for movieID, similarity := range sequential {
+			if math.Abs(parallel[movieID]-similarity) > 1e-9 {
+				t.Fatalf("%d trabajadores: película %d con similitud %v, se esperaba %v", workers, movieID, parallel[movieID], similarity)
+			}
+		}
+	}
+}
+
+// Escalamiento del recorrido de candidatos con la cantidad de trabajadores:
+//
+//	go test -bench=FindSimilarMovies -run=^$
+func BenchmarkFindSimilarMovies(b *testing.B) {
+	store, favorites := loadSample(b)
+	counts := []int{1, 2, 4, 8}
+	if procs := runtime.GOMAXPROCS(0); procs > 8 {
+		counts = append(counts, procs)
+	}
+	for _, workers := range counts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				scanSimilarMovies(context.Background(), favorites, store.vectors, store.norms, workers)
+			}
+		})
+	}
+}
+
+// Recorrido exacto de referencia: similitud de cosenos con todas las películas
+func exactSimilarMovies(favoriteVectors map[int]map[int]float64, movieRatings map[int]map[int]float64) map[int]float64 {
+	similarities := make(map[int]float64)
+	for favID, favVector := range favoriteVectors {
+		for movieID, vector := range movieRatings {
+			if movieID != favID {
+				similarities[movieID] += calculateCosineSimilarity(favVector, vector)
+			}
+		}
+	}
+	return similarities
+}
+
+// Fracción de las k mejores películas exactas que también están entre las k
+// mejores aproximadas
+func recallAt(exact, approximate map[int]float64, favorites map[int]map[int]float64, k int) float64 {
+	for favID := range favorites {
+		delete(exact, favID)
+		delete(approximate, favID)
+	}
+	found := make(map[int]bool)
+	for _, movie := range topScoredMovies(approximate, k) {
+		found[movie.MovieID] = true
+	}
+	expected := topScoredMovies(exact, k)
+	var hits int
+	for _, movie := range expected {
+		if found[movie.MovieID] {
+			hits++
+		}
+	}
+	return float64(hits) / float64(len(expected))
+}
+
+// Recall y latencia de la búsqueda aproximada frente al recorrido exacto:
+//
+//	go test -bench=SimilaritySearch -run=^$
+func BenchmarkSimilaritySearch(b *testing.B) {
+	const k = 50
+	store, favorites := loadSample(b)
+	store.annIndex()
+	exact := exactSimilarMovies(favorites, store.vectors)
+
+	b.Run("exact", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			exactSimilarMovies(favorites, store.vectors)
+		}
+		b.ReportMetric(1, "recall@50")
+	})
+
+	request := NodeRequest{FavoriteVectors: favorites, Search: SearchApproximate}
+	b.Run("approximate", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			personalizedScores(context.Background(), AlgorithmItemKNN, request, store)
+		}
+		candidates := store.annIndex().candidates(favorites)
+		b.ReportMetric(recallAt(exact, personalizedScores(context.Background(), AlgorithmItemKNN, request, store), favorites, k), "recall@50")
+		b.ReportMetric(float64(len(candidates))/float64(len(store.vectors)), "candidates/movies")
+	})
+}
+
+// Actualizar el índice calificación por calificación debe dejarlo igual
+// que crearlo desde cero con los datos finales
+func TestLSHIndexIncrementalUpdate(t *testing.T) {
+	data := syntheticSample()
+	store := storeFromRatingData(data)
+	store.annIndex()
+
+	random := rand.New(rand.NewSource(2))
+	var ratings []Rating
+	for i := 0; i < 500; i++ {
+		ratings = append(ratings, Rating{
+			UserID:  1 + random.Intn(25000),
+			MovieID: 1 + random.Intn(3100),
+			Rating:  float64(1 + random.Intn(5)),
+		})
+	}
+	store.addRatings(ratings)
+
+	rebuilt := newLSHIndex(store.vectors)
+	for movieID, embedding := range rebuilt.embeddings {
+		for i, value := range embedding {
+			if math.Abs(store.ann.embeddings[movieID][i]-value) > 1e-6 {
+				t.Fatalf("película %d: embedding %v en la dimensión %d, se esperaba %v", movieID, store.ann.embeddings[movieID][i], i, value)
+			}
+		}
+	}
+	for table := range rebuilt.buckets {
+		if len(rebuilt.buckets[table]) != len(store.ann.buckets[table]) {
+			t.Fatalf("tabla %d: %d cubetas, se esperaban %d", table, len(store.ann.buckets[table]), len(rebuilt.buckets[table]))
+		}
+		for signature, bucket := range rebuilt.buckets[table] {
+			for movieID := range bucket {
+				if !store.ann.buckets[table][signature][movieID] {
+					t.Fatalf("tabla %d: la película %d no está en la cubeta %x", table, movieID, signature)
+				}
+			}
+		}
+	}
+}
+
+// Una solicitud cancelada deja de recorrer el shard y responde con un error
+// tipado en lugar de puntajes parciales
+func TestScoreStoreStopsWhenCanceled(t *testing.T) {
+	store, favorites := loadSample(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if similarities := scanSimilarMovies(ctx, favorites, store.vectors, store.norms, 4); len(similarities) != 0 {
+		t.Fatalf("el recorrido cancelado devolvió %d películas", len(similarities))
+	}
+	response := scoreStore(ctx, NodeRequest{FavoriteVectors: favorites, Algorithm: AlgorithmItemKNN}, store)
+	if response.Error == nil || response.Error.Code != ErrCanceled {
+		t.Fatalf("error %+v, se esperaba %s", response.Error, ErrCanceled)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	response = scoreStore(ctx, NodeRequest{FavoriteVectors: favorites, Algorithm: AlgorithmItemKNN}, store)
+	if response.Error == nil || response.Error.Code != ErrDeadlineExceeded {
+		t.Fatalf("error %+v, se esperaba %s", response.Error, ErrDeadlineExceeded)
+	}
+}
+
+// En arranque en frío se prefieren las películas del shard de años cercanos
+// a los de las favoritas, aunque las favoritas no estén en el shard
+func TestColdStartPrefersNearbyYears(t *testing.T) {
+	store := newShardStore(1, map[int]map[int]float64{
+		10: {1: 5, 2: 5, 3: 5, 4: 5},
+		11: {1: 4, 2: 4, 3: 4},
+		12: {1: 3, 2: 3},
+		13: {1: 3},
+	}, nil)
+	request := NodeRequest{
+		FavoriteMovieIDs: []int{99},
+		Fallback:         AlgorithmPopularity,
+		CandidateLimit:   2,
+		FavoriteYears:    map[int]int{99: 2005},
+		MovieYears:       map[int]int{10: 1990, 11: 2005, 12: 2006, 13: 2004},
+	}
+
+	movies, nodeErr := coldStartRecommendations(request, store)
+	if nodeErr != nil {
+		t.Fatal(nodeErr.Message)
+	}
+	if len(movies) != 2 || movies[0].MovieID != 11 || movies[1].MovieID != 12 {
+		t.Fatalf("se recomendó %v, se esperaban 11 y 12", movies)
+	}
+
+	// Sin el año de las favoritas se usa el ranking completo
+	request.FavoriteYears = nil
+	movies, _ = coldStartRecommendations(request, store)
+	if len(movies) != 2 || movies[0].MovieID != 10 {
+		t.Fatalf("sin años se recomendó %v, se esperaba primero 10", movies)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Métricas del nodo en el formato de Prometheus, con client_golang como en
+// el coordinador, y chequeos de salud, en un puerto HTTP aparte. Además de
+// las del nodo se exportan las del proceso y del runtime de Go.
+
+// Dirección del endpoint de métricas
+const metricsAddr = "172.20.0.4:9090"
+
+// Límites de los histogramas de latencia, en segundos. Los recorridos de
+// los datasets completos pueden tardar varios minutos.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// Medidor o contador cuyo valor se lee al exportar, con una serie por cada
+// valor de sus etiquetas
+type funcCollector struct {
+	desc    *prometheus.Desc
+	kind    prometheus.ValueType
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+func (f funcCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- f.desc
+}
+
+func (f funcCollector) Collect(ch chan<- prometheus.Metric) {
+	f.collect(func(value float64, labelValues ...string) {
+		ch <- prometheus.MustNewConstMetric(f.desc, f.kind, value, labelValues...)
+	})
+}
+
+func newGaugeFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	prometheus.MustRegister(funcCollector{prometheus.NewDesc(name, help, labels, nil), prometheus.GaugeValue, collect})
+}
+
+// Atiende /metrics, /healthz y /readyz en su propio puerto, ya que el del
+// nodo habla gob
+func serveHTTP() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	slog.Info("Métricas y estado disponibles", "url", "http://"+metricsAddr)
+	if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+		slog.Error("Error al iniciar el endpoint de métricas", "error", err)
+	}
+}
+
+// Shards cargados y carga del nodo, para los chequeos del servidor
+func healthReport() *NodeReport {
+	report := &NodeReport{
+		ShardVersions: make(map[int]int64),
+		Workers:       maxWorkers,
+		Busy:          int(busyWorkers.Load()),
+		Queued:        len(jobs),
+	}
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	for shard, store := range shards {
+		report.ShardVersions[shard] = store.version
+	}
+	return report
+}
+
+// El proceso está vivo y atiende HTTP
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// Listo una vez que el servidor le cargó al menos un shard, y hasta que
+// empieza a apagarse
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "shutting_down"})
+		return
+	}
+	report := healthReport()
+	if len(report.ShardVersions) == 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "not_ready", "reason": "el nodo no tiene shards cargados"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ready", "shards": report.ShardVersions})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Conexión que cuenta los bytes enviados y recibidos y los suma a las
+// métricas al cerrarse
+type meteredConn struct {
+	net.Conn
+	sent      atomic.Int64
+	received  atomic.Int64
+	closeOnce sync.Once
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Add(int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Close() error {
+	c.closeOnce.Do(func() {
+		payloadBytes.WithLabelValues("received").Add(float64(c.received.Load()))
+		payloadBytes.WithLabelValues("sent").Add(float64(c.sent.Load()))
+	})
+	return c.Conn.Close()
+}
+
+// Métricas del nodo
+var (
+	nodeRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "node_requests_total",
+		Help: "Mensajes recibidos del servidor, por tipo y resultado",
+	}, []string{"type", "code"})
+	nodeRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "node_request_duration_seconds",
+		Help:    "Duración de la atención de cada mensaje, por tipo; en recommend no incluye la espera en la cola",
+		Buckets: latencyBuckets,
+	}, []string{"type"})
+	queueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "node_queue_wait_seconds",
+		Help:    "Espera de las solicitudes de recomendaciones en la cola",
+		Buckets: latencyBuckets,
+	})
+	similarityScanDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "node_similarity_scan_duration_seconds",
+		Help:    "Duración del recorrido de similitud de los algoritmos personalizados",
+		Buckets: latencyBuckets,
+	}, []string{"algorithm", "search"})
+	payloadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "node_payload_bytes_total",
+		Help: "Bytes intercambiados con el servidor",
+	}, []string{"direction"})
+	busyWorkers atomic.Int64
+)
+
+func init() {
+	newGaugeFunc("node_queue_length", "Solicitudes esperando un trabajador", nil,
+		func(emit func(float64, ...string)) { emit(float64(len(jobs))) })
+	newGaugeFunc("node_workers_busy", "Trabajadores calculando recomendaciones", nil,
+		func(emit func(float64, ...string)) { emit(float64(busyWorkers.Load())) })
+	newGaugeFunc("node_workers", "Trabajadores del nodo", nil,
+		func(emit func(float64, ...string)) { emit(float64(maxWorkers)) })
+	newGaugeFunc("node_shard_movies", "Películas de cada shard cargado", []string{"shard"},
+		func(emit func(float64, ...string)) {
+			storeMu.RLock()
+			defer storeMu.RUnlock()
+			for shard, store := range shards {
+				emit(float64(len(store.vectors)), strconv.Itoa(shard))
+			}
+		})
+	newGaugeFunc("node_shard_version", "Versión de cada shard cargado", []string{"shard"},
+		func(emit func(float64, ...string)) {
+			storeMu.RLock()
+			defer storeMu.RUnlock()
+			for shard, store := range shards {
+				emit(float64(store.version), strconv.Itoa(shard))
+			}
+		})
+}
+
+// Resultado de una respuesta para las métricas: el código de su error u "ok"
+func responseCode(response NodeResponse) string {
+	if response.Error != nil {
+		return response.Error.Code
+	}
+	return "ok"
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tamaño y vigencia de la caché de recomendaciones (0 = sin caché)
+var (
+	resultCacheSize = getEnvInt("RESULT_CACHE_SIZE", 1000)
+	resultCacheTTL  = time.Duration(getEnvInt("RESULT_CACHE_TTL_SECONDS", 300)) * time.Second
+)
+
+// Cada cuánto se informan los aciertos de la caché
+const cacheStatsInterval = time.Minute
+
+// Caché LRU de respuestas de recomendaciones. Las entradas vencen después
+// de ttl y, cuando la caché está llena, se descarta la usada hace más tiempo.
+type resultCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List               // Más reciente al frente
+	entries map[string]*list.Element // Clave → elemento de order
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// Entrada de la caché
+type cacheEntry struct {
+	key      string
+	response RecommendationResponse
+	expires  time.Time
+}
+
+var recommendationCache = newResultCache(resultCacheSize, resultCacheTTL)
+
+func newResultCache(size int, ttl time.Duration) *resultCache {
+	return &resultCache{size: size, ttl: ttl, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Indica si la caché está activa
+func (c *resultCache) enabled() bool {
+	return c.size > 0 && c.ttl > 0
+}
+
+// Busca una respuesta vigente y la marca como la más reciente
+func (c *resultCache) get(key string) (RecommendationResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if ok && time.Now().After(element.Value.(*cacheEntry).expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		c.misses.Add(1)
+		return RecommendationResponse{}, false
+	}
+	c.hits.Add(1)
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).response, true
+}
+
+// Guarda una respuesta; si la caché está llena descarta la menos usada
+func (c *resultCache) put(key string, response RecommendationResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &cacheEntry{key: key, response: response, expires: time.Now().Add(c.ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Vacía la caché, por ejemplo cuando cambian las calificaciones
+func (c *resultCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	clear(c.entries)
+}
+
+// Clave de una solicitud ya validada: las favoritas sin repetir y en orden,
+// los parámetros que afectan el resultado y la versión del dataset
+func cacheKey(request RecommendationRequest, version int64) string {
+	movieIDs := slices.Clone(request.MovieIDs)
+	slices.Sort(movieIDs)
+	movieIDs = slices.Compact(movieIDs)
+
+	var key strings.Builder
+	fmt.Fprintf(&key, "v%d|%s|%s|%s|w%d|h%g|d%g|", version, request.Algorithm, request.Search, request.ColdStart,
+		request.WindowDays, request.HalfLifeDays, request.Diversity)
+	algorithms := make([]string, 0, len(request.Weights))
+	for algorithm := range request.Weights {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+	for _, algorithm := range algorithms {
+		fmt.Fprintf(&key, "%s=%g,", algorithm, request.Weights[algorithm])
+	}
+	key.WriteByte('|')
+	for _, movieID := range movieIDs {
+		key.WriteString(strconv.Itoa(movieID))
+		key.WriteByte(',')
+	}
+	return key.String()
+}
+
+// Informa periódicamente los aciertos de la caché
+func runCacheStats() {
+	if !recommendationCache.enabled() {
+		return
+	}
+	var reported int64
+	for range time.Tick(cacheStatsInterval) {
+		hits, misses := recommendationCache.hits.Load(), recommendationCache.misses.Load()
+		if hits+misses == reported {
+			continue
+		}
+		reported = hits + misses
+		recommendationCache.mu.Lock()
+		entries := recommendationCache.order.Len()
+		recommendationCache.mu.Unlock()
+		slog.Info("Aciertos de la caché", "hits", hits, "misses", misses,
+			"hit_ratio", float64(hits)/float64(hits+misses), "entries", entries)
+	}
+}
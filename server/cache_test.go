@@ -0,0 +1,268 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Respuesta de prueba que se distingue por su primera película
+func cachedResponse(movieID int) RecommendationResponse {
+	return RecommendationResponse{MovieIDs: []int{movieID}}
+}
+
+// Busca una clave y devuelve la primera película de la respuesta, o 0 si
+// no está
+func cachedMovie(c *resultCache, key string) int {
+	response, ok := c.get(key)
+	if !ok {
+		return 0
+	}
+	return response.MovieIDs[0]
+}
+
+// Con la caché llena se descarta la entrada usada hace más tiempo
+func TestResultCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newResultCache(2, time.Minute)
+	cache.put("a", cachedResponse(1))
+	cache.put("b", cachedResponse(2))
+	// a pasa a ser la más reciente, así que la que sobra es b
+	if got := cachedMovie(cache, "a"); got != 1 {
+		t.Fatalf("a = %d, se esperaba 1", got)
+	}
+	cache.put("c", cachedResponse(3))
+
+	if got := cachedMovie(cache, "b"); got != 0 {
+		t.Fatal("b sigue en la caché; debería haberse descartado")
+	}
+	if cachedMovie(cache, "a") != 1 || cachedMovie(cache, "c") != 3 {
+		t.Fatal("se descartó una entrada usada más recientemente que b")
+	}
+
+	// Guardar una clave existente la reemplaza sin ocupar otro lugar
+	cache.put("a", cachedResponse(4))
+	if got := cachedMovie(cache, "a"); got != 4 {
+		t.Fatalf("a = %d después de reemplazarla, se esperaba 4", got)
+	}
+	if cache.order.Len() != 2 || len(cache.entries) != 2 {
+		t.Fatalf("la caché tiene %d entradas, se esperaban 2", cache.order.Len())
+	}
+	if hits, misses := cache.hits.Load(), cache.misses.Load(); hits != 4 || misses != 1 {
+		t.Fatalf("aciertos %d y fallos %d, se esperaba 4 y 1", hits, misses)
+	}
+}
+
+// Las entradas vencidas no se devuelven y se quitan de la caché
+func TestResultCacheExpires(t *testing.T) {
+	cache := newResultCache(10, time.Minute)
+	cache.put("a", cachedResponse(1))
+	cache.put("b", cachedResponse(2))
+	cache.entries["a"].Value.(*cacheEntry).expires = time.Now().Add(-time.Millisecond)
+
+	if got := cachedMovie(cache, "a"); got != 0 {
+		t.Fatal("se devolvió una entrada vencida")
+	}
+	if _, ok := cache.entries["a"]; ok || cache.order.Len() != 1 {
+		t.Fatal("la entrada vencida sigue en la caché")
+	}
+	if got := cachedMovie(cache, "b"); got != 2 {
+		t.Fatalf("b = %d, se esperaba 2: todavía está vigente", got)
+	}
+}
+
+// La clave no depende del orden ni de las repeticiones de las favoritas, ni
+// del orden en que se recorren los pesos
+func TestCacheKeyNormalization(t *testing.T) {
+	request := RecommendationRequest{
+		MovieIDs:  []int{3, 1, 2},
+		Algorithm: "ensemble",
+		Weights:   map[string]float64{"item-knn": 0.5, "user-knn": 0.3, "popularity": 0.2, "trending": 0.1},
+	}
+	key := cacheKey(request, 7)
+
+	same := request
+	same.MovieIDs = []int{2, 3, 1, 3, 2}
+	same.Weights = map[string]float64{"trending": 0.1, "popularity": 0.2, "user-knn": 0.3, "item-knn": 0.5}
+	// El orden de los mapas cambia entre recorridos: se prueban varios
+	for range 20 {
+		if got := cacheKey(same, 7); got != key {
+			t.Fatalf("clave %q, se esperaba %q", got, key)
+		}
+	}
+	// La solicitud original no se modifica
+	if !slices.Equal(same.MovieIDs, []int{2, 3, 1, 3, 2}) {
+		t.Fatalf("cacheKey modificó las favoritas: %v", same.MovieIDs)
+	}
+
+	different := map[string]RecommendationRequest{}
+	weights := request
+	weights.Weights = map[string]float64{"item-knn": 0.5, "user-knn": 0.3, "popularity": 0.2, "trending": 0.2}
+	different["otro peso"] = weights
+	movies := request
+	movies.MovieIDs = []int{1, 2}
+	different["otras favoritas"] = movies
+	algorithm := request
+	algorithm.Algorithm = "item-knn"
+	different["otro algoritmo"] = algorithm
+	for name, other := range different {
+		if cacheKey(other, 7) == key {
+			t.Errorf("%s: se obtuvo la misma clave", name)
+		}
+	}
+	if cacheKey(request, 8) == key {
+		t.Error("otra versión del dataset: se obtuvo la misma clave")
+	}
+}
+
+// Carga un dataset pequeño con su WAL en un directorio temporal y restaura
+// el estado del coordinador al terminar
+func useTestDataset(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	base := filepath.Join(dir, "dataset.csv")
+	if err := os.WriteFile(base, []byte("MovieID,CustomerID,Rating,Date\n1,1,1,2005-12-26\n2,1,5,2005-10-04\n3,2,5,2005-11-01\n1,4,5,2005-09-12\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	index, version, wal, err := recoverDataset(dir, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataMu.Lock()
+	previousDataset, previousVersion, previousShards := dataset, datasetVersion, slices.Clone(shardVersions)
+	dataset, datasetVersion = index, version
+	dataMu.Unlock()
+	ingestMu.Lock()
+	previousLog := ratingsLog
+	ratingsLog = wal
+	ingestMu.Unlock()
+	previousDir, previousBase := walDir, nodeDatasets[0]
+	walDir, nodeDatasets[0] = dir, base
+
+	t.Cleanup(func() {
+		walDir, nodeDatasets[0] = previousDir, previousBase
+		ingestMu.Lock()
+		if ratingsLog != nil {
+			ratingsLog.close()
+		}
+		ratingsLog = previousLog
+		ingestMu.Unlock()
+		dataMu.Lock()
+		dataset, datasetVersion = previousDataset, previousVersion
+		copy(shardVersions, previousShards)
+		dataMu.Unlock()
+	})
+}
+
+// Usa una caché de prueba en lugar de la del coordinador
+func useTestCache(t *testing.T) *resultCache {
+	t.Helper()
+	previous := recommendationCache
+	recommendationCache = newResultCache(10, time.Minute)
+	t.Cleanup(func() { recommendationCache = previous })
+	return recommendationCache
+}
+
+// Las calificaciones nuevas cambian la versión del dataset y vacían la caché
+func TestIngestRatingsPurgesCache(t *testing.T) {
+	resetElection(t)
+	becomeLeader(1)
+	useTestDataset(t)
+	a, b, c := answeringNode(t, 1), answeringNode(t, 2), answeringNode(t, 3)
+	useNodes(t, a.address, b.address, c.address)
+	cache := useTestCache(t)
+	cache.put("clave", cachedResponse(1))
+
+	response := ingestRatings(testContext(t), []RatingInput{{UserID: 3, MovieID: 1, Rating: 4}})
+	if response.Error != nil {
+		t.Fatalf("no se aceptaron las calificaciones: %v", response.Error.Message)
+	}
+	if response.Version != 1 {
+		t.Fatalf("versión %d, se esperaba 1", response.Version)
+	}
+	if cachedMovie(cache, "clave") != 0 || cache.order.Len() != 0 {
+		t.Fatal("la caché conserva respuestas de la versión anterior del dataset")
+	}
+}
+
+// El coordinador que pasa a ser líder vacía la caché al ponerse al día
+func TestPromotePurgesCache(t *testing.T) {
+	resetElection(t)
+	becomeLeader(1)
+	election.mu.Lock()
+	election.ready = false
+	// Con el estado del líder anterior no se vuelven a enviar los shards
+	election.state = &ClusterState{}
+	election.mu.Unlock()
+	useTestDataset(t)
+	cache := useTestCache(t)
+	cache.put("clave", cachedResponse(1))
+
+	promote(1)
+	if !isLeader() {
+		t.Fatal("el coordinador no quedó listo como líder")
+	}
+	if cachedMovie(cache, "clave") != 0 || cache.order.Len() != 0 {
+		t.Fatal("la caché conserva respuestas de antes de ser líder")
+	}
+}
+
+// Nodo que recomienda una película por vecino de user-knn (100 + el usuario)
+// con su similitud, para que la respuesta dependa de los vecinos
+func neighborsNode(t *testing.T) *fakeNode {
+	return startFakeNode(t, func(message NodeMessage) NodeResponse {
+		var candidates []ScoredMovie
+		for userID, similarity := range message.Recommend.Neighbors {
+			candidates = append(candidates, ScoredMovie{MovieID: 100 + userID, Score: similarity})
+		}
+		return NodeResponse{Shard: message.Recommend.Shard, Scores: map[string][]ScoredMovie{AlgorithmUserKNN: candidates}}
+	})
+}
+
+// Las favoritas repetidas no cuentan dos veces: la solicitud que las repite
+// da la misma respuesta que la que no, y comparten la entrada de la caché
+func TestDuplicateFavoritesShareResponse(t *testing.T) {
+	resetElection(t)
+	becomeLeader(1)
+	useTestDataset(t)
+	a, b, c := neighborsNode(t), neighborsNode(t), neighborsNode(t)
+	useNodes(t, a.address, b.address, c.address)
+	cache := useTestCache(t)
+
+	recommend := func(movieIDs []int, noCache bool) RecommendationResponse {
+		t.Helper()
+		response := sendThroughConnection(t, APIMessage{Type: "recommend", NoCache: noCache, RecommendationRequest: RecommendationRequest{
+			RequestID: "prueba",
+			MovieIDs:  movieIDs,
+			Algorithm: AlgorithmUserKNN,
+			ColdStart: ColdStartNone,
+		}})
+		if response.Error != nil {
+			t.Fatalf("la solicitud %v falló: %v", movieIDs, response.Error.Message)
+		}
+		return response
+	}
+
+	// Contando dos veces la película 1 el usuario 4 sería más parecido que
+	// el 1
+	repeated := recommend([]int{1, 99, 1, 2, 99}, true)
+	single := recommend([]int{1, 2, 99}, true)
+	if !slices.Equal(repeated.MovieIDs, []int{101, 104}) || !slices.Equal(repeated.MovieIDs, single.MovieIDs) {
+		t.Fatalf("con favoritas repetidas se recomendó %v y sin repetir %v, se esperaba [101 104]", repeated.MovieIDs, single.MovieIDs)
+	}
+	if !slices.Equal(repeated.UnknownMovieIDs, []int{99}) || !slices.Equal(single.UnknownMovieIDs, []int{99}) {
+		t.Fatalf("desconocidas %v y %v, se esperaba [99]", repeated.UnknownMovieIDs, single.UnknownMovieIDs)
+	}
+
+	// Las dos respuestas se guardaron en la misma entrada, y otra solicitud
+	// con repeticiones sale de ella
+	if cache.order.Len() != 1 {
+		t.Fatalf("la caché tiene %d entradas, se esperaba 1", cache.order.Len())
+	}
+	cached := recommend([]int{2, 99, 1, 1}, false)
+	if !cached.Cached || !slices.Equal(cached.MovieIDs, single.MovieIDs) || !slices.Equal(cached.UnknownMovieIDs, single.UnknownMovieIDs) {
+		t.Fatalf("respuesta %+v, se esperaba la guardada %+v", cached, single)
+	}
+}
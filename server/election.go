@@ -0,0 +1,515 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dirección de este coordinador y de todos los coordinadores del clúster,
+// incluido este. Solo el líder atiende solicitudes; los demás reciben su
+// estado y lo reemplazan si deja de renovar su concesión.
+var (
+	coordinatorAddr = getEnv("SERVER_ADDR", "172.20.0.5:9002")
+	coordinators    = parseCoordinators(getEnv("COORDINATORS", coordinatorAddr))
+)
+
+const (
+	electionTick      = 100 * time.Millisecond // Cada cuánto se revisa el estado de la elección
+	heartbeatInterval = time.Second            // Cada cuánto el líder renueva su concesión
+	leaseDuration     = 3 * time.Second        // Validez de la concesión del líder
+	electionJitter    = 2 * time.Second        // Espera aleatoria máxima antes de postularse
+	peerTimeout       = 500 * time.Millisecond // Plazo de los mensajes entre coordinadores
+)
+
+// Mensajes entre coordinadores
+const (
+	MessageVote      = "vote"      // Un candidato pide el voto
+	MessageHeartbeat = "heartbeat" // El líder renueva su concesión y replica su estado
+	MessageResign    = "resign"    // El líder se apaga y libera su concesión
+)
+
+// Estado del clúster que el líder replica en los demás coordinadores para
+// que el siguiente líder no tenga que reconstruirlo
+type ClusterState struct {
+	DatasetVersion int64      `json:"datasetVersion"`
+	ShardVersions  []int64    `json:"shardVersions"`
+	ShardReplicas  [][]string `json:"shardReplicas"`
+	DeadNodes      []string   `json:"deadNodes,omitempty"`
+}
+
+// Pedido de voto o renovación de la concesión entre coordinadores
+type LeaseMessage struct {
+	Term      int64         `json:"term"`
+	Candidate string        `json:"candidate"`       // Quien pide el voto o renueva la concesión
+	Version   int64         `json:"version"`         // Versión del dataset que conoce el candidato (votos)
+	State     *ClusterState `json:"state,omitempty"` // Solo en las renovaciones
+}
+
+// Respuesta a un LeaseMessage
+type LeaseResponse struct {
+	Term    int64  `json:"term"`
+	Granted bool   `json:"granted"`
+	Leader  string `json:"leader,omitempty"`
+}
+
+// Estado de la elección en este coordinador. Lo protege mu.
+var election struct {
+	mu          sync.Mutex
+	term        int64
+	votedFor    string        // Candidato votado en el término actual
+	leader      string        // Líder conocido; vacío durante una elección
+	leaseExpiry time.Time     // Hasta cuándo vale la concesión del líder
+	electionAt  time.Time     // Desde cuándo este coordinador puede postularse
+	lastRenewal time.Time     // Última renovación enviada, si es el líder
+	ready       bool          // Es el líder y ya puso al día el dataset
+	state       *ClusterState // Último estado recibido de un líder
+}
+
+// Separa la lista de coordinadores; este siempre está incluido
+func parseCoordinators(value string) []string {
+	var addresses []string
+	for _, address := range strings.Split(value, ",") {
+		address = strings.TrimSpace(address)
+		if address != "" && !slices.Contains(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+	if !slices.Contains(addresses, coordinatorAddr) {
+		addresses = append(addresses, coordinatorAddr)
+	}
+	return addresses
+}
+
+// Los demás coordinadores
+func peerCoordinators() []string {
+	var peers []string
+	for _, address := range coordinators {
+		if address != coordinatorAddr {
+			peers = append(peers, address)
+		}
+	}
+	return peers
+}
+
+// Espera aleatoria para que dos coordinadores no se postulen a la vez
+func randomJitter() time.Duration {
+	return time.Duration(rand.Int63n(int64(electionJitter)))
+}
+
+// Indica si este coordinador es el líder, su concesión sigue vigente y ya
+// puede atender solicitudes
+func isLeader() bool {
+	election.mu.Lock()
+	defer election.mu.Unlock()
+	return election.ready && election.leader == coordinatorAddr && time.Now().Before(election.leaseExpiry)
+}
+
+// Error que recibe la API cuando envía una solicitud a un coordinador que
+// no es el líder, con el líder conocido para que reintente allí
+func notLeaderError() *ServiceError {
+	election.mu.Lock()
+	leader := election.leader
+	election.mu.Unlock()
+	if leader == coordinatorAddr {
+		// Todavía está poniendo al día el dataset o perdió la concesión
+		leader = ""
+	}
+	return &ServiceError{
+		Code:    ErrNotLeader,
+		Message: fmt.Sprintf("el coordinador %s no es el líder", coordinatorAddr),
+		Leader:  leader,
+	}
+}
+
+// Versión del dataset más nueva que conoce este coordinador: la cargada o
+// la que informó el último líder
+func knownVersion() int64 {
+	dataMu.RLock()
+	version := datasetVersion
+	dataMu.RUnlock()
+	election.mu.Lock()
+	defer election.mu.Unlock()
+	if election.state != nil {
+		version = max(version, election.state.DatasetVersion)
+	}
+	return version
+}
+
+// Lleva adelante la elección: el líder renueva su concesión y los demás se
+// postulan cuando vence la del líder que conocían
+func runElection() {
+	election.mu.Lock()
+	// Un coordinador solo no tiene a quién esperar
+	if len(coordinators) > 1 {
+		election.electionAt = time.Now().Add(leaseDuration + randomJitter())
+	}
+	election.mu.Unlock()
+
+	for range time.Tick(electionTick) {
+		election.mu.Lock()
+		leading := election.leader == coordinatorAddr
+		renew := leading && time.Since(election.lastRenewal) >= heartbeatInterval && !shuttingDown.Load()
+		campaign := !leading && time.Now().After(election.leaseExpiry) && time.Now().After(election.electionAt) && !shuttingDown.Load()
+		election.mu.Unlock()
+
+		switch {
+		case renew:
+			renewLease()
+		case campaign:
+			runCampaign()
+		}
+	}
+}
+
+// Se postula en un término nuevo y pasa a ser líder si la mayoría lo vota
+func runCampaign() {
+	election.mu.Lock()
+	election.term++
+	term := election.term
+	election.votedFor = coordinatorAddr
+	election.leader = ""
+	// Si no gana, vuelve a intentar más tarde
+	election.electionAt = time.Now().Add(leaseDuration + randomJitter())
+	election.mu.Unlock()
+
+	if len(coordinators) > 1 {
+		slog.Info("El coordinador se postula como líder", "coordinator", coordinatorAddr, "term", term)
+	}
+	message := APIMessage{Type: MessageVote, Lease: &LeaseMessage{Term: term, Candidate: coordinatorAddr, Version: knownVersion()}}
+	votes := 1 + countGranted(term, message)
+	if votes <= len(coordinators)/2 {
+		return
+	}
+
+	election.mu.Lock()
+	if election.term != term {
+		election.mu.Unlock()
+		return
+	}
+	election.leader = coordinatorAddr
+	election.leaseExpiry = time.Now().Add(leaseDuration)
+	election.mu.Unlock()
+
+	slog.Info("Coordinador elegido líder", "coordinator", coordinatorAddr, "term", term, "votes", votes, "coordinators", len(coordinators))
+	renewLease()
+	go promote(term)
+}
+
+// Renueva la concesión del líder enviando el estado del clúster a los demás
+// coordinadores. La concesión se extiende desde el envío solo si la mayoría
+// lo aceptó; si vence sin mayoría, el líder deja de serlo.
+func renewLease() {
+	election.mu.Lock()
+	term := election.term
+	ready := election.ready
+	state := election.state
+	election.lastRenewal = time.Now()
+	election.mu.Unlock()
+
+	// Mientras pone al día el dataset, reenvía el estado del líder anterior
+	if ready {
+		state = currentClusterState()
+	}
+	sent := time.Now()
+	message := APIMessage{Type: MessageHeartbeat, Lease: &LeaseMessage{Term: term, Candidate: coordinatorAddr, State: state}}
+	acks := 1 + countGranted(term, message)
+
+	election.mu.Lock()
+	if election.term != term || election.leader != coordinatorAddr {
+		election.mu.Unlock()
+		return
+	}
+	if acks > len(coordinators)/2 {
+		election.leaseExpiry = sent.Add(leaseDuration)
+		election.mu.Unlock()
+		return
+	}
+	expired := time.Now().After(election.leaseExpiry)
+	election.mu.Unlock()
+	if expired {
+		slog.Warn("El coordinador no pudo renovar su concesión con la mayoría; deja de ser líder", "coordinator", coordinatorAddr)
+		stepDown(term)
+	}
+}
+
+// Envía el mensaje a los demás coordinadores y cuenta cuántos lo aceptaron.
+// Si alguno está en un término mayor, este coordinador lo adopta y deja de
+// ser líder.
+func countGranted(term int64, message APIMessage) int {
+	peers := peerCoordinators()
+	responses := make([]LeaseResponse, len(peers))
+	var wg sync.WaitGroup
+	for i, address := range peers {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			response, err := callPeer(address, message)
+			if err == nil {
+				responses[i] = response
+			}
+		}(i, address)
+	}
+	wg.Wait()
+
+	granted := 0
+	var newerTerm int64
+	for _, response := range responses {
+		if response.Granted {
+			granted++
+		}
+		newerTerm = max(newerTerm, response.Term)
+	}
+	if newerTerm > term {
+		election.mu.Lock()
+		if newerTerm > election.term {
+			election.term = newerTerm
+			election.votedFor = ""
+		}
+		election.mu.Unlock()
+		stepDown(term)
+		return 0
+	}
+	return granted
+}
+
+// Envía un mensaje de la elección a otro coordinador
+func callPeer(address string, message APIMessage) (LeaseResponse, error) {
+	conn, err := net.DialTimeout("tcp", address, peerTimeout)
+	if err != nil {
+		return LeaseResponse{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(peerTimeout))
+
+	if err := json.NewEncoder(conn).Encode(message); err != nil {
+		return LeaseResponse{}, err
+	}
+	var response LeaseResponse
+	err = json.NewDecoder(conn).Decode(&response)
+	return response, err
+}
+
+// Atiende un pedido de voto o una renovación de otro coordinador
+func handleLeaseMessage(messageType string, message *LeaseMessage) LeaseResponse {
+	if message == nil {
+		return LeaseResponse{}
+	}
+	now := time.Now()
+	dataMu.RLock()
+	loadedVersion := datasetVersion
+	dataMu.RUnlock()
+
+	election.mu.Lock()
+	wasLeader := election.leader == coordinatorAddr
+	term := election.term
+	if message.Term < election.term {
+		response := LeaseResponse{Term: election.term, Leader: election.leader}
+		election.mu.Unlock()
+		return response
+	}
+
+	if messageType == MessageResign {
+		// Sin esperar a que venza la concesión, los demás pueden postularse
+		if message.Term == election.term && election.leader == message.Candidate {
+			slog.Info("El coordinador líder se apaga y libera su concesión", "leader", message.Candidate, "term", message.Term)
+			election.leader = ""
+			election.leaseExpiry = now
+			election.electionAt = now.Add(randomJitter() / 4)
+		}
+		response := LeaseResponse{Term: election.term, Granted: true}
+		election.mu.Unlock()
+		return response
+	}
+
+	if messageType == MessageVote {
+		// Mientras la concesión del líder conocido siga vigente no se vota
+		// por otro, así no puede haber dos líderes a la vez
+		if election.leader != "" && election.leader != message.Candidate && now.Before(election.leaseExpiry) {
+			response := LeaseResponse{Term: election.term, Leader: election.leader}
+			election.mu.Unlock()
+			return response
+		}
+		if message.Term > election.term {
+			election.term, election.votedFor, election.leader = message.Term, "", ""
+		}
+		// Un candidato con un dataset más viejo perdería calificaciones
+		version := loadedVersion
+		if election.state != nil {
+			version = max(version, election.state.DatasetVersion)
+		}
+		granted := (election.votedFor == "" || election.votedFor == message.Candidate) && message.Version >= version
+		if granted {
+			election.votedFor = message.Candidate
+			// Se le da tiempo al candidato para enviar su primera renovación
+			election.electionAt = now.Add(leaseDuration + randomJitter())
+		}
+		response := LeaseResponse{Term: election.term, Granted: granted}
+		election.mu.Unlock()
+		if wasLeader && response.Term > term {
+			stepDown(term)
+		}
+		return response
+	}
+
+	// Renovación del líder del término
+	if message.Term > election.term {
+		election.votedFor = ""
+	}
+	election.term = message.Term
+	if election.leader != message.Candidate {
+		slog.Info("Nuevo coordinador líder", "leader", message.Candidate, "term", message.Term)
+	}
+	election.leader = message.Candidate
+	election.leaseExpiry = now.Add(leaseDuration)
+	election.electionAt = election.leaseExpiry.Add(randomJitter())
+	if message.State != nil {
+		election.state = message.State
+	}
+	election.mu.Unlock()
+
+	if wasLeader {
+		stepDown(term)
+	}
+	if message.State != nil {
+		applyClusterState(message.State)
+	}
+	return LeaseResponse{Term: message.Term, Granted: true}
+}
+
+// Deja de ser líder en el término dado: ya no atiende solicitudes y cierra
+// el WAL para que lo use el líder nuevo
+func stepDown(term int64) {
+	election.mu.Lock()
+	if election.leader == coordinatorAddr {
+		if election.term != term {
+			// Ya es líder en un término posterior
+			election.mu.Unlock()
+			return
+		}
+		election.leader = ""
+	}
+	election.ready = false
+	election.mu.Unlock()
+
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+	if ratingsLog != nil {
+		ratingsLog.close()
+		ratingsLog = nil
+		slog.Info("El coordinador deja de ser líder y cierra el WAL", "coordinator", coordinatorAddr)
+	}
+}
+
+// Deja de ser líder al empezar el apagado, antes de esperar las solicitudes
+// en curso, y avisa a los demás coordinadores para que elijan otro líder sin
+// esperar a que venza la concesión
+func resign() {
+	election.mu.Lock()
+	leading, term := election.leader == coordinatorAddr, election.term
+	election.mu.Unlock()
+	if !leading {
+		return
+	}
+	slog.Info("El coordinador se apaga y deja de ser líder", "coordinator", coordinatorAddr, "term", term)
+	stepDown(term)
+	countGranted(term, APIMessage{Type: MessageResign, Lease: &LeaseMessage{Term: term, Candidate: coordinatorAddr}})
+}
+
+// Pone al día el dataset con el WAL y el estado replicado por el líder
+// anterior y empieza a atender solicitudes. Las renovaciones siguen
+// mientras tanto, así la concesión no vence aunque la carga demore.
+func promote(term int64) {
+	election.mu.Lock()
+	state := election.state
+	election.mu.Unlock()
+
+	dataMu.Lock()
+	index, version, wal, err := catchUpDataset(walDir, nodeDatasets[0], dataset, datasetVersion)
+	if err != nil {
+		dataMu.Unlock()
+		slog.Error("Error al poner al día el dataset", "error", err)
+		stepDown(term)
+		return
+	}
+	dataset = index
+	datasetVersion = version
+	recommendationCache.purge()
+	switch {
+	case state != nil && state.DatasetVersion == version && len(state.ShardVersions) == len(shardVersions):
+		copy(shardVersions, state.ShardVersions)
+	default:
+		// Sin el estado del líder anterior no se sabe qué shards cambiaron:
+		// los nodos recargan los que tengan una versión anterior
+		for shard := range shardVersions {
+			shardVersions[shard] = version
+		}
+	}
+	dataMu.Unlock()
+
+	ingestMu.Lock()
+	election.mu.Lock()
+	current := election.term == term && election.leader == coordinatorAddr
+	if current {
+		election.ready = true
+		ratingsLog = wal
+	}
+	election.mu.Unlock()
+	ingestMu.Unlock()
+	if !current {
+		if wal != nil {
+			wal.close()
+		}
+		return
+	}
+	slog.Info("Coordinador listo para atender solicitudes", "coordinator", coordinatorAddr, "version", version)
+
+	// Si ya había un líder, los nodos tienen sus shards; si no, es el
+	// arranque del clúster y se envían
+	if state == nil {
+		distributeShards()
+	}
+}
+
+// Estado del clúster que el líder envía en cada renovación
+func currentClusterState() *ClusterState {
+	state := &ClusterState{}
+	dataMu.RLock()
+	state.DatasetVersion = datasetVersion
+	state.ShardVersions = slices.Clone(shardVersions)
+	dataMu.RUnlock()
+
+	placementMu.RLock()
+	for _, replicas := range shardReplicas {
+		state.ShardReplicas = append(state.ShardReplicas, slices.Clone(replicas))
+	}
+	for _, nodeIP := range nodeIPs {
+		if !nodeStatus[nodeIP].alive {
+			state.DeadNodes = append(state.DeadNodes, nodeIP)
+		}
+	}
+	placementMu.RUnlock()
+	return state
+}
+
+// Adopta la ubicación de los shards y el estado de los nodos del líder. Las
+// versiones de los shards se adoptan al pasar a ser líder, junto con el
+// dataset.
+func applyClusterState(state *ClusterState) {
+	placementMu.Lock()
+	defer placementMu.Unlock()
+	if len(state.ShardReplicas) == len(shardReplicas) {
+		for shard, replicas := range state.ShardReplicas {
+			shardReplicas[shard] = slices.Clone(replicas)
+		}
+	}
+	for _, nodeIP := range nodeIPs {
+		nodeStatus[nodeIP].alive = !slices.Contains(state.DeadNodes, nodeIP)
+	}
+}
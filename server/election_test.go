@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Otros coordinadores de las pruebas
+const (
+	candidateA = "172.20.0.6:9002"
+	candidateB = "172.20.0.7:9002"
+)
+
+// Deja la elección como recién arrancada y la vuelve a dejar así al terminar
+func resetElection(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		election.mu.Lock()
+		election.term, election.votedFor, election.leader = 0, "", ""
+		election.leaseExpiry, election.electionAt, election.lastRenewal = time.Time{}, time.Time{}, time.Time{}
+		election.ready, election.state = false, nil
+		election.mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// Este coordinador es el líder del término, con la concesión vigente y el
+// dataset al día
+func becomeLeader(term int64) {
+	election.mu.Lock()
+	defer election.mu.Unlock()
+	election.term, election.votedFor, election.leader = term, coordinatorAddr, coordinatorAddr
+	election.leaseExpiry = time.Now().Add(leaseDuration)
+	election.ready = true
+}
+
+func vote(term int64, candidate string) LeaseResponse {
+	return handleLeaseMessage(MessageVote, &LeaseMessage{Term: term, Candidate: candidate})
+}
+
+func heartbeat(term int64, leader string) LeaseResponse {
+	return handleLeaseMessage(MessageHeartbeat, &LeaseMessage{Term: term, Candidate: leader})
+}
+
+// En un término se vota a un solo candidato
+func TestVoteOncePerTerm(t *testing.T) {
+	resetElection(t)
+
+	if response := vote(5, candidateA); !response.Granted || response.Term != 5 {
+		t.Fatalf("primer voto del término 5: %+v, se esperaba concedido", response)
+	}
+	if response := vote(5, candidateB); response.Granted {
+		t.Fatalf("se votó a %s y a %s en el término 5", candidateA, candidateB)
+	}
+	// Repetir el pedido del mismo candidato no cambia el voto
+	if response := vote(5, candidateA); !response.Granted {
+		t.Fatalf("se negó el voto repetido de %s: %+v", candidateA, response)
+	}
+	// En un término nuevo se puede votar a otro
+	if response := vote(6, candidateB); !response.Granted || response.Term != 6 {
+		t.Fatalf("voto del término 6: %+v, se esperaba concedido", response)
+	}
+	// Los pedidos de términos viejos se rechazan con el término actual
+	if response := vote(4, candidateA); response.Granted || response.Term != 6 {
+		t.Fatalf("voto del término 4: %+v, se esperaba rechazado con término 6", response)
+	}
+}
+
+// Mientras la concesión del líder sigue vigente no se vota a otro, ni
+// siquiera en un término mayor
+func TestNoVoteWhileLeaseIsValid(t *testing.T) {
+	resetElection(t)
+
+	if response := heartbeat(3, candidateA); !response.Granted {
+		t.Fatalf("se rechazó la renovación del líder: %+v", response)
+	}
+	response := vote(4, candidateB)
+	if response.Granted {
+		t.Fatal("se votó a otro candidato con la concesión del líder vigente")
+	}
+	if response.Leader != candidateA || response.Term != 3 {
+		t.Fatalf("respuesta %+v, se esperaba el líder %s en el término 3", response, candidateA)
+	}
+
+	// Vencida la concesión, sí se vota
+	election.mu.Lock()
+	election.leaseExpiry = time.Now().Add(-time.Millisecond)
+	election.mu.Unlock()
+	if response := vote(4, candidateB); !response.Granted {
+		t.Fatalf("se negó el voto con la concesión vencida: %+v", response)
+	}
+}
+
+// Un candidato con un dataset más viejo que el conocido no recibe votos
+func TestNoVoteForStaleDataset(t *testing.T) {
+	resetElection(t)
+	election.mu.Lock()
+	election.state = &ClusterState{DatasetVersion: 7}
+	election.mu.Unlock()
+
+	if response := handleLeaseMessage(MessageVote, &LeaseMessage{Term: 1, Candidate: candidateA, Version: 6}); response.Granted {
+		t.Fatal("se votó a un candidato con la versión 6 del dataset; se conocía la 7")
+	}
+	if response := handleLeaseMessage(MessageVote, &LeaseMessage{Term: 2, Candidate: candidateA, Version: 7}); !response.Granted {
+		t.Fatalf("se negó el voto a un candidato al día: %+v", response)
+	}
+}
+
+// El líder que se apaga libera la concesión y los demás pueden votar enseguida
+func TestResignReleasesLease(t *testing.T) {
+	resetElection(t)
+	heartbeat(3, candidateA)
+
+	// Solo el líder del término puede liberarla
+	handleLeaseMessage(MessageResign, &LeaseMessage{Term: 3, Candidate: candidateB})
+	if response := vote(4, candidateB); response.Granted {
+		t.Fatal("otro coordinador liberó la concesión del líder")
+	}
+
+	handleLeaseMessage(MessageResign, &LeaseMessage{Term: 3, Candidate: candidateA})
+	if response := vote(4, candidateB); !response.Granted {
+		t.Fatalf("se negó el voto después de que el líder liberó la concesión: %+v", response)
+	}
+}
+
+// Envía un mensaje al coordinador por una conexión en memoria y devuelve su
+// respuesta
+func sendThroughConnection(t *testing.T, message APIMessage) RecommendationResponse {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleAPIConnection(server)
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := json.NewEncoder(client).Encode(message); err != nil {
+		t.Fatal(err)
+	}
+	var response RecommendationResponse
+	if err := json.NewDecoder(client).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// Solicitud de recomendaciones con una favorita
+func requestThroughConnection(t *testing.T) RecommendationResponse {
+	t.Helper()
+	return sendThroughConnection(t, APIMessage{Type: "recommend", RecommendationRequest: RecommendationRequest{RequestID: "prueba", MovieIDs: []int{1}}})
+}
+
+// Un líder que recibe la renovación de un término mayor deja de serlo y
+// responde not_leader con el líder nuevo
+func TestSteppedDownLeaderRejectsRequests(t *testing.T) {
+	resetElection(t)
+	becomeLeader(1)
+	if !isLeader() {
+		t.Fatal("el coordinador debería ser el líder")
+	}
+
+	if response := heartbeat(2, candidateA); !response.Granted {
+		t.Fatalf("se rechazó la renovación del líder nuevo: %+v", response)
+	}
+	if isLeader() {
+		t.Fatal("el coordinador sigue siendo líder después de la renovación de un término mayor")
+	}
+	response := requestThroughConnection(t)
+	if response.Error == nil || response.Error.Code != ErrNotLeader {
+		t.Fatalf("respuesta %+v, se esperaba not_leader", response)
+	}
+	if response.Error.Leader != candidateA {
+		t.Fatalf("el error indica el líder %q, se esperaba %s", response.Error.Leader, candidateA)
+	}
+
+	// Sin renovar la concesión tampoco atiende, aunque siga creyéndose líder
+	resetElection(t)
+	becomeLeader(3)
+	election.mu.Lock()
+	election.leaseExpiry = time.Now().Add(-time.Millisecond)
+	election.mu.Unlock()
+	if response := requestThroughConnection(t); response.Error == nil || response.Error.Code != ErrNotLeader {
+		t.Fatalf("con la concesión vencida respondió %+v, se esperaba not_leader", response)
+	}
+}
+
+// Un líder cuya concesión venció no vacía el WAL compartido
+func TestCompactWALRequiresLeadership(t *testing.T) {
+	resetElection(t)
+	previousDir := walDir
+	walDir = t.TempDir()
+	t.Cleanup(func() { walDir = previousDir })
+
+	wal, _, err := openWAL(filepath.Join(walDir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.append(walRecord{Version: 1, Ratings: []Rating{{UserID: 1, MovieID: 1, Rating: 3}}}); err != nil {
+		t.Fatal(err)
+	}
+	ingestMu.Lock()
+	ratingsLog = wal
+	ingestMu.Unlock()
+	t.Cleanup(func() {
+		ingestMu.Lock()
+		ratingsLog = nil
+		ingestMu.Unlock()
+		wal.close()
+	})
+
+	becomeLeader(1)
+	election.mu.Lock()
+	election.leaseExpiry = time.Now().Add(-time.Millisecond)
+	election.mu.Unlock()
+	if err := compactWAL(); err != nil {
+		t.Fatal(err)
+	}
+	wal.mu.Lock()
+	size := wal.size
+	wal.mu.Unlock()
+	if size == 0 {
+		t.Fatal("un coordinador con la concesión vencida vació el WAL")
+	}
+
+	// Con la concesión vigente sí se compacta
+	becomeLeader(1)
+	if err := compactWAL(); err != nil {
+		t.Fatal(err)
+	}
+	wal.mu.Lock()
+	size = wal.size
+	wal.mu.Unlock()
+	if size != 0 {
+		t.Fatalf("el líder no compactó el WAL: quedan %d bytes", size)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Candidatos que cada nodo devuelve por algoritmo en modo ensamble
+const ensembleCandidates = 50
+
+// Algoritmos que pueden participar en el ensamble. No hay factorización de
+// matrices: los nodos no la implementan, así que un peso para ella se
+// rechaza como cualquier algoritmo desconocido.
+var ensembleAlgorithms = map[string]bool{
+	AlgorithmItemKNN:    true,
+	AlgorithmUserKNN:    true,
+	AlgorithmPopularity: true,
+	AlgorithmBayesian:   true,
+	AlgorithmTrending:   true,
+}
+
+// Pesos del ensamble configurados al iniciar el servidor
+var ensembleWeights = loadEnsembleWeights()
+
+// Lee los pesos de ENSEMBLE_WEIGHTS ("item-knn=0.5,user-knn=0.3,...") o
+// usa los pesos por defecto si la variable no está definida o es inválida
+func loadEnsembleWeights() map[string]float64 {
+	defaults := map[string]float64{
+		AlgorithmItemKNN:    0.5,
+		AlgorithmUserKNN:    0.3,
+		AlgorithmPopularity: 0.2,
+	}
+	value := getEnv("ENSEMBLE_WEIGHTS", "")
+	if value == "" {
+		return defaults
+	}
+	weights, err := parseEnsembleWeights(value)
+	if err != nil {
+		slog.Warn("ENSEMBLE_WEIGHTS inválido, se usan los pesos por defecto", "error", err)
+		return defaults
+	}
+	return weights
+}
+
+// Convierte "algoritmo=peso,..." en un mapa de pesos validado
+func parseEnsembleWeights(value string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, pair := range strings.Split(value, ",") {
+		name, rawWeight, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("se esperaba algoritmo=peso en %q", pair)
+		}
+		weight, err := strconv.ParseFloat(rawWeight, 64)
+		if err != nil {
+			return nil, fmt.Errorf("peso inválido para %s: %v", name, err)
+		}
+		weights[name] = weight
+	}
+	return weights, validateEnsembleWeights(weights)
+}
+
+// Verifica que los pesos correspondan a algoritmos conocidos, no sean
+// negativos y que al menos uno sea positivo
+func validateEnsembleWeights(weights map[string]float64) error {
+	var total float64
+	for name, weight := range weights {
+		if !ensembleAlgorithms[name] {
+			return fmt.Errorf("algoritmo desconocido en el ensamble: %s", name)
+		}
+		if weight < 0 {
+			return fmt.Errorf("el peso de %s no puede ser negativo", name)
+		}
+		total += weight
+	}
+	if total == 0 {
+		return fmt.Errorf("al menos un algoritmo del ensamble debe tener peso positivo")
+	}
+	return nil
+}
+
+// Combina las puntuaciones que devolvieron los shards. Las puntuaciones de
+// cada algoritmo se normalizan al rango [0, 1], con el mínimo y el máximo
+// de todos los shards, antes de aplicar su peso, ya que cada algoritmo usa
+// una escala distinta.
+func blendScores(results []nodeResult, weights map[string]float64) map[int]float64 {
+	// Unir los candidatos de todos los shards por algoritmo
+	candidates := make(map[string][]ScoredMovie)
+	for _, result := range results {
+		if result.err != nil {
+			continue
+		}
+		for algorithm, scored := range result.response.Scores {
+			candidates[algorithm] = append(candidates[algorithm], scored...)
+		}
+	}
+
+	blended := make(map[int]float64)
+	for algorithm, scored := range candidates {
+		if len(scored) == 0 {
+			continue
+		}
+		minScore, maxScore := scored[0].Score, scored[0].Score
+		for _, candidate := range scored {
+			minScore = min(minScore, candidate.Score)
+			maxScore = max(maxScore, candidate.Score)
+		}
+		for _, candidate := range scored {
+			normalized := 1.0
+			if maxScore > minScore {
+				normalized = (candidate.Score - minScore) / (maxScore - minScore)
+			}
+			blended[candidate.MovieID] += weights[algorithm] * normalized
+		}
+	}
+	return blended
+}
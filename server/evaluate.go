@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// Opciones de la evaluación fuera de línea. Por ejemplo:
+//
+//	go run *.go -evaluate=time -eval-algorithm=user-knn -eval-users=100
+var (
+	evaluateSplit     = flag.String("evaluate", "", "evalúa los algoritmos en lugar de atender solicitudes: time (división temporal) o random")
+	evalAlgorithm     = flag.String("eval-algorithm", AlgorithmItemKNN, "algoritmo a evaluar")
+	evalUsers         = flag.Int("eval-users", 50, "cantidad máxima de usuarios a evaluar")
+	evalTestFraction  = flag.Float64("eval-test-fraction", 0.2, "fracción de calificaciones que se reserva para prueba")
+	evalHalfLifeDays  = flag.Float64("eval-half-life-days", 0, "vida media del decaimiento temporal (0 = sin decaimiento)")
+	evalRelevantScore = flag.Float64("eval-relevant-rating", 4, "calificación mínima para considerar relevante una película de prueba")
+	evalSearch        = flag.String("eval-search", SearchExact, "búsqueda de item-knn: exact o approximate")
+)
+
+// Cantidad de recomendaciones evaluadas por usuario (precisión@k y recall@k)
+const evalK = recommendationLimit
+
+// Favoritas que se toman del entrenamiento de cada usuario
+const evalFavorites = 5
+
+// Calificación individual, usada para dividir el dataset
+type ratingEntry struct {
+	userID  int
+	movieID int
+	rating  float64
+	date    int64
+}
+
+// Divide las calificaciones en entrenamiento y prueba. Con la división
+// temporal todas las calificaciones de prueba son posteriores a las de
+// entrenamiento, como ocurre al recomendar en producción.
+func splitRatings(data RatingData, split string, testFraction float64) (RatingData, RatingData, error) {
+	var entries []ratingEntry
+	for userID, movies := range data.Ratings {
+		for movieID, rating := range movies {
+			entries = append(entries, ratingEntry{userID, movieID, rating, data.Dates[userID][movieID]})
+		}
+	}
+	// Orden fijo para que la división sea reproducible
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].userID != entries[j].userID {
+			return entries[i].userID < entries[j].userID
+		}
+		return entries[i].movieID < entries[j].movieID
+	})
+
+	switch split {
+	case "time":
+		if len(data.Dates) == 0 {
+			return RatingData{}, RatingData{}, fmt.Errorf("la división temporal requiere las fechas de las calificaciones")
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].date < entries[j].date })
+	case "random":
+		random := rand.New(rand.NewSource(1))
+		random.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+	default:
+		return RatingData{}, RatingData{}, fmt.Errorf("división desconocida: %s", split)
+	}
+
+	train := RatingData{Ratings: make(map[int]map[int]float64), Dates: make(map[int]map[int]int64)}
+	test := RatingData{Ratings: make(map[int]map[int]float64), Dates: make(map[int]map[int]int64)}
+	cutoff := int(float64(len(entries)) * (1 - testFraction))
+	for i, entry := range entries {
+		target := train
+		if i >= cutoff {
+			target = test
+		}
+		if target.Ratings[entry.userID] == nil {
+			target.Ratings[entry.userID] = make(map[int]float64)
+			target.Dates[entry.userID] = make(map[int]int64)
+		}
+		target.Ratings[entry.userID][entry.movieID] = entry.rating
+		if entry.date != 0 {
+			target.Dates[entry.userID][entry.movieID] = entry.date
+		}
+	}
+	return train, test, nil
+}
+
+// Favoritas de un usuario: sus películas mejor calificadas en entrenamiento,
+// las más recientes primero en caso de empate
+func userFavorites(train RatingData, userID int) []int {
+	var favorites []int
+	for movieID := range train.Ratings[userID] {
+		favorites = append(favorites, movieID)
+	}
+	sort.Slice(favorites, func(i, j int) bool {
+		a, b := favorites[i], favorites[j]
+		ratingA, ratingB := train.Ratings[userID][a], train.Ratings[userID][b]
+		if ratingA != ratingB {
+			return ratingA > ratingB
+		}
+		dateA, dateB := train.Dates[userID][a], train.Dates[userID][b]
+		if dateA != dateB {
+			return dateA > dateB
+		}
+		return a < b
+	})
+	if len(favorites) > evalFavorites {
+		favorites = favorites[:evalFavorites]
+	}
+	return favorites
+}
+
+// Pide recomendaciones para un usuario de evaluación al nodo indicado y
+// descarta las películas que el usuario ya calificó en entrenamiento. El
+// nodo puntúa todas las películas de entrenamiento, que viajan en la solicitud.
+func evaluationRecommendations(nodeIndex int, train *datasetIndex, request RecommendationRequest, seen map[int]float64) ([]int, *ServiceError) {
+	payload, _, _, serviceErr := train.nodeRequest(request)
+	if serviceErr != nil {
+		return nil, serviceErr
+	}
+	payload.RatingData = train.data
+	if payload.Fallback != "" {
+		// El nodo puntúa todas las películas de entrenamiento
+		payload.MovieYears = catalog.Years
+	}
+	if payload.CandidateLimit == 0 {
+		// Candidatos de sobra para descartar los ya vistos
+		payload.CandidateLimit = evalK + len(seen)
+	}
+
+	result := sendNodeMessage(context.Background(), nodeIPs[nodeIndex], NodeMessage{Type: MessageRecommend, Recommend: &payload})
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	scores := make(map[int]float64)
+	if request.Algorithm == AlgorithmEnsemble {
+		scores = blendScores([]nodeResult{result}, request.Weights)
+	} else {
+		for _, candidates := range result.response.Scores {
+			for _, candidate := range candidates {
+				scores[candidate.MovieID] = candidate.Score
+			}
+		}
+	}
+	for movieID := range seen {
+		delete(scores, movieID)
+	}
+	return sortMoviesByScore(scores, evalK), nil
+}
+
+// Evalúa un algoritmo: divide los datos, pide recomendaciones a los nodos
+// para cada usuario usando solo el entrenamiento y mide cuántas de ellas
+// aparecen entre sus películas relevantes de prueba
+func runEvaluation(split string) error {
+	train, test, err := splitRatings(dataset.data, split, *evalTestFraction)
+	if err != nil {
+		return err
+	}
+	trainIndex := newDatasetIndex(train)
+
+	request := RecommendationRequest{
+		Algorithm:    *evalAlgorithm,
+		HalfLifeDays: *evalHalfLifeDays,
+		Search:       *evalSearch,
+	}
+	if serviceErr := validateRequest(&request); serviceErr != nil {
+		return fmt.Errorf("%s: %s", serviceErr.Code, serviceErr.Message)
+	}
+
+	// Usuarios con historial de entrenamiento y alguna película relevante en prueba
+	relevant := make(map[int]map[int]bool)
+	var users []int
+	for userID, movies := range test.Ratings {
+		if len(train.Ratings[userID]) == 0 {
+			continue
+		}
+		for movieID, rating := range movies {
+			if rating >= *evalRelevantScore {
+				if relevant[userID] == nil {
+					relevant[userID] = make(map[int]bool)
+				}
+				relevant[userID][movieID] = true
+			}
+		}
+		if relevant[userID] != nil {
+			users = append(users, userID)
+		}
+	}
+	sort.Ints(users)
+	if len(users) > *evalUsers {
+		users = users[:*evalUsers]
+	}
+	if len(users) == 0 {
+		return fmt.Errorf("no hay usuarios con calificaciones relevantes en prueba")
+	}
+
+	fmt.Printf("Evaluando %s con división %s: %d usuarios, %.0f%% de las calificaciones para prueba.\n",
+		request.Algorithm, split, len(users), *evalTestFraction*100)
+
+	// Cada nodo atiende un usuario a la vez
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var precisionSum, recallSum float64
+	var hits, evaluated, failed int
+	jobs := make(chan int)
+	for nodeIndex := range nodeIPs {
+		wg.Add(1)
+		go func(nodeIndex int) {
+			defer wg.Done()
+			for userID := range jobs {
+				userRequest := request
+				userRequest.MovieIDs = userFavorites(train, userID)
+				recommendations, serviceErr := evaluationRecommendations(nodeIndex, trainIndex, userRequest, train.Ratings[userID])
+
+				mu.Lock()
+				if serviceErr != nil {
+					failed++
+				} else {
+					var userHits int
+					for _, movieID := range recommendations {
+						if relevant[userID][movieID] {
+							userHits++
+						}
+					}
+					precisionSum += float64(userHits) / evalK
+					recallSum += float64(userHits) / float64(len(relevant[userID]))
+					if userHits > 0 {
+						hits++
+					}
+					evaluated++
+				}
+				mu.Unlock()
+			}
+		}(nodeIndex)
+	}
+	for _, userID := range users {
+		jobs <- userID
+	}
+	close(jobs)
+	wg.Wait()
+
+	if evaluated == 0 {
+		return fmt.Errorf("ningún nodo pudo generar recomendaciones (%d fallos)", failed)
+	}
+	fmt.Printf("Usuarios evaluados: %d (fallos: %d)\n", evaluated, failed)
+	fmt.Printf("Precisión@%d: %.4f\n", evalK, precisionSum/float64(evaluated))
+	fmt.Printf("Recall@%d:    %.4f\n", evalK, recallSum/float64(evaluated))
+	fmt.Printf("Tasa de acierto: %.4f\n", float64(hits)/float64(evaluated))
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Percentil de la latencia reciente de los nodos a partir del cual la
+// consulta de un shard se repite en otro nodo (0 = sin consultas de respaldo)
+var hedgePercentile = getEnvInt("HEDGE_PERCENTILE", 95)
+
+const (
+	latencyWindow      = 500         // Latencias recientes que se conservan
+	hedgeMinSamples    = 20          // Con menos muestras no se envían respaldos
+	hedgeStatsInterval = time.Minute // Cada cuánto se informan los contadores
+)
+
+// Latencias de las últimas consultas de recomendaciones exitosas a los nodos
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration // Búfer circular
+	next    int
+}
+
+var nodeLatencies latencyTracker
+
+// Contadores de las consultas de respaldo
+var hedgeStats struct {
+	queries atomic.Int64 // Consultas de shards
+	fired   atomic.Int64 // Consultas en las que se envió un respaldo
+	won     atomic.Int64 // Respaldos que respondieron antes que la copia preferida
+}
+
+// Agrega una latencia y descarta la más antigua si la ventana está llena
+func (t *latencyTracker) record(latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) < latencyWindow {
+		t.samples = append(t.samples, latency)
+		return
+	}
+	t.samples[t.next] = latency
+	t.next = (t.next + 1) % latencyWindow
+}
+
+// Percentil p (entre 1 y 100) de las latencias recientes; false si todavía
+// hay pocas muestras
+func (t *latencyTracker) percentile(p int) (time.Duration, bool) {
+	t.mu.Lock()
+	sorted := append([]time.Duration(nil), t.samples...)
+	t.mu.Unlock()
+	if len(sorted) < hedgeMinSamples {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := (len(sorted)*p+99)/100 - 1
+	return sorted[max(0, min(index, len(sorted)-1))], true
+}
+
+// Tiempo que se espera a la copia preferida de un shard antes del respaldo
+func hedgeDelay() (time.Duration, bool) {
+	if hedgePercentile <= 0 || len(nodeIPs) < 2 {
+		return 0, false
+	}
+	return nodeLatencies.percentile(min(hedgePercentile, 100))
+}
+
+// Nodo que recibe la consulta de respaldo de un shard: otra copia viva. Si
+// no hay, no se envía respaldo, porque un nodo sin copia recibiría el shard
+// completo y lo conservaría sin actualizarlo.
+func hedgeNode(shard int, primary string) (string, bool) {
+	candidates := otherReplicas(shard, primary)
+	if len(candidates) == 0 {
+		return "", false
+	}
+	return candidates[0], true
+}
+
+// Consulta un shard en la copia preferida. Si no se puede conectar o está
+// ocupada, la consulta se reasigna a otra copia.
+func queryOwner(ctx context.Context, payload NodeRequest) nodeResult {
+	nodeIP := shardReplica(payload.Shard)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", nodeIP)
+	if err != nil {
+		slog.WarnContext(ctx, "Error al conectar con el nodo", "node", nodeIP, "error", err)
+		return handleReassignment(ctx, payload, nodeIP, false)
+	}
+	result := queryShard(ctx, conn, payload)
+
+	// Si el nodo está saturado, otra copia puede atender el shard
+	if result.err != nil && result.err.Code == ErrNodeBusy {
+		slog.InfoContext(ctx, "El nodo está ocupado, se reasigna el shard", "node", nodeIP, "shard", payload.Shard)
+		return handleReassignment(ctx, payload, nodeIP, true)
+	}
+	return result
+}
+
+// Consulta un shard en un nodo dado, sin reasignarlo si falla
+func queryNode(ctx context.Context, nodeIP string, payload NodeRequest) nodeResult {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", nodeIP)
+	if err != nil {
+		slog.WarnContext(ctx, "Error al conectar con el nodo", "node", nodeIP, "error", err)
+		return nodeResult{node: nodeIP, err: nodeConnectionError(nodeIP, err)}
+	}
+	return queryShard(ctx, conn, payload)
+}
+
+// Consulta un shard y, si la copia preferida tarda más que el percentil
+// configurado de las latencias recientes, repite la consulta en otra copia.
+// Se usa la primera respuesta exitosa y la otra consulta se cancela.
+func queryShardHedged(ctx context.Context, payload NodeRequest) nodeResult {
+	hedgeStats.queries.Add(1)
+	start := time.Now()
+
+	delay, ok := hedgeDelay()
+	if !ok {
+		result := queryOwner(ctx, payload)
+		if result.err == nil {
+			nodeLatencies.record(time.Since(start))
+		}
+		return result
+	}
+
+	primary := shardReplica(payload.Shard)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		result nodeResult
+		hedge  bool
+	}
+	attempts := make(chan attempt, 2)
+	go func() {
+		attempts <- attempt{result: queryOwner(ctx, payload)}
+	}()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	pending, hedged := 1, false
+	var failed *nodeResult
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			nodeIP, ok := hedgeNode(payload.Shard, primary)
+			if !ok {
+				continue
+			}
+			hedged = true
+			pending++
+			hedgeStats.fired.Add(1)
+			slog.InfoContext(ctx, "El shard no respondió a tiempo, se consulta también a otra copia", "shard", payload.Shard, "delay", delay, "node", nodeIP)
+			go func() {
+				attempts <- attempt{result: queryNode(ctx, nodeIP, payload), hedge: true}
+			}()
+		case a := <-attempts:
+			pending--
+			if a.result.err == nil {
+				// Si ganó el respaldo, la latencia de la otra copia es al menos la
+				// transcurrida; se registra igual para no subestimar el percentil
+				nodeLatencies.record(time.Since(start))
+				if a.hedge {
+					hedgeStats.won.Add(1)
+					slog.InfoContext(ctx, "El respaldo respondió primero", "shard", payload.Shard, "node", a.result.node)
+				}
+				return a.result
+			}
+			// Se prefiere informar el error de la copia preferida
+			if failed == nil || !a.hedge {
+				failed = &a.result
+			}
+			// Si la copia preferida falló antes del respaldo, no hay nada más que esperar
+			if !hedged {
+				return *failed
+			}
+		}
+	}
+	return *failed
+}
+
+// Informa periódicamente cuántas consultas de shards necesitaron un respaldo
+func runHedgeStats() {
+	if hedgePercentile <= 0 {
+		return
+	}
+	var reported int64
+	for range time.Tick(hedgeStatsInterval) {
+		queries := hedgeStats.queries.Load()
+		if queries == reported {
+			continue
+		}
+		reported = queries
+		fired, won := hedgeStats.fired.Load(), hedgeStats.won.Load()
+		delay, _ := hedgeDelay()
+		slog.Info("Consultas de respaldo", "hedged", fired, "queries", queries,
+			"hedged_ratio", float64(fired)/float64(queries), "won", won, "percentile", hedgePercentile, "delay", delay)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Carga latencias iguales, suficientes para enviar respaldos, y restaura
+// las anteriores al terminar
+func useLatencies(t *testing.T, latency time.Duration) {
+	t.Helper()
+	nodeLatencies.mu.Lock()
+	previous, previousNext := nodeLatencies.samples, nodeLatencies.next
+	nodeLatencies.samples, nodeLatencies.next = nil, 0
+	nodeLatencies.mu.Unlock()
+	for range hedgeMinSamples {
+		nodeLatencies.record(latency)
+	}
+	t.Cleanup(func() {
+		nodeLatencies.mu.Lock()
+		nodeLatencies.samples, nodeLatencies.next = previous, previousNext
+		nodeLatencies.mu.Unlock()
+	})
+}
+
+// Nodo que tarda en responder
+func slowNode(t *testing.T, delay time.Duration, movieID int) *fakeNode {
+	return startFakeNode(t, func(message NodeMessage) NodeResponse {
+		time.Sleep(delay)
+		return NodeResponse{Shard: message.Recommend.Shard, Scores: map[string][]ScoredMovie{"default": {{MovieID: movieID}}}}
+	})
+}
+
+// Variación de los contadores de respaldos durante f
+func hedgeCounts(f func()) (fired, won int64) {
+	fired, won = hedgeStats.fired.Load(), hedgeStats.won.Load()
+	f()
+	return hedgeStats.fired.Load() - fired, hedgeStats.won.Load() - won
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	var tracker latencyTracker
+	for i := 1; i < hedgeMinSamples; i++ {
+		tracker.record(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := tracker.percentile(50); ok {
+		t.Fatalf("con %d muestras no debería haber percentil", hedgeMinSamples-1)
+	}
+
+	tracker = latencyTracker{}
+	// Del 100 al 1 para comprobar que se ordenan
+	for i := 100; i >= 1; i-- {
+		tracker.record(time.Duration(i) * time.Millisecond)
+	}
+	for _, test := range []struct {
+		p    int
+		want time.Duration
+	}{
+		{1, time.Millisecond},
+		{50, 50 * time.Millisecond},
+		{95, 95 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+	} {
+		if got, ok := tracker.percentile(test.p); !ok || got != test.want {
+			t.Errorf("percentil %d = %v, se esperaba %v", test.p, got, test.want)
+		}
+	}
+
+	// Llena la ventana con latencias altas: las anteriores se descartan
+	for range latencyWindow {
+		tracker.record(time.Second)
+	}
+	if got, _ := tracker.percentile(1); got != time.Second {
+		t.Fatalf("percentil 1 = %v después de llenar la ventana, se esperaba 1s", got)
+	}
+}
+
+// Si el dueño tarda, el respaldo va a la otra copia y gana
+func TestHedgeGoesToReplica(t *testing.T) {
+	owner, replica, outsider := slowNode(t, time.Second, 1), answeringNode(t, 2), answeringNode(t, 3)
+	usePlacement(t, [][]string{{owner.address, replica.address}}, owner.address, replica.address, outsider.address)
+	useLatencies(t, 10*time.Millisecond)
+
+	var result nodeResult
+	fired, won := hedgeCounts(func() {
+		result = queryShardHedged(testContext(t), NodeRequest{Shard: 0})
+	})
+	if result.err != nil || result.node != replica.address {
+		t.Fatalf("respondió %s (error %v), se esperaba la otra copia", result.node, result.err)
+	}
+	if fired != 1 || won != 1 {
+		t.Fatalf("respaldos enviados %d y ganados %d, se esperaba 1 y 1", fired, won)
+	}
+	if outsider.count(MessageRecommend) != 0 || outsider.count(MessageLoadShard) != 0 {
+		t.Fatal("el respaldo fue a un nodo sin copia del shard")
+	}
+}
+
+// Sin otra copia viva no se envía respaldo y se espera al dueño
+func TestNoHedgeWithoutReplica(t *testing.T) {
+	owner, outsider := slowNode(t, 100*time.Millisecond, 1), answeringNode(t, 3)
+	usePlacement(t, [][]string{{owner.address}}, owner.address, outsider.address)
+	useLatencies(t, 10*time.Millisecond)
+
+	var result nodeResult
+	fired, won := hedgeCounts(func() {
+		result = queryShardHedged(testContext(t), NodeRequest{Shard: 0})
+	})
+	if result.err != nil || result.node != owner.address {
+		t.Fatalf("respondió %s (error %v), se esperaba el dueño", result.node, result.err)
+	}
+	if fired != 0 || won != 0 {
+		t.Fatalf("respaldos enviados %d y ganados %d, se esperaba ninguno", fired, won)
+	}
+	if outsider.count(MessageRecommend) != 0 || outsider.count(MessageLoadShard) != 0 {
+		t.Fatal("se consultó a un nodo sin copia del shard")
+	}
+}
+
+// Si el dueño falla antes de que venza la espera, se devuelve su error sin
+// enviar el respaldo
+func TestOwnerFailsBeforeHedge(t *testing.T) {
+	owner := startFakeNode(t, func(NodeMessage) NodeResponse {
+		return NodeResponse{Error: &NodeError{Code: ErrBadRequest, Message: "solicitud inválida"}}
+	})
+	replica := answeringNode(t, 2)
+	usePlacement(t, [][]string{{owner.address, replica.address}}, owner.address, replica.address)
+	useLatencies(t, time.Second)
+
+	start := time.Now()
+	var result nodeResult
+	fired, won := hedgeCounts(func() {
+		result = queryShardHedged(testContext(t), NodeRequest{Shard: 0})
+	})
+	if result.err == nil || result.err.Code != ErrBadRequest {
+		t.Fatalf("resultado %+v, se esperaba el error del dueño", result)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("la consulta tardó %v: se esperó al respaldo aunque el dueño ya había fallado", elapsed)
+	}
+	if fired != 0 || won != 0 || replica.count(MessageRecommend) != 0 {
+		t.Fatalf("se envió un respaldo después del error del dueño: enviados %d, ganados %d", fired, won)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Cantidad de usuarios vecinos que considera user-knn
+const userNeighbors = 50
+
+// Calificación individual, tal como se agrega al dataset y se envía a los nodos
+type Rating struct {
+	UserID  int
+	MovieID int
+	Rating  float64
+	Date    int64 // Segundos Unix; 0 si no se conoce
+}
+
+// Calificaciones cargadas junto con los índices que el servidor mantiene al
+// día con cada calificación nueva, sin reconstruirlos
+type datasetIndex struct {
+	data      RatingData
+	vectors   map[int]map[int]float64 // Película → usuario → calificación
+	userNorms map[int]float64         // Suma de cuadrados de las calificaciones de cada usuario
+	total     float64                 // Suma de todas las calificaciones
+	count     int                     // Cantidad de calificaciones
+	latest    int64                   // Fecha de la calificación más reciente
+}
+
+// Dataset que atiende las solicitudes. dataMu protege el índice y las
+// versiones de los shards.
+var (
+	dataMu  sync.RWMutex
+	dataset = newDatasetIndex(RatingData{})
+)
+
+// Crea el índice de un dataset recorriendo todas sus calificaciones
+func newDatasetIndex(data RatingData) *datasetIndex {
+	if data.Ratings == nil {
+		data.Ratings = make(map[int]map[int]float64)
+	}
+	if data.Dates == nil {
+		data.Dates = make(map[int]map[int]int64)
+	}
+	index := &datasetIndex{
+		data:      data,
+		vectors:   buildMovieVectors(data),
+		userNorms: make(map[int]float64, len(data.Ratings)),
+	}
+	for userID, movies := range data.Ratings {
+		for _, rating := range movies {
+			index.userNorms[userID] += rating * rating
+			index.total += rating
+			index.count++
+		}
+	}
+	for _, movies := range data.Dates {
+		for _, date := range movies {
+			index.latest = max(index.latest, date)
+		}
+	}
+	return index
+}
+
+// Crear vectores de películas desde RatingData
+func buildMovieVectors(data RatingData) map[int]map[int]float64 {
+	vectors := make(map[int]map[int]float64)
+	for userID, movies := range data.Ratings {
+		for movieID, rating := range movies {
+			if vectors[movieID] == nil {
+				vectors[movieID] = make(map[int]float64)
+			}
+			vectors[movieID][userID] = rating
+		}
+	}
+	return vectors
+}
+
+// Agrega o reemplaza una calificación y corrige los índices afectados
+func (idx *datasetIndex) addRating(r Rating) {
+	if idx.data.Ratings[r.UserID] == nil {
+		idx.data.Ratings[r.UserID] = make(map[int]float64)
+	}
+	previous, existed := idx.data.Ratings[r.UserID][r.MovieID]
+	idx.data.Ratings[r.UserID][r.MovieID] = r.Rating
+
+	if idx.vectors[r.MovieID] == nil {
+		idx.vectors[r.MovieID] = make(map[int]float64)
+	}
+	idx.vectors[r.MovieID][r.UserID] = r.Rating
+
+	idx.userNorms[r.UserID] += r.Rating*r.Rating - previous*previous
+	idx.total += r.Rating - previous
+	if !existed {
+		idx.count++
+	}
+
+	if r.Date != 0 {
+		if idx.data.Dates[r.UserID] == nil {
+			idx.data.Dates[r.UserID] = make(map[int]int64)
+		}
+		idx.data.Dates[r.UserID][r.MovieID] = r.Date
+		idx.latest = max(idx.latest, r.Date)
+	}
+}
+
+// Peso de cada calificación según su antigüedad, como en los nodos
+type timeDecay struct {
+	dates    map[int]map[int]int64 // Usuario → película → fecha
+	latest   int64
+	halfLife float64 // En segundos
+}
+
+// Crea el decaimiento pedido; nil si no se pidió o no hay fechas
+func (idx *datasetIndex) timeDecay(halfLifeDays float64) *timeDecay {
+	if halfLifeDays <= 0 || idx.latest == 0 {
+		return nil
+	}
+	return &timeDecay{dates: idx.data.Dates, latest: idx.latest, halfLife: halfLifeDays * 24 * 60 * 60}
+}
+
+// Peso de la calificación de un usuario a una película
+func (d *timeDecay) weight(userID, movieID int) float64 {
+	if d == nil {
+		return 1
+	}
+	date, ok := d.dates[userID][movieID]
+	if !ok {
+		return 1
+	}
+	return math.Pow(0.5, float64(d.latest-date)/d.halfLife)
+}
+
+// Separa las favoritas desconocidas de las conocidas, y entre estas las
+// que tienen suficientes calificaciones para aportar señal
+func (idx *datasetIndex) classifyFavorites(movieIDs []int) (known, usable, unknown []int) {
+	for _, favID := range movieIDs {
+		vector, exists := idx.vectors[favID]
+		if !exists {
+			unknown = append(unknown, favID)
+			continue
+		}
+		known = append(known, favID)
+		if len(vector) >= coldStartMinRatings {
+			usable = append(usable, favID)
+		}
+	}
+	return known, usable, unknown
+}
+
+// Usuarios más parecidos a un usuario ficticio que dio la nota máxima a
+// todas las favoritas, con su similitud de cosenos. Se calculan aquí porque
+// la norma de cada usuario depende de calificaciones de todos los shards.
+func (idx *datasetIndex) findNeighbors(favoriteMovieIDs []int, decay *timeDecay) map[int]float64 {
+	const favoriteRating = 5.0
+	favoriteNorm := favoriteRating * math.Sqrt(float64(len(favoriteMovieIDs)))
+
+	dotProducts := make(map[int]float64)
+	for _, favID := range favoriteMovieIDs {
+		for userID, rating := range idx.vectors[favID] {
+			dotProducts[userID] += favoriteRating * rating * decay.weight(userID, favID)
+		}
+	}
+
+	type neighbor struct {
+		userID     int
+		similarity float64
+	}
+	var neighbors []neighbor
+	for userID, dotProduct := range dotProducts {
+		norm := idx.userNorms[userID]
+		if decay != nil {
+			norm = 0
+			for movieID, rating := range idx.data.Ratings[userID] {
+				weighted := rating * decay.weight(userID, movieID)
+				norm += weighted * weighted
+			}
+		}
+		if dotProduct == 0 || norm == 0 {
+			continue
+		}
+		neighbors = append(neighbors, neighbor{userID, dotProduct / (favoriteNorm * math.Sqrt(norm))})
+	}
+
+	// Quedarse con los vecinos más parecidos
+	sort.Slice(neighbors, func(i, j int) bool {
+		if neighbors[i].similarity != neighbors[j].similarity {
+			return neighbors[i].similarity > neighbors[j].similarity
+		}
+		return neighbors[i].userID < neighbors[j].userID
+	})
+	if len(neighbors) > userNeighbors {
+		neighbors = neighbors[:userNeighbors]
+	}
+
+	similarities := make(map[int]float64, len(neighbors))
+	for _, n := range neighbors {
+		similarities[n.userID] = n.similarity
+	}
+	return similarities
+}
+
+// Promedio global de las calificaciones y su peso en el promedio bayesiano
+// (la cantidad media de calificaciones por película). Con decaimiento
+// temporal cada calificación pesa según su antigüedad.
+func (idx *datasetIndex) bayesianPrior(decay *timeDecay) (float64, float64) {
+	total, count := idx.total, float64(idx.count)
+	if decay != nil {
+		total, count = 0, 0
+		for userID, movies := range idx.data.Ratings {
+			for movieID, rating := range movies {
+				weight := decay.weight(userID, movieID)
+				total += weight * rating
+				count += weight
+			}
+		}
+	}
+	if count == 0 || len(idx.vectors) == 0 {
+		return 0, 0
+	}
+	return total / count, count / float64(len(idx.vectors))
+}
+
+// Copia de los vectores de las favoritas y, si se pide decaimiento, de sus
+// fechas indexadas por película
+func (idx *datasetIndex) favoriteVectors(favoriteMovieIDs []int, withDates bool) (map[int]map[int]float64, map[int]map[int]int64) {
+	vectors := make(map[int]map[int]float64, len(favoriteMovieIDs))
+	var dates map[int]map[int]int64
+	if withDates {
+		dates = make(map[int]map[int]int64, len(favoriteMovieIDs))
+	}
+	for _, favID := range favoriteMovieIDs {
+		vector := make(map[int]float64, len(idx.vectors[favID]))
+		for userID, rating := range idx.vectors[favID] {
+			vector[userID] = rating
+			if date, ok := idx.data.Dates[userID][favID]; ok && withDates {
+				if dates[favID] == nil {
+					dates[favID] = make(map[int]int64)
+				}
+				dates[favID][userID] = date
+			}
+		}
+		vectors[favID] = vector
+	}
+	return vectors, dates
+}
+
+// Años de las favoritas que están en el catálogo. Los de las películas de
+// cada shard se agregan al enviar la solicitud a su nodo.
+func favoriteYears(movieIDs []int) map[int]int {
+	years := make(map[int]int)
+	for _, movieID := range movieIDs {
+		if year, ok := catalog.Years[movieID]; ok {
+			years[movieID] = year
+		}
+	}
+	return years
+}
+
+// Arma la solicitud que se envía a los nodos (sin el shard). Devuelve
+// también las favoritas desconocidas y la estrategia de arranque en frío
+// usada, si hubo, o un error si ninguna favorita está en los datos.
+func (idx *datasetIndex) nodeRequest(request RecommendationRequest) (NodeRequest, []int, string, *ServiceError) {
+	known, usable, unknown := idx.classifyFavorites(request.MovieIDs)
+
+	payload := NodeRequest{
+		FavoriteMovieIDs: request.MovieIDs,
+		Algorithm:        request.Algorithm,
+		WindowDays:       request.WindowDays,
+		HalfLifeDays:     request.HalfLifeDays,
+		LatestDate:       idx.latest,
+		Search:           request.Search,
+	}
+
+	algorithms := []string{request.Algorithm}
+	if request.Algorithm == AlgorithmEnsemble {
+		algorithms = nil
+		for name, weight := range request.Weights {
+			if weight > 0 {
+				algorithms = append(algorithms, name)
+			}
+		}
+		sort.Strings(algorithms)
+		payload.Algorithms = algorithms
+		payload.CandidateLimit = ensembleCandidates
+	} else if request.Diversity > 0 {
+		// Para diversificar se necesitan más candidatos que los que se devuelven
+		payload.CandidateLimit = diversityCandidates
+	}
+
+	uses := make(map[string]bool)
+	for _, algorithm := range algorithms {
+		uses[algorithm] = true
+	}
+
+	// Favoritas que usan los algoritmos personalizados: las que tienen
+	// suficientes calificaciones. Si no hay ninguna, solos o en el ensamble
+	// se usa el arranque en frío.
+	favorites := usable
+	if (uses[AlgorithmItemKNN] || uses[AlgorithmUserKNN]) && len(usable) == 0 {
+		if request.ColdStart == ColdStartNone {
+			// Sin arranque en frío se usa la poca señal que haya
+			if len(known) == 0 {
+				return NodeRequest{}, unknown, "", &ServiceError{
+					Code:    ErrUnknownMovie,
+					Message: fmt.Sprintf("ninguna de las películas %v está en los datos", unknown),
+				}
+			}
+			favorites = known
+		} else {
+			payload.Fallback = request.ColdStart
+			payload.FavoriteYears = favoriteYears(request.MovieIDs)
+			uses[request.ColdStart] = true
+			favorites = nil
+		}
+	}
+
+	decay := idx.timeDecay(request.HalfLifeDays)
+	if uses[AlgorithmItemKNN] {
+		payload.FavoriteVectors, payload.FavoriteDates = idx.favoriteVectors(favorites, decay != nil)
+	}
+	if uses[AlgorithmUserKNN] && len(favorites) > 0 {
+		payload.Neighbors = idx.findNeighbors(favorites, decay)
+	}
+	if uses[AlgorithmBayesian] {
+		payload.GlobalMean, payload.BayesianPrior = idx.bayesianPrior(decay)
+	}
+	return payload, unknown, payload.Fallback, nil
+}
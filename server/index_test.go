@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Carga un catálogo con el año de las películas 1 a 30 y restaura el
+// anterior al terminar
+func useTestCatalog(t *testing.T) {
+	t.Helper()
+	var data strings.Builder
+	for movieID := 1; movieID <= 30; movieID++ {
+		fmt.Fprintf(&data, "%d,%d,Película %d\n", movieID, 1980+movieID, movieID)
+	}
+	path := filepath.Join(t.TempDir(), "movie_titles.csv")
+	if err := os.WriteFile(path, []byte(data.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := catalog
+	catalog = loaded
+	t.Cleanup(func() { catalog = previous })
+}
+
+// El catálogo separa los años por shard, sin repetir ni perder películas
+func TestCatalogShardYears(t *testing.T) {
+	useTestCatalog(t)
+
+	total := 0
+	for shard, years := range catalog.ShardYears {
+		for movieID, year := range years {
+			if shardOf(movieID) != shard {
+				t.Errorf("la película %d está en los años del shard %d, pero es del %d", movieID, shard, shardOf(movieID))
+			}
+			if year != catalog.Years[movieID] {
+				t.Errorf("película %d: año %d, se esperaba %d", movieID, year, catalog.Years[movieID])
+			}
+		}
+		total += len(years)
+	}
+	if total != len(catalog.Years) {
+		t.Fatalf("los shards tienen %d años, el catálogo %d", total, len(catalog.Years))
+	}
+}
+
+// En arranque en frío cada nodo recibe los años de las favoritas y los de
+// las películas de su shard, no el catálogo completo
+func TestColdStartSendsOnlyShardYears(t *testing.T) {
+	resetElection(t)
+	becomeLeader(1)
+	useTestDataset(t)
+	useTestCatalog(t)
+	useTestCache(t)
+
+	var mu sync.Mutex
+	received := make(map[int]*NodeRequest)
+	record := func(message NodeMessage) NodeResponse {
+		mu.Lock()
+		received[message.Recommend.Shard] = message.Recommend
+		mu.Unlock()
+		return NodeResponse{Shard: message.Recommend.Shard, Scores: map[string][]ScoredMovie{}}
+	}
+	a, b, c := startFakeNode(t, record), startFakeNode(t, record), startFakeNode(t, record)
+	useNodes(t, a.address, b.address, c.address)
+
+	// Ninguna favorita tiene calificaciones suficientes para item-knn
+	response := sendThroughConnection(t, APIMessage{Type: "recommend", RecommendationRequest: RecommendationRequest{
+		RequestID: "prueba",
+		MovieIDs:  []int{1, 2},
+		ColdStart: AlgorithmPopularity,
+	}})
+	if response.Error != nil || response.ColdStart != AlgorithmPopularity {
+		t.Fatalf("respuesta %+v, se esperaba arranque en frío con popularity", response)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != len(nodeIPs) {
+		t.Fatalf("respondieron %d shards, se esperaban %d", len(received), len(nodeIPs))
+	}
+	for shard, request := range received {
+		if len(request.FavoriteYears) != 2 || request.FavoriteYears[1] != 1981 || request.FavoriteYears[2] != 1982 {
+			t.Errorf("shard %d: años de las favoritas %v, se esperaba {1: 1981, 2: 1982}", shard, request.FavoriteYears)
+		}
+		if len(request.MovieYears) != len(catalog.ShardYears[shard]) {
+			t.Errorf("shard %d: se enviaron %d años, el shard tiene %d", shard, len(request.MovieYears), len(catalog.ShardYears[shard]))
+		}
+		for movieID := range request.MovieYears {
+			if shardOf(movieID) != shard {
+				t.Errorf("shard %d: se envió el año de la película %d, que es del shard %d", shard, movieID, shardOf(movieID))
+			}
+		}
+	}
+}
+
+// En el ensamble, si ninguna favorita tiene calificaciones suficientes, los
+// algoritmos personalizados usan el arranque en frío y la respuesta lo
+// advierte
+func TestEnsembleColdStart(t *testing.T) {
+	resetElection(t)
+	becomeLeader(1)
+	useTestDataset(t)
+	useTestCache(t)
+
+	var mu sync.Mutex
+	var fallbacks []string
+	record := func(message NodeMessage) NodeResponse {
+		mu.Lock()
+		fallbacks = append(fallbacks, message.Recommend.Fallback)
+		mu.Unlock()
+		return NodeResponse{Shard: message.Recommend.Shard, Scores: map[string][]ScoredMovie{
+			AlgorithmItemKNN:    {{MovieID: 3, Score: 1}},
+			AlgorithmPopularity: {{MovieID: 3, Score: 1}},
+		}}
+	}
+	a, b, c := startFakeNode(t, record), startFakeNode(t, record), startFakeNode(t, record)
+	useNodes(t, a.address, b.address, c.address)
+
+	response := sendThroughConnection(t, APIMessage{Type: "recommend", RecommendationRequest: RecommendationRequest{
+		RequestID: "prueba",
+		MovieIDs:  []int{1, 99},
+		Algorithm: AlgorithmEnsemble,
+		Weights:   map[string]float64{AlgorithmItemKNN: 0.7, AlgorithmPopularity: 0.3},
+		ColdStart: AlgorithmPopularity,
+	}})
+	if response.Error != nil {
+		t.Fatalf("la solicitud falló: %v", response.Error.Message)
+	}
+	if response.ColdStart != AlgorithmPopularity || response.Degraded {
+		t.Fatalf("respuesta %+v, se esperaba arranque en frío con popularity sin degradar", response)
+	}
+	if len(response.Warnings) != 1 || response.Warnings[0].Code != ErrColdStart {
+		t.Fatalf("advertencias %+v, se esperaba cold_start", response.Warnings)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(fallbacks) != len(nodeIPs) {
+		t.Fatalf("respondieron %d shards, se esperaban %d", len(fallbacks), len(nodeIPs))
+	}
+	for _, fallback := range fallbacks {
+		if fallback != AlgorithmPopularity {
+			t.Fatalf("un nodo recibió el respaldo %q, se esperaba popularity", fallback)
+		}
+	}
+}
+
+// Sin arranque en frío, un ensamble con algoritmos personalizados y
+// ninguna favorita en los datos responde unknown_movie
+func TestEnsembleUnknownFavorites(t *testing.T) {
+	useTestDataset(t)
+
+	request := RecommendationRequest{
+		MovieIDs:  []int{98, 99},
+		Algorithm: AlgorithmEnsemble,
+		Weights:   map[string]float64{AlgorithmUserKNN: 0.5, AlgorithmPopularity: 0.5},
+		ColdStart: ColdStartNone,
+	}
+	dataMu.RLock()
+	defer dataMu.RUnlock()
+	if serviceErr := validateRequest(&request); serviceErr != nil {
+		t.Fatal(serviceErr.Message)
+	}
+	_, unknown, _, serviceErr := dataset.nodeRequest(request)
+	if serviceErr == nil || serviceErr.Code != ErrUnknownMovie {
+		t.Fatalf("error %+v, se esperaba unknown_movie", serviceErr)
+	}
+	if len(unknown) != 2 {
+		t.Fatalf("desconocidas %v, se esperaban 98 y 99", unknown)
+	}
+
+	// Solo con algoritmos no personalizados las favoritas no hacen falta
+	request.Weights = map[string]float64{AlgorithmPopularity: 1}
+	if _, _, _, serviceErr := dataset.nodeRequest(request); serviceErr != nil {
+		t.Fatalf("un ensamble sin algoritmos personalizados respondió %v", serviceErr.Message)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Métricas de Prometheus, expuestas en /metrics con client_golang, igual
+// que en la API. Además de las del coordinador se exportan las del proceso
+// y del runtime de Go.
+
+// Dirección del endpoint de métricas: la de este coordinador en el puerto 9090
+var metricsAddr = getEnv("METRICS_ADDR", metricsDefaultAddr(coordinatorAddr))
+
+// Límites de los histogramas de latencia, en segundos. Los recorridos de
+// los datasets completos pueden tardar varios minutos.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// Medidor o contador cuyo valor se lee al exportar, con una serie por cada
+// valor de sus etiquetas
+type funcCollector struct {
+	desc    *prometheus.Desc
+	kind    prometheus.ValueType
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+func (f funcCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- f.desc
+}
+
+func (f funcCollector) Collect(ch chan<- prometheus.Metric) {
+	f.collect(func(value float64, labelValues ...string) {
+		ch <- prometheus.MustNewConstMetric(f.desc, f.kind, value, labelValues...)
+	})
+}
+
+func newGaugeFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	prometheus.MustRegister(funcCollector{prometheus.NewDesc(name, help, labels, nil), prometheus.GaugeValue, collect})
+}
+
+func newCounterFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	prometheus.MustRegister(funcCollector{prometheus.NewDesc(name, help, labels, nil), prometheus.CounterValue, collect})
+}
+
+// Atiende /metrics, /healthz, /readyz y /cluster en su propio puerto, ya
+// que el del servidor habla TCP
+func serveHTTP() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/cluster", handleCluster)
+	slog.Info("Métricas y estado disponibles", "url", "http://"+metricsAddr)
+	if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+		slog.Error("Error al iniciar el endpoint de métricas", "error", err)
+	}
+}
+
+// Misma IP que la dirección dada, en el puerto 9090
+func metricsDefaultAddr(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return ":9090"
+	}
+	return net.JoinHostPort(host, "9090")
+}
+
+// Conexión que cuenta los bytes enviados y recibidos
+type meteredConn struct {
+	net.Conn
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Add(int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+// Métricas del servidor
+var (
+	apiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "server_requests_total",
+		Help: "Mensajes recibidos en el puerto del servidor, por tipo y resultado",
+	}, []string{"type", "code"})
+	apiRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "server_request_duration_seconds",
+		Help:    "Duración de la atención de cada mensaje, por tipo",
+		Buckets: latencyBuckets,
+	}, []string{"type"})
+	apiPayloadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "server_api_payload_bytes_total",
+		Help: "Bytes intercambiados con la API y los demás coordinadores",
+	}, []string{"direction"})
+	nodeRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "server_node_requests_total",
+		Help: "Mensajes enviados a los nodos, por nodo, tipo y resultado",
+	}, []string{"node", "type", "code"})
+	nodeRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "server_node_request_duration_seconds",
+		Help:    "Duración de los mensajes a los nodos (servidor → nodo), por nodo y tipo",
+		Buckets: latencyBuckets,
+	}, []string{"node", "type"})
+	nodePayloadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "server_node_payload_bytes_total",
+		Help: "Bytes intercambiados con los nodos",
+	}, []string{"node", "direction"})
+)
+
+func init() {
+	newGaugeFunc("server_node_up", "1 si el nodo respondió a los últimos chequeos de salud", []string{"node"},
+		func(emit func(float64, ...string)) {
+			for _, nodeIP := range nodeIPs {
+				emit(boolValue(nodeAlive(nodeIP)), nodeIP)
+			}
+		})
+	newGaugeFunc("server_node_last_seen_timestamp_seconds", "Último chequeo de salud exitoso de cada nodo", []string{"node"},
+		func(emit func(float64, ...string)) {
+			placementMu.RLock()
+			defer placementMu.RUnlock()
+			for _, nodeIP := range nodeIPs {
+				if lastSeen := nodeStatus[nodeIP].lastSeen; !lastSeen.IsZero() {
+					emit(float64(lastSeen.Unix()), nodeIP)
+				}
+			}
+		})
+	newGaugeFunc("server_inflight_requests", "Solicitudes de la API en curso", nil,
+		func(emit func(float64, ...string)) { emit(float64(apiInFlight.Load())) })
+	newGaugeFunc("server_node_inflight_requests", "Mensajes enviados a cada nodo que esperan respuesta", []string{"node"},
+		func(emit func(float64, ...string)) {
+			for _, nodeIP := range nodeIPs {
+				emit(float64(nodeInFlight[nodeIP].Load()), nodeIP)
+			}
+		})
+	newGaugeFunc("server_leader", "1 si este coordinador es el líder", nil,
+		func(emit func(float64, ...string)) { emit(boolValue(isLeader())) })
+	newGaugeFunc("server_dataset_version", "Versión del dataset cargado", nil,
+		func(emit func(float64, ...string)) {
+			dataMu.RLock()
+			defer dataMu.RUnlock()
+			emit(float64(datasetVersion))
+		})
+	newCounterFunc("server_cache_requests_total", "Búsquedas en la caché de recomendaciones, por resultado", []string{"result"},
+		func(emit func(float64, ...string)) {
+			emit(float64(recommendationCache.hits.Load()), "hit")
+			emit(float64(recommendationCache.misses.Load()), "miss")
+		})
+	newGaugeFunc("server_cache_entries", "Respuestas guardadas en la caché de recomendaciones", nil,
+		func(emit func(float64, ...string)) {
+			recommendationCache.mu.Lock()
+			defer recommendationCache.mu.Unlock()
+			emit(float64(recommendationCache.order.Len()))
+		})
+	newCounterFunc("server_shard_queries_total", "Consultas de shards, con y sin respaldo", nil,
+		func(emit func(float64, ...string)) { emit(float64(hedgeStats.queries.Load())) })
+	newCounterFunc("server_hedged_queries_total", "Consultas de shards en las que se envió un respaldo", nil,
+		func(emit func(float64, ...string)) { emit(float64(hedgeStats.fired.Load())) })
+	newCounterFunc("server_hedge_wins_total", "Respaldos que respondieron antes que la copia preferida", nil,
+		func(emit func(float64, ...string)) { emit(float64(hedgeStats.won.Load())) })
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
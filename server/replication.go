@@ -0,0 +1,294 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Cantidad de nodos que guardan una copia de cada shard
+var replicationFactor = max(1, min(getEnvInt("REPLICATION_FACTOR", 2), len(nodeIPs)))
+
+const (
+	healthCheckInterval = 5 * time.Second // Tiempo entre chequeos de salud de los nodos
+	healthCheckTimeout  = 2 * time.Second // Plazo del nodo para responder un chequeo
+	healthFailureLimit  = 3               // Chequeos fallidos seguidos para declarar muerto un nodo
+)
+
+// Estado de un nodo según los chequeos de salud
+type nodeHealth struct {
+	alive     bool
+	failures  int         // Chequeos fallidos seguidos
+	lastSeen  time.Time   // Último chequeo exitoso
+	lastError string      // Error del último chequeo fallido
+	report    *NodeReport // Lo que informó el nodo en el último chequeo exitoso
+}
+
+// Nodos que tienen una copia de cada shard, en orden de preferencia, y el
+// estado de cada nodo. Los protege placementMu.
+var (
+	placementMu   sync.RWMutex
+	shardReplicas = initialPlacement()
+	nodeStatus    = initialNodeStatus()
+)
+
+// Cada shard se copia en su nodo y en los replicationFactor-1 que le siguen
+// en el anillo
+func initialPlacement() [][]string {
+	replicas := make([][]string, len(nodeIPs))
+	for shard := range replicas {
+		for _, node := range movieRing.successors(shard, replicationFactor) {
+			replicas[shard] = append(replicas[shard], nodeIPs[node])
+		}
+	}
+	return replicas
+}
+
+// Al iniciar se supone que todos los nodos están vivos
+func initialNodeStatus() map[string]*nodeHealth {
+	status := make(map[string]*nodeHealth, len(nodeIPs))
+	for _, nodeIP := range nodeIPs {
+		status[nodeIP] = &nodeHealth{alive: true}
+	}
+	return status
+}
+
+// Nodos con una copia del shard
+func replicasOf(shard int) []string {
+	placementMu.RLock()
+	defer placementMu.RUnlock()
+	return slices.Clone(shardReplicas[shard])
+}
+
+// Indica si el nodo tiene asignada una copia del shard
+func isReplica(shard int, nodeIP string) bool {
+	placementMu.RLock()
+	defer placementMu.RUnlock()
+	return slices.Contains(shardReplicas[shard], nodeIP)
+}
+
+// Indica si el nodo respondió a los últimos chequeos de salud
+func nodeAlive(nodeIP string) bool {
+	placementMu.RLock()
+	defer placementMu.RUnlock()
+	return nodeStatus[nodeIP].alive
+}
+
+// Copia del shard que atiende las consultas: la primera viva. Si ninguna
+// está viva se usa la preferida, por si los chequeos aún no lo detectaron.
+func shardReplica(shard int) string {
+	replicas := replicasOf(shard)
+	for _, nodeIP := range replicas {
+		if nodeAlive(nodeIP) {
+			return nodeIP
+		}
+	}
+	return replicas[0]
+}
+
+// Otras copias vivas del shard, a las que se redirige su consulta si la
+// preferida falla, está ocupada o tarda
+func otherReplicas(shard int, exclude string) []string {
+	var candidates []string
+	for _, nodeIP := range replicasOf(shard) {
+		if nodeIP != exclude && nodeAlive(nodeIP) {
+			candidates = append(candidates, nodeIP)
+		}
+	}
+	return candidates
+}
+
+// Revisa periódicamente los nodos. Un nodo que falla healthFailureLimit
+// chequeos seguidos se declara muerto y sus shards se copian en otros nodos.
+func runHealthChecks() {
+	for range time.Tick(healthCheckInterval) {
+		// Los demás coordinadores reciben el estado de los nodos del líder
+		if !isLeader() {
+			continue
+		}
+		for _, nodeIP := range nodeIPs {
+			report, err := probeNode(nodeIP)
+
+			placementMu.Lock()
+			status := nodeStatus[nodeIP]
+			died, returned := false, false
+			if err == nil {
+				if !status.alive {
+					slog.Info("El nodo está disponible de nuevo", "node", nodeIP)
+					returned = true
+				}
+				status.alive, status.failures, status.lastSeen = true, 0, time.Now()
+				status.lastError, status.report = "", report
+			} else {
+				status.failures++
+				status.lastError = err.Error()
+				if status.alive && status.failures >= healthFailureLimit {
+					status.alive = false
+					died = true
+				}
+			}
+			placementMu.Unlock()
+
+			if died {
+				slog.Warn("El nodo no respondió a los chequeos seguidos; se declara muerto", "node", nodeIP, "failures", healthFailureLimit)
+				reReplicate(nodeIP)
+			}
+			if returned {
+				go restoreNode(nodeIP, report)
+			}
+		}
+	}
+}
+
+// Un nodo que se apaga avisa antes de cerrar su puerto. Se lo declara
+// muerto sin esperar a que fallen los chequeos, así las consultas nuevas van
+// a otras copias, y sus shards se copian en otros nodos. Si vuelve, los
+// chequeos lo marcan vivo otra vez y recupera sus shards.
+func nodeLeaving(nodeIP string) {
+	placementMu.Lock()
+	status, ok := nodeStatus[nodeIP]
+	wasAlive := ok && status.alive
+	if ok {
+		status.alive, status.failures, status.lastError = false, healthFailureLimit, "el nodo se apagó"
+	}
+	placementMu.Unlock()
+
+	if !ok {
+		slog.Warn("Aviso de apagado de un nodo desconocido", "node", nodeIP)
+		return
+	}
+	slog.Info("El nodo se apaga; sus consultas van a otras copias", "node", nodeIP)
+	if wasAlive {
+		reReplicate(nodeIP)
+	}
+}
+
+// Copia de un shard que se agrega o se borra en un nodo
+type shardCopy struct {
+	shard  int
+	nodeIP string
+}
+
+// Reemplaza al nodo muerto en los shards que tenía por nodos vivos sin copia
+// de ese shard, eligiendo los que tienen menos shards, y les envía los
+// shards. Si no hay reemplazo el nodo sigue en la lista y retoma sus shards
+// cuando vuelva.
+func reReplicate(deadIP string) {
+	var moves []shardCopy
+
+	placementMu.Lock()
+	for shard, replicas := range shardReplicas {
+		index := slices.Index(replicas, deadIP)
+		if index < 0 {
+			continue
+		}
+		target := leastLoadedNode(replicas)
+		if target == "" {
+			slog.Warn("No hay nodos vivos para una nueva copia del shard", "shard", shard)
+			continue
+		}
+		// La copia nueva va al final: las que ya tienen los datos son preferidas
+		replicas = slices.Delete(replicas, index, index+1)
+		shardReplicas[shard] = append(replicas, target)
+		moves = append(moves, shardCopy{shard, target})
+	}
+	placementMu.Unlock()
+
+	for _, m := range moves {
+		go func(m shardCopy) {
+			slog.Info("Nueva copia del shard", "shard", m.shard, "node", m.nodeIP)
+			if serviceErr := pushShard(m.nodeIP, m.shard); serviceErr != nil {
+				// El nodo recibirá el shard en su primera consulta
+				slog.Warn("No se pudo copiar el shard", "shard", m.shard, "node", m.nodeIP, "code", serviceErr.Code, "error", serviceErr.Message)
+			}
+		}(m)
+	}
+}
+
+// Devuelve a un nodo que volvió los shards que le asigna el anillo y que
+// se copiaron en otros nodos mientras estaba muerto. Cada shard se le envía
+// antes de agregarlo a las copias, y el nodo que lo había recibido en su
+// lugar deja de ser copia y borra el suyo. También se borran las copias que
+// el nodo conserva de shards que ya no tiene asignados.
+func restoreNode(nodeIP string, report *NodeReport) {
+	var dropped []shardCopy
+	for shard, preferred := range initialPlacement() {
+		if !slices.Contains(preferred, nodeIP) || isReplica(shard, nodeIP) {
+			continue
+		}
+		// Con ingestMu tomado no llegan calificaciones entre el envío del shard
+		// y el cambio de copias
+		ingestMu.Lock()
+		if !isLeader() {
+			ingestMu.Unlock()
+			return
+		}
+		if serviceErr := pushShardLocked(nodeIP, shard); serviceErr != nil {
+			ingestMu.Unlock()
+			slog.Warn("No se pudo devolver el shard al nodo", "shard", shard, "node", nodeIP, "code", serviceErr.Code, "error", serviceErr.Message)
+			continue
+		}
+		placementMu.Lock()
+		replicas, replaced := restoredReplicas(preferred, shardReplicas[shard], nodeIP)
+		shardReplicas[shard] = replicas
+		placementMu.Unlock()
+		ingestMu.Unlock()
+
+		slog.Info("El shard vuelve a su copia", "shard", shard, "node", nodeIP, "replaced", replaced)
+		for _, replacedIP := range replaced {
+			dropped = append(dropped, shardCopy{shard, replacedIP})
+		}
+	}
+	if report != nil {
+		for shard := range report.ShardVersions {
+			if !isReplica(shard, nodeIP) {
+				dropped = append(dropped, shardCopy{shard, nodeIP})
+			}
+		}
+	}
+	for _, m := range dropped {
+		dropShard(m.nodeIP, m.shard)
+	}
+}
+
+// Copias de un shard con el nodo que vuelve en su lugar del anillo: primero
+// las del anillo, en su orden, y después los reemplazos. Los reemplazos que
+// sobran para replicationFactor se devuelven aparte.
+func restoredReplicas(preferred, current []string, nodeIP string) (replicas, replaced []string) {
+	for _, replicaIP := range preferred {
+		if replicaIP == nodeIP || slices.Contains(current, replicaIP) {
+			replicas = append(replicas, replicaIP)
+		}
+	}
+	for _, replicaIP := range current {
+		if !slices.Contains(preferred, replicaIP) {
+			replicas = append(replicas, replicaIP)
+		}
+	}
+	if len(replicas) > replicationFactor {
+		replicas, replaced = replicas[:replicationFactor], slices.Clone(replicas[replicationFactor:])
+	}
+	return replicas, replaced
+}
+
+// Nodo vivo que no está entre los dados y tiene menos shards asignados.
+// Requiere placementMu.
+func leastLoadedNode(exclude []string) string {
+	load := make(map[string]int)
+	for _, replicas := range shardReplicas {
+		for _, nodeIP := range replicas {
+			load[nodeIP]++
+		}
+	}
+	best := ""
+	for _, nodeIP := range nodeIPs {
+		if !nodeStatus[nodeIP].alive || slices.Contains(exclude, nodeIP) {
+			continue
+		}
+		if best == "" || load[nodeIP] < load[best] {
+			best = nodeIP
+		}
+	}
+	return best
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Nodo simulado: responde los chequeos de salud y pasa los demás mensajes a
+// reply. Cuenta los mensajes recibidos de cada tipo.
+type fakeNode struct {
+	address  string
+	mu       sync.Mutex
+	received map[string]int
+}
+
+func startFakeNode(t *testing.T, reply func(message NodeMessage) NodeResponse) *fakeNode {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	node := &fakeNode{address: listener.Addr().String(), received: make(map[string]int)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var message NodeMessage
+				if err := gob.NewDecoder(conn).Decode(&message); err != nil {
+					return
+				}
+				if message.Type == MessageHealth {
+					gob.NewEncoder(conn).Encode(NodeResponse{Report: &NodeReport{ShardVersions: map[int]int64{}}})
+					return
+				}
+				node.mu.Lock()
+				node.received[message.Type]++
+				node.mu.Unlock()
+				gob.NewEncoder(conn).Encode(reply(message))
+			}()
+		}
+	}()
+	return node
+}
+
+// Mensajes de un tipo que recibió el nodo
+func (n *fakeNode) count(messageType string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.received[messageType]
+}
+
+// Nodo que atiende las consultas con una recomendación propia
+func answeringNode(t *testing.T, movieID int) *fakeNode {
+	return startFakeNode(t, func(message NodeMessage) NodeResponse {
+		if message.Type != MessageRecommend {
+			return NodeResponse{}
+		}
+		return NodeResponse{Shard: message.Recommend.Shard, Scores: map[string][]ScoredMovie{"default": {{MovieID: movieID}}}}
+	})
+}
+
+// Nodo con la cola llena
+func busyNode(t *testing.T) *fakeNode {
+	return startFakeNode(t, func(NodeMessage) NodeResponse {
+		return NodeResponse{Error: &NodeError{Code: ErrNodeBusy, Message: "la cola del nodo está llena"}}
+	})
+}
+
+// Reemplaza la ubicación de los shards: cada shard se copia en los nodos
+// dados, en orden de preferencia, y todos los nodos listados están vivos.
+// Al terminar se restaura la original.
+func usePlacement(t *testing.T, replicas [][]string, nodes ...string) {
+	t.Helper()
+	placementMu.Lock()
+	previousReplicas, previousStatus := shardReplicas, nodeStatus
+	shardReplicas = replicas
+	nodeStatus = make(map[string]*nodeHealth, len(nodes))
+	for _, nodeIP := range nodes {
+		nodeStatus[nodeIP] = &nodeHealth{alive: true}
+	}
+	placementMu.Unlock()
+	t.Cleanup(func() {
+		placementMu.Lock()
+		shardReplicas, nodeStatus = previousReplicas, previousStatus
+		placementMu.Unlock()
+	})
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// Con el dueño ocupado la consulta pasa a la otra copia, no a un nodo sin
+// el shard
+func TestBusyOwnerReassignsToReplica(t *testing.T) {
+	owner, replica, outsider := busyNode(t), answeringNode(t, 42), answeringNode(t, 7)
+	usePlacement(t, [][]string{{owner.address, replica.address}}, owner.address, replica.address, outsider.address)
+
+	result := queryOwner(testContext(t), NodeRequest{Shard: 0})
+	if result.err != nil {
+		t.Fatalf("la consulta falló: %v", result.err.Message)
+	}
+	if result.node != replica.address || result.response.Scores["default"][0].MovieID != 42 {
+		t.Fatalf("respondió %s con %+v, se esperaba la otra copia", result.node, result.response.Scores)
+	}
+	if outsider.count(MessageRecommend) != 0 || outsider.count(MessageLoadShard) != 0 {
+		t.Fatal("se consultó a un nodo sin copia del shard")
+	}
+}
+
+// Si todas las copias están ocupadas se responde node_busy, sin enviar el
+// shard a otro nodo
+func TestBusyReplicasReturnNodeBusy(t *testing.T) {
+	owner, replica, outsider := busyNode(t), busyNode(t), answeringNode(t, 7)
+	usePlacement(t, [][]string{{owner.address, replica.address}}, owner.address, replica.address, outsider.address)
+
+	result := queryOwner(testContext(t), NodeRequest{Shard: 0})
+	if result.err == nil || result.err.Code != ErrNodeBusy {
+		t.Fatalf("resultado %+v, se esperaba node_busy", result)
+	}
+	if replica.count(MessageRecommend) != 1 {
+		t.Fatalf("la otra copia recibió %d consultas, se esperaba 1", replica.count(MessageRecommend))
+	}
+	if outsider.count(MessageRecommend) != 0 || outsider.count(MessageLoadShard) != 0 {
+		t.Fatal("el shard se envió a un nodo sin copia")
+	}
+}
+
+// Un dueño ocupado sin otras copias también responde node_busy
+func TestBusyOwnerWithoutReplicas(t *testing.T) {
+	owner, outsider := busyNode(t), answeringNode(t, 7)
+	usePlacement(t, [][]string{{owner.address}}, owner.address, outsider.address)
+
+	result := queryOwner(testContext(t), NodeRequest{Shard: 0})
+	if result.err == nil || result.err.Code != ErrNodeBusy {
+		t.Fatalf("resultado %+v, se esperaba node_busy", result)
+	}
+	if outsider.count(MessageRecommend) != 0 || outsider.count(MessageLoadShard) != 0 {
+		t.Fatal("el shard se envió a un nodo sin copia")
+	}
+}
+
+// Usa los nodos dados como los del clúster, con los shards ubicados según
+// el anillo
+func useNodes(t *testing.T, nodes ...string) {
+	t.Helper()
+	previous := nodeIPs
+	nodeIPs = nodes
+	t.Cleanup(func() { nodeIPs = previous })
+	usePlacement(t, initialPlacement(), nodes...)
+}
+
+func setAlive(nodeIP string, alive bool) {
+	placementMu.Lock()
+	defer placementMu.Unlock()
+	nodeStatus[nodeIP].alive = alive
+}
+
+// Copia de la ubicación actual de los shards
+func currentPlacement() [][]string {
+	placement := make([][]string, len(nodeIPs))
+	for shard := range placement {
+		placement[shard] = replicasOf(shard)
+	}
+	return placement
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("no se cumplió a tiempo: %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Se elige el nodo vivo con menos shards que no está excluido
+func TestLeastLoadedNode(t *testing.T) {
+	nodes := testNodes(3)
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	useNodes(t, nodes...)
+	usePlacement(t, [][]string{{a, b}, {b, c}, {b, a}}, nodes...)
+
+	placementMu.RLock()
+	got := []string{leastLoadedNode(nil), leastLoadedNode([]string{c}), leastLoadedNode([]string{a, c}), leastLoadedNode(nodes)}
+	placementMu.RUnlock()
+	want := []string{c, a, b, ""}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("caso %d: se eligió %q, se esperaba %q", i, got[i], want[i])
+		}
+	}
+
+	// Los nodos muertos no se eligen aunque tengan menos shards
+	setAlive(c, false)
+	placementMu.RLock()
+	defer placementMu.RUnlock()
+	if got := leastLoadedNode(nil); got != a {
+		t.Fatalf("con %s muerto se eligió %q, se esperaba %s", c, got, a)
+	}
+}
+
+// Al morir un nodo, cada shard que tenía pasa a otro nodo vivo sin copia,
+// que lo recibe completo
+func TestReReplicateOnDeath(t *testing.T) {
+	a, b, c := answeringNode(t, 1), answeringNode(t, 2), answeringNode(t, 3)
+	useNodes(t, a.address, b.address, c.address)
+	lost := 0
+	for _, replicas := range currentPlacement() {
+		if slices.Contains(replicas, a.address) {
+			lost++
+		}
+	}
+
+	setAlive(a.address, false)
+	reReplicate(a.address)
+
+	for shard, replicas := range currentPlacement() {
+		if slices.Contains(replicas, a.address) {
+			t.Errorf("el shard %d sigue en el nodo muerto: %v", shard, replicas)
+		}
+		if len(replicas) != replicationFactor || replicas[0] == replicas[1] {
+			t.Errorf("el shard %d quedó con las copias %v", shard, replicas)
+		}
+	}
+	waitFor(t, "que las copias nuevas reciban sus shards", func() bool {
+		return b.count(MessageLoadShard)+c.count(MessageLoadShard) == lost
+	})
+}
+
+// Sin nodos vivos para una copia nueva, el nodo muerto sigue en la lista
+// para retomar sus shards cuando vuelva
+func TestReReplicateWithoutTarget(t *testing.T) {
+	a, b, c := answeringNode(t, 1), answeringNode(t, 2), answeringNode(t, 3)
+	useNodes(t, a.address, b.address, c.address)
+	placement := [][]string{{a.address, b.address}, {b.address, c.address}, {c.address, b.address}}
+	usePlacement(t, placement, a.address, b.address, c.address)
+
+	setAlive(c.address, false)
+	setAlive(a.address, false)
+	reReplicate(a.address)
+
+	if got := currentPlacement(); !slices.EqualFunc(got, placement, slices.Equal) {
+		t.Fatalf("la ubicación cambió sin nodos disponibles: %v", got)
+	}
+	if b.count(MessageLoadShard) != 0 || c.count(MessageLoadShard) != 0 {
+		t.Fatal("se envió un shard sin haber un reemplazo")
+	}
+}
+
+// Un nodo que vuelve recupera sus shards, los reemplazos borran sus copias
+// y el nodo borra las de shards que ya no tiene asignados
+func TestRestoreNodeAfterDeath(t *testing.T) {
+	resetElection(t)
+	becomeLeader(1)
+	a, b, c := answeringNode(t, 1), answeringNode(t, 2), answeringNode(t, 3)
+	useNodes(t, a.address, b.address, c.address)
+	initial := currentPlacement()
+
+	setAlive(a.address, false)
+	reReplicate(a.address)
+	restored, foreign := 0, -1
+	for shard, replicas := range initial {
+		if slices.Contains(replicas, a.address) {
+			restored++
+		} else {
+			foreign = shard
+		}
+	}
+	waitFor(t, "que las copias nuevas reciban sus shards", func() bool {
+		return b.count(MessageLoadShard)+c.count(MessageLoadShard) == restored
+	})
+
+	// El nodo vuelve con una copia de un shard que no le corresponde
+	setAlive(a.address, true)
+	restoreNode(a.address, &NodeReport{ShardVersions: map[int]int64{foreign: 0}})
+
+	if got := currentPlacement(); !slices.EqualFunc(got, initial, slices.Equal) {
+		t.Fatalf("ubicación %v después de que volvió el nodo, se esperaba la inicial %v", got, initial)
+	}
+	if got := a.count(MessageLoadShard); got != restored {
+		t.Fatalf("el nodo recibió %d shards, se esperaba %d", got, restored)
+	}
+	if got := b.count(MessageDropShard) + c.count(MessageDropShard); got != restored {
+		t.Fatalf("los reemplazos borraron %d copias, se esperaba %d", got, restored)
+	}
+	if got := a.count(MessageDropShard); got != 1 {
+		t.Fatalf("el nodo borró %d copias, se esperaba 1", got)
+	}
+}
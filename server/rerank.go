@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strings"
+)
+
+// Candidatos que se piden a cada nodo cuando se diversifica el resultado
+const diversityCandidates = 25
+
+// Sufijo que distingue temporadas o volúmenes de una misma serie, por
+// ejemplo "Star Trek: Voyager: Season 1" o "Planet Earth: Vol. 2". Solo se
+// reconoce al final del título, después de un separador y con su número,
+// así "The Book Thief" y "The Book of Eli" siguen siendo películas distintas.
+var seriesSuffix = regexp.MustCompile(`(?i)[\s:,\-]+\(?(season|series|vol\.?|volume|disc|part)\s*\d+\)?$`)
+
+// Calcular similitud de cosenos entre dos películas
+func calculateCosineSimilarity(movie1, movie2 map[int]float64) float64 {
+	var dotProduct, normA, normB float64
+
+	for userID, rating1 := range movie1 {
+		if rating2, exists := movie2[userID]; exists {
+			dotProduct += rating1 * rating2
+		}
+		normA += rating1 * rating1
+	}
+	for _, rating2 := range movie2 {
+		normB += rating2 * rating2
+	}
+
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dotProduct / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// Clave que identifica la serie de un título, sin temporada ni volumen.
+// Sin catálogo cada película es su propia serie.
+func seriesKey(movieID int) string {
+	title, ok := catalog.Titles[movieID]
+	if !ok {
+		return ""
+	}
+	key := strings.TrimSpace(seriesSuffix.ReplaceAllString(title, ""))
+	if key == "" {
+		key = title
+	}
+	return strings.ToLower(key)
+}
+
+// Reordena los candidatos con relevancia marginal máxima (MMR): en cada paso
+// elige la película que maximiza
+//
+//	(1 - diversity) * relevancia - diversity * similitud máxima con las ya elegidas
+//
+// La relevancia se normaliza al rango [0, 1]. Antes se descartan las
+// temporadas o volúmenes de una serie que ya tiene una película mejor puntuada.
+func diversifyRecommendations(scores map[int]float64, diversity float64, limit int) []int {
+	ranked := sortMoviesByScore(scores, len(scores))
+	if len(ranked) == 0 {
+		return ranked
+	}
+
+	// Deduplicar series según el catálogo
+	var candidates []int
+	seenSeries := make(map[string]bool)
+	for _, movieID := range ranked {
+		key := seriesKey(movieID)
+		if key != "" && seenSeries[key] {
+			continue
+		}
+		seenSeries[key] = true
+		candidates = append(candidates, movieID)
+	}
+
+	maxScore, minScore := scores[ranked[0]], scores[ranked[len(ranked)-1]]
+	relevance := func(movieID int) float64 {
+		if maxScore == minScore {
+			return 1
+		}
+		return (scores[movieID] - minScore) / (maxScore - minScore)
+	}
+
+	// La similitud entre películas usa los vectores del dataset actual
+	dataMu.RLock()
+	defer dataMu.RUnlock()
+
+	var selected []int
+	for len(selected) < limit && len(candidates) > 0 {
+		bestIndex, bestValue := 0, math.Inf(-1)
+		for i, movieID := range candidates {
+			var maxSimilarity float64
+			for _, selectedID := range selected {
+				maxSimilarity = max(maxSimilarity, calculateCosineSimilarity(dataset.vectors[movieID], dataset.vectors[selectedID]))
+			}
+			value := (1-diversity)*relevance(movieID) - diversity*maxSimilarity
+			if value > bestValue {
+				bestIndex, bestValue = i, value
+			}
+		}
+		selected = append(selected, candidates[bestIndex])
+		candidates = append(candidates[:bestIndex], candidates[bestIndex+1:]...)
+	}
+	return selected
+}
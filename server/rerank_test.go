@@ -0,0 +1,121 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSeriesKey(t *testing.T) {
+	tests := []struct {
+		title string
+		key   string
+	}{
+		{"Star Trek: Voyager: Season 1", "star trek: voyager"},
+		{"Star Trek: Voyager: Season 2", "star trek: voyager"},
+		{"Planet Earth: Vol. 2", "planet earth"},
+		{"Planet Earth Volume 3", "planet earth"},
+		{"Dragon Ball Z (Season 4)", "dragon ball z"},
+		{"The Sopranos - Disc 2", "the sopranos"},
+		{"Kill Bill: Part 1", "kill bill"},
+		{"Blackadder, Series 2", "blackadder"},
+		// Las palabras de los sufijos en otra parte del título no cortan nada
+		{"The Book Thief", "the book thief"},
+		{"The Book of Eli", "the book of eli"},
+		{"The Criterion Collection: Seven Samurai", "the criterion collection: seven samurai"},
+		{"Part of Me", "part of me"},
+		{"Four Seasons", "four seasons"},
+		// Sin número no es una temporada
+		{"Season of the Witch", "season of the witch"},
+		// Si no queda nada se usa el título completo
+		{"Season 1", "season 1"},
+	}
+
+	previous := catalog
+	t.Cleanup(func() { catalog = previous })
+	catalog = Catalog{Titles: make(map[int]string)}
+	for i, test := range tests {
+		catalog.Titles[i+1] = test.title
+	}
+	for i, test := range tests {
+		if key := seriesKey(i + 1); key != test.key {
+			t.Errorf("seriesKey(%q) = %q, se esperaba %q", test.title, key, test.key)
+		}
+	}
+	if key := seriesKey(len(tests) + 1); key != "" {
+		t.Errorf("una película fuera del catálogo tiene la clave %q; se esperaba vacía", key)
+	}
+}
+
+// Vectores de prueba: 1 y 2 tienen los mismos usuarios, 3 no comparte
+// ninguno con ellas y 4 comparte uno con 1 y otro con 3
+func useRerankDataset(t *testing.T, titles map[int]string) {
+	t.Helper()
+	dataMu.Lock()
+	previousDataset, previousCatalog := dataset, catalog
+	dataset = &datasetIndex{vectors: map[int]map[int]float64{
+		1: {1: 5, 2: 5},
+		2: {1: 5, 2: 5},
+		3: {3: 5},
+		4: {1: 5, 3: 5},
+	}}
+	catalog = Catalog{Titles: titles}
+	dataMu.Unlock()
+	t.Cleanup(func() {
+		dataMu.Lock()
+		dataset, catalog = previousDataset, previousCatalog
+		dataMu.Unlock()
+	})
+}
+
+func TestDiversifyRecommendations(t *testing.T) {
+	useRerankDataset(t, nil)
+	scores := map[int]float64{1: 1, 2: 0.9, 3: 0.5, 4: 0.1}
+	equal := map[int]float64{1: 0.7, 2: 0.7, 3: 0.7, 4: 0.7}
+
+	tests := []struct {
+		name      string
+		scores    map[int]float64
+		diversity float64
+		limit     int
+		want      []int
+	}{
+		// Sin diversidad se conserva el orden por relevancia
+		{"sin diversidad", scores, 0, 4, []int{1, 2, 3, 4}},
+		// Después de la primera se elige la menos parecida a las ya elegidas:
+		// 3 no se parece a 1, 4 se parece menos que 2
+		{"solo diversidad", scores, 1, 4, []int{1, 3, 4, 2}},
+		{"límite menor", scores, 1, 2, []int{1, 3}},
+		// Con diversidad intermedia 2 vuelve antes que 4 por su relevancia
+		{"límite mayor que los candidatos", scores, 0.5, 10, []int{1, 3, 2, 4}},
+		// Con puntuaciones iguales todas tienen relevancia 1 y decide la similitud
+		{"puntuaciones iguales", equal, 0.5, 4, []int{1, 3, 4, 2}},
+		{"puntuaciones iguales sin diversidad", equal, 0, 4, []int{1, 2, 3, 4}},
+		{"una película", map[int]float64{2: 0.3}, 0.5, 4, []int{2}},
+		{"sin candidatos", map[int]float64{}, 0.5, 4, []int{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := diversifyRecommendations(test.scores, test.diversity, test.limit)
+			if !slices.Equal(got, test.want) {
+				t.Fatalf("diversifyRecommendations = %v, se esperaba %v", got, test.want)
+			}
+		})
+	}
+}
+
+// De cada serie queda solo la temporada mejor puntuada, aunque sin
+// diversidad
+func TestDiversifyKeepsOneTitlePerSeries(t *testing.T) {
+	useRerankDataset(t, map[int]string{
+		1: "Planet Earth: Vol. 2",
+		2: "Planet Earth: Vol. 1",
+		3: "Blackadder, Series 2",
+		// 4 no está en el catálogo: es su propia serie
+	})
+	scores := map[int]float64{1: 0.8, 2: 0.9, 3: 0.5, 4: 0.1}
+
+	got := diversifyRecommendations(scores, 0, 10)
+	if want := []int{2, 3, 4}; !slices.Equal(got, want) {
+		t.Fatalf("diversifyRecommendations = %v, se esperaba %v", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// Puntos que ocupa cada nodo en el anillo. Con más puntos la carga se
+// reparte más parejo.
+const ringVirtualNodes = 256
+
+// Anillo de hash consistente. Cada nodo ocupa varios puntos (nodos
+// virtuales) y cada película pertenece al nodo del primer punto que sigue a
+// su hash. Al agregar o quitar un nodo solo cambian de dueño las películas
+// de los tramos que ese nodo gana o pierde.
+type hashRing struct {
+	nodes  []string
+	points []ringPoint // Ordenados por hash
+}
+
+// Punto del anillo: un nodo virtual
+type ringPoint struct {
+	hash uint64
+	node int // Índice del nodo en hashRing.nodes
+}
+
+// Anillo con el que se reparten las películas. El shard de una película es
+// el índice de su nodo en nodeIPs.
+var movieRing = newHashRing(nodeIPs)
+
+// Crea el anillo con los nodos dados. Los puntos dependen solo de la
+// dirección de cada nodo, no de su posición en la lista.
+func newHashRing(nodes []string) *hashRing {
+	ring := &hashRing{nodes: slices.Clone(nodes)}
+	for node, address := range nodes {
+		for i := 0; i < ringVirtualNodes; i++ {
+			ring.points = append(ring.points, ringPoint{ringHash(address + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		if ring.points[i].hash != ring.points[j].hash {
+			return ring.points[i].hash < ring.points[j].hash
+		}
+		return ring.nodes[ring.points[i].node] < ring.nodes[ring.points[j].node]
+	})
+	return ring
+}
+
+// FNV-1a seguido de una mezcla de bits, porque FNV solo reparte mal las
+// claves cortas y parecidas (como los IDs de las películas)
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xBF58476D1CE4E5B9
+	x = (x ^ (x >> 27)) * 0x94D049BB133111EB
+	return x ^ (x >> 31)
+}
+
+// Posición del primer punto con hash mayor o igual al dado
+func (r *hashRing) search(hash uint64) int {
+	index := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if index == len(r.points) {
+		return 0
+	}
+	return index
+}
+
+// Nodo dueño de una película
+func (r *hashRing) owner(movieID int) int {
+	return r.points[r.search(ringHash(strconv.Itoa(movieID)))].node
+}
+
+// El nodo dado y los count-1 nodos distintos que le siguen en el anillo a
+// partir de su primer punto
+func (r *hashRing) successors(node, count int) []int {
+	count = min(count, len(r.nodes))
+	start := r.search(ringHash(r.nodes[node] + "#0"))
+	nodes := []int{node}
+	for i := 1; len(nodes) < count; i++ {
+		next := r.points[(start+i)%len(r.points)].node
+		if !slices.Contains(nodes, next) {
+			nodes = append(nodes, next)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+// Cantidad de películas con que se prueban los anillos
+const ringTestMovies = 100000
+
+// Direcciones de prueba con el formato de las de los nodos
+func testNodes(count int) []string {
+	nodes := make([]string, count)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("172.20.1.%d:9002", i+2)
+	}
+	return nodes
+}
+
+// Dirección del nodo dueño de cada película
+func ringOwners(ring *hashRing) []string {
+	owners := make([]string, ringTestMovies+1)
+	for movieID := 1; movieID <= ringTestMovies; movieID++ {
+		owners[movieID] = ring.nodes[ring.owner(movieID)]
+	}
+	return owners
+}
+
+func TestHashRingBalance(t *testing.T) {
+	for _, nodes := range [][]string{nodeIPs, testNodes(5), testNodes(8)} {
+		ring := newHashRing(nodes)
+		counts := make(map[string]int)
+		for _, owner := range ringOwners(ring)[1:] {
+			counts[owner]++
+		}
+		expected := float64(ringTestMovies) / float64(len(nodes))
+		for _, node := range nodes {
+			if deviation := math.Abs(float64(counts[node])-expected) / expected; deviation > 0.15 {
+				t.Errorf("%d nodos: %s tiene %d películas, %.0f%% lejos de las %.0f esperadas", len(nodes), node, counts[node], 100*deviation, expected)
+			}
+		}
+	}
+}
+
+// Al agregar un nodo solo se mueven películas hacia él, y aproximadamente
+// la fracción que le corresponde
+func TestHashRingAddNodeMovesOnlyItsShare(t *testing.T) {
+	for _, count := range []int{3, 5, 8} {
+		nodes := testNodes(count + 1)
+		before := ringOwners(newHashRing(nodes[:count]))
+		after := ringOwners(newHashRing(nodes))
+
+		var moved int
+		for movieID := 1; movieID <= ringTestMovies; movieID++ {
+			if before[movieID] == after[movieID] {
+				continue
+			}
+			moved++
+			if after[movieID] != nodes[count] {
+				t.Fatalf("%d nodos: la película %d pasó de %s a %s, que no es el nodo nuevo", count, movieID, before[movieID], after[movieID])
+			}
+		}
+		expected := 1 / float64(count+1)
+		if fraction := float64(moved) / ringTestMovies; math.Abs(fraction-expected) > 0.15*expected {
+			t.Errorf("%d nodos: se movió el %.1f%% de las películas, se esperaba cerca del %.1f%%", count, 100*fraction, 100*expected)
+		}
+	}
+}
+
+// Al quitar un nodo solo se mueven sus películas, y el orden de la lista no
+// importa
+func TestHashRingRemoveNodeMovesOnlyItsMovies(t *testing.T) {
+	nodes := testNodes(5)
+	removed := nodes[2]
+	remaining := slices.Delete(slices.Clone(nodes), 2, 3)
+	slices.Reverse(remaining)
+
+	before := ringOwners(newHashRing(nodes))
+	after := ringOwners(newHashRing(remaining))
+	for movieID := 1; movieID <= ringTestMovies; movieID++ {
+		if before[movieID] != removed && before[movieID] != after[movieID] {
+			t.Fatalf("la película %d pasó de %s a %s sin que se quitara su nodo", movieID, before[movieID], after[movieID])
+		}
+		if after[movieID] == removed {
+			t.Fatalf("la película %d sigue en el nodo quitado", movieID)
+		}
+	}
+}
+
+func TestHashRingSuccessors(t *testing.T) {
+	ring := newHashRing(testNodes(5))
+	for node := range ring.nodes {
+		for count := 1; count <= 6; count++ {
+			successors := ring.successors(node, count)
+			if len(successors) != min(count, len(ring.nodes)) {
+				t.Fatalf("nodo %d: %d sucesores, se pidieron %d", node, len(successors), count)
+			}
+			if successors[0] != node {
+				t.Fatalf("nodo %d: el primer sucesor es %d", node, successors[0])
+			}
+			slices.Sort(successors)
+			if len(slices.Compact(successors)) != len(successors) {
+				t.Fatalf("nodo %d: sucesores repetidos", node)
+			}
+		}
+	}
+}
@@ -1,24 +1,44 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/csv"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"os"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Mapa para almacenar las recomendaciones recibidas de cada nodo
-var recommendationsCount = make(map[int]int)
-var mu sync.Mutex
-var wg sync.WaitGroup
-var ratingData RatingData
+var catalog Catalog
 var err error
 
+// Archivo opcional con el catálogo de películas (MovieID, Año, Título)
+const catalogFile = "/var/my-data/movie_titles.csv"
+
+// Configuración del arranque en frío, ajustable con variables de entorno
+var coldStartStrategy = getEnv("COLD_START", AlgorithmBayesian)
+var coldStartMinRatings = getEnvInt("COLD_START_MIN_RATINGS", 5)
+
+// Tiempo máximo de espera por la respuesta de un nodo. También es el plazo
+// de las solicitudes que llegan sin uno.
+const nodeTimeout = 540 * time.Second
+
 // Lista de IPs de los nodos cliente en la red
 var nodeIPs = []string{
 	"172.20.0.2:9002", // IP y puerto del nodo 1
@@ -35,6 +55,210 @@ var nodeDatasets = []string{
 // Estructura para almacenar la matriz de calificaciones
 type RatingData struct {
 	Ratings map[int]map[int]float64
+	Dates   map[int]map[int]int64 // Fecha (Unix) de cada calificación; vacío si el dataset no la incluye
+}
+
+// Catálogo de películas con su año de estreno y título
+type Catalog struct {
+	Years  map[int]int
+	Titles map[int]string
+	// Años separados por shard, así a cada nodo se le envían solo los de sus
+	// películas
+	ShardYears []map[int]int
+}
+
+// Algoritmos de recomendación que ejecutan los nodos
+const (
+	AlgorithmItemKNN    = "item-knn"   // Similitud de cosenos entre películas
+	AlgorithmUserKNN    = "user-knn"   // Películas de los usuarios más parecidos
+	AlgorithmPopularity = "popularity" // Películas con más calificaciones
+	AlgorithmBayesian   = "bayesian"   // Mayor promedio bayesiano
+	AlgorithmTrending   = "trending"   // Más calificadas en la ventana de tiempo reciente
+	AlgorithmEnsemble   = "ensemble"   // Combinación ponderada de varios algoritmos
+)
+
+// Número de recomendaciones que se devuelven a la API
+const recommendationLimit = 5
+
+// Algoritmos no personalizados, usables también en el arranque en frío
+var baselineAlgorithms = map[string]bool{
+	AlgorithmPopularity: true,
+	AlgorithmBayesian:   true,
+	AlgorithmTrending:   true,
+}
+
+// Búsqueda de películas similares en item-knn
+const (
+	SearchExact       = "exact"       // Se compara con todas las películas
+	SearchApproximate = "approximate" // Solo con las cercanas según el índice LSH de los nodos
+)
+
+// Sin arranque en frío. Cualquier otro valor es el algoritmo no
+// personalizado que se usa cuando las favoritas no aportan señal.
+const ColdStartNone = "none"
+
+// Códigos de error que el servidor y los nodos devuelven
+const (
+	ErrBadRequest       = "bad_request"
+	ErrUnknownMovie     = "unknown_movie"
+	ErrNodeTimeout      = "node_timeout"
+	ErrNodeUnavailable  = "node_unavailable"
+	ErrPartialResults   = "partial_results"
+	ErrNodeBusy         = "node_busy"
+	ErrDatasetNotLoaded = "dataset_not_loaded"
+	ErrDatesNotLoaded   = "dates_not_loaded"
+	ErrCanceled         = "canceled"          // La API cerró la conexión antes de la respuesta
+	ErrDeadlineExceeded = "deadline_exceeded" // Venció el plazo de la solicitud
+	ErrNotLeader        = "not_leader"        // El coordinador no es el líder; Leader indica cuál es
+	// No se pudieron guardar las calificaciones nuevas en el WAL
+	ErrStorageUnavailable = "storage_unavailable"
+	// Advertencia: en el ensamble los algoritmos personalizados usaron el
+	// arranque en frío
+	ErrColdStart = "cold_start"
+)
+
+// Película con su puntuación según un algoritmo
+type ScoredMovie struct {
+	MovieID int
+	Score   float64
+}
+
+// Error tipado que viaja junto con la respuesta de un nodo
+type NodeError struct {
+	Code    string
+	Message string
+}
+
+// Solicitud enviada a cada nodo. El nodo puntúa solo las películas de su
+// shard; lo que depende del dataset completo viaja en la solicitud.
+type NodeRequest struct {
+	Shard            int
+	FavoriteMovieIDs []int
+	FavoriteVectors  map[int]map[int]float64 // Vectores de las favoritas que aportan señal
+	FavoriteDates    map[int]map[int]int64   // Película → usuario → fecha de las favoritas
+	Neighbors        map[int]float64         // Usuarios más parecidos y su similitud (user-knn)
+	RatingData       RatingData              // Datos propios de la solicitud (evaluación); reemplazan al shard
+	Algorithm        string                  // Algoritmo de recomendación
+	Algorithms       []string                // Algoritmos a puntuar en modo ensamble
+	CandidateLimit   int                     // Candidatos a devolver por algoritmo
+	WindowDays       int                     // Ventana del algoritmo trending, en días
+	HalfLifeDays     float64                 // Vida media del peso de las calificaciones (0 = sin decaimiento)
+	LatestDate       int64                   // Fecha de la calificación más reciente del dataset
+	GlobalMean       float64                 // Promedio global de las calificaciones (bayesian)
+	BayesianPrior    float64                 // Peso del promedio global (bayesian)
+	FavoriteYears    map[int]int             // Año de las favoritas según el catálogo (puede estar vacío)
+	MovieYears       map[int]int             // Año de las películas del shard según el catálogo
+	Fallback         string                  // Algoritmo de arranque en frío que reemplaza a los personalizados
+	Search           string                  // Búsqueda de item-knn: exacta (por defecto) o aproximada
+	Timeout          time.Duration           // Plazo del nodo para responder; al vencer abandona el cálculo
+}
+
+// Respuesta de un nodo: candidatos puntuados por algoritmo o un error tipado
+type NodeResponse struct {
+	Shard   int
+	Version int64 // Versión del shard usada o cargada
+	Scores  map[string][]ScoredMovie
+	Report  *NodeReport // Respuesta a un chequeo de salud
+	Error   *NodeError
+}
+
+// Estado que un nodo informa en los chequeos de salud
+type NodeReport struct {
+	ShardVersions map[int]int64 // Shards cargados y su versión
+	Workers       int           // Trabajadores del nodo
+	Busy          int           // Trabajadores calculando recomendaciones
+	Queued        int           // Solicitudes esperando un trabajador
+}
+
+// Mensaje que la API envía al servidor: una solicitud de recomendaciones
+// (por defecto) o calificaciones nuevas
+type APIMessage struct {
+	Type string `json:"type,omitempty"` // "recommend", "ratings", "cluster", "leave" de un nodo, o "vote" y "heartbeat" entre coordinadores
+	RecommendationRequest
+	Ratings   []RatingInput `json:"ratings,omitempty"`
+	TimeoutMs int64         `json:"timeoutMs,omitempty"` // Plazo que le queda a la solicitud en la API
+	Lease     *LeaseMessage `json:"lease,omitempty"`     // Mensajes de la elección del líder
+	NoCache   bool          `json:"noCache,omitempty"`   // No responder desde la caché
+	NoStore   bool          `json:"noStore,omitempty"`   // No guardar la respuesta en la caché
+	Stream    bool          `json:"stream,omitempty"`    // Enviar el resultado de cada shard antes de la respuesta final
+	// Contexto de la traza de la solicitud (W3C traceparent)
+	TraceParent string `json:"traceparent,omitempty"`
+	Node        string `json:"node,omitempty"` // Nodo que se apaga (leave)
+}
+
+// Calificación recibida en POST /ratings
+type RatingInput struct {
+	UserID  int     `json:"userId"`
+	MovieID int     `json:"movieId"`
+	Rating  float64 `json:"rating"`
+	Date    string  `json:"date,omitempty"` // "2005-09-06" o segundos Unix; por defecto, la fecha actual
+}
+
+// Respuesta a una carga de calificaciones
+type RatingsResponse struct {
+	RequestID string         `json:"requestId"`
+	Accepted  int            `json:"accepted"`
+	Version   int64          `json:"version"` // Versión del dataset después de la carga
+	Degraded  bool           `json:"degraded"`
+	Warnings  []ServiceError `json:"warnings,omitempty"`
+	Error     *ServiceError  `json:"error,omitempty"`
+}
+
+// Solicitud de recomendaciones enviada por la API
+type RecommendationRequest struct {
+	RequestID    string             `json:"requestId"`
+	MovieIDs     []int              `json:"movieIds"`
+	Algorithm    string             `json:"algorithm,omitempty"`
+	Weights      map[string]float64 `json:"weights,omitempty"` // Pesos del ensamble
+	WindowDays   int                `json:"windowDays,omitempty"`
+	HalfLifeDays float64            `json:"halfLifeDays,omitempty"` // Decaimiento temporal de las calificaciones
+	ColdStart    string             `json:"coldStart,omitempty"`
+	Diversity    float64            `json:"diversity,omitempty"` // Entre 0 (sin reordenar) y 1
+	Search       string             `json:"search,omitempty"`    // Búsqueda de item-knn: "exact" o "approximate"
+}
+
+// Error tipado que el servidor devuelve a la API
+type ServiceError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Node    string `json:"node,omitempty"`
+	Leader  string `json:"leader,omitempty"` // Coordinador líder conocido (not_leader)
+}
+
+// Respuesta enviada a la API. Si algunos nodos fallan se devuelven los
+// resultados parciales con Degraded en true y el detalle en Warnings.
+type RecommendationResponse struct {
+	RequestID       string             `json:"requestId"`
+	Algorithm       string             `json:"algorithm,omitempty"`
+	Weights         map[string]float64 `json:"weights,omitempty"` // Pesos usados en modo ensamble
+	MovieIDs        []int              `json:"movieIds"`
+	UnknownMovieIDs []int              `json:"unknownMovieIds,omitempty"`
+	ColdStart       string             `json:"coldStart,omitempty"` // Estrategia de respaldo usada, si hubo
+	Cached          bool               `json:"cached,omitempty"`    // La respuesta salió de la caché
+	Degraded        bool               `json:"degraded"`
+	Warnings        []ServiceError     `json:"warnings,omitempty"`
+	Error           *ServiceError      `json:"error,omitempty"`
+}
+
+// Resultado de un shard que se envía a la API apenas responde su nodo, si
+// la solicitud lo pide con stream. La respuesta final llega después.
+type PartialResult struct {
+	Type      string        `json:"type"` // Siempre "partial"
+	RequestID string        `json:"requestId"`
+	Shard     int           `json:"shard"`
+	Node      string        `json:"node,omitempty"` // Nodo que respondió
+	MovieIDs  []int         `json:"movieIds"`       // Mejores películas del shard
+	Error     *ServiceError `json:"error,omitempty"`
+}
+
+// Tipo de los resultados parciales
+const MessagePartial = "partial"
+
+// Resultado de la consulta a un nodo
+type nodeResult struct {
+	node     string
+	response NodeResponse
+	err      *ServiceError
 }
 
 // Cargar datos de calificaciones
@@ -45,7 +269,10 @@ func loadNetflixData(filename string) (RatingData, error) {
 	}
 	defer file.Close()
 
-	data := RatingData{Ratings: make(map[int]map[int]float64)}
+	data := RatingData{
+		Ratings: make(map[int]map[int]float64),
+		Dates:   make(map[int]map[int]int64),
+	}
 	reader := csv.NewReader(file)
 
 	// Leer encabezado
@@ -56,9 +283,12 @@ func loadNetflixData(filename string) (RatingData, error) {
 
 	for {
 		record, err := reader.Read()
-		if err != nil {
+		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return data, err
+		}
 
 		movieID, _ := strconv.Atoi(record[0])
 		customerID, _ := strconv.Atoi(record[1])
@@ -68,175 +298,839 @@ func loadNetflixData(filename string) (RatingData, error) {
 			data.Ratings[customerID] = make(map[int]float64)
 		}
 		data.Ratings[customerID][movieID] = rating
+
+		// La cuarta columna, si existe, es la fecha de la calificación
+		if len(record) > 3 {
+			if date, ok := parseRatingDate(record[3]); ok {
+				if data.Dates[customerID] == nil {
+					data.Dates[customerID] = make(map[int]int64)
+				}
+				data.Dates[customerID][movieID] = date
+			}
+		}
 	}
 
 	return data, nil
 }
 
-// Función que maneja la conexión con el nodo cliente
-func handleNodeConnection(conn net.Conn, favoriteMovieIDs []int, ratingData RatingData, nodeIndex int) {
+// Convierte la fecha de una calificación ("2005-09-06" o segundos Unix) a
+// segundos Unix
+func parseRatingDate(value string) (int64, bool) {
+	value = strings.TrimSpace(value)
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		return date.Unix(), true
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return seconds, true
+	}
+	return 0, false
+}
+
+// Cargar el catálogo de películas. Los títulos pueden contener comas sin
+// comillas, por lo que todo lo que sigue al año se considera el título.
+func loadCatalog(filename string) (Catalog, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return Catalog{}, err
+	}
+	defer file.Close()
+
+	catalog := Catalog{Years: make(map[int]int), Titles: make(map[int]string)}
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			break
+		}
+		if len(record) < 3 {
+			continue
+		}
+
+		movieID, err := strconv.Atoi(record[0])
+		if err != nil {
+			continue
+		}
+		if year, err := strconv.Atoi(record[1]); err == nil {
+			catalog.Years[movieID] = year
+		}
+		catalog.Titles[movieID] = strings.Join(record[2:], ",")
+	}
+
+	catalog.ShardYears = make([]map[int]int, len(nodeIPs))
+	for shard := range catalog.ShardYears {
+		catalog.ShardYears[shard] = make(map[int]int)
+	}
+	for movieID, year := range catalog.Years {
+		catalog.ShardYears[shardOf(movieID)][movieID] = year
+	}
+	return catalog, nil
+}
+
+// Años de las películas de un shard; nil si el catálogo no se cargó
+func (c Catalog) shardYears(shard int) map[int]int {
+	if shard >= len(c.ShardYears) {
+		return nil
+	}
+	return c.ShardYears[shard]
+}
+
+// Lee una variable de entorno o devuelve el valor por defecto
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Lee una variable de entorno entera o devuelve el valor por defecto
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Función que maneja la conexión con el nodo cliente. Si ctx se cancela o
+// vence mientras el nodo calcula, se le avisa para que abandone el cálculo.
+func handleNodeConnection(ctx context.Context, conn net.Conn, message NodeMessage) (result nodeResult) {
 	defer conn.Close()
 
-	// Timeout de 10 minutos en la conexión
-	// conn.SetDeadline(time.Now().Add(600 * time.Second))
+	nodeIP := conn.RemoteAddr().String()
+
+	// Tramo del mensaje, del que el nodo cuelga los suyos
+	ctx, span := tracer.Start(ctx, "server.node_call", trace.WithSpanKind(trace.SpanKindClient))
+	span.SetAttributes(attribute.String("node", nodeIP), attribute.String("message.type", message.Type))
+	message.TraceParent = traceParent(ctx)
+	message.RequestID = requestIDFrom(ctx)
+
+	// Trabajo en curso en el nodo, para /cluster
+	if inFlight, ok := nodeInFlight[nodeIP]; ok {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+	}
+
+	// Métricas del mensaje: resultado, duración y bytes
+	start := time.Now()
+	metered := &meteredConn{Conn: conn}
+	conn = metered
+	defer func() {
+		code := "ok"
+		if result.err != nil {
+			code = result.err.Code
+			span.SetStatus(codes.Error, result.err.Message)
+		}
+		span.SetAttributes(attribute.String("code", code),
+			attribute.Int64("bytes.sent", metered.sent.Load()),
+			attribute.Int64("bytes.received", metered.received.Load()))
+		span.End()
+		nodeRequests.WithLabelValues(nodeIP, message.Type, code).Inc()
+		nodeRequestDuration.WithLabelValues(nodeIP, message.Type).Observe(time.Since(start).Seconds())
+		nodePayloadBytes.WithLabelValues(nodeIP, "sent").Add(float64(metered.sent.Load()))
+		nodePayloadBytes.WithLabelValues(nodeIP, "received").Add(float64(metered.received.Load()))
+	}()
+	deadline := time.Now().Add(nodeTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
 
-	// Crear un paquete que incluya las películas favoritas y el dataset
-	payload := struct {
-		FavoriteMovieIDs []int
-		RatingData       RatingData
-	}{
-		FavoriteMovieIDs: favoriteMovieIDs,
-		RatingData:       ratingData,
+	// El nodo recibe un plazo algo menor para que su error llegue a tiempo
+	if message.Recommend != nil {
+		request := *message.Recommend
+		request.Timeout = hopBudget(time.Until(deadline))
+		message.Recommend = &request
+		span.SetAttributes(attribute.Int("shard", request.Shard))
 	}
 
-	// Enviar el paquete al nodo cliente
+	// Enviar el mensaje al nodo cliente
+	_, encodeSpan := tracer.Start(ctx, "server.encode")
 	encoder := gob.NewEncoder(conn)
-	if err := encoder.Encode(payload); err != nil {
-		fmt.Println("Error al enviar datos al nodo:", err)
-		wg.Done()
-		return
+	err := encoder.Encode(message)
+	encodeSpan.End()
+	if err != nil {
+		slog.WarnContext(ctx, "Error al enviar datos al nodo", "node", nodeIP, "error", err)
+		return nodeResult{node: nodeIP, err: nodeConnectionError(nodeIP, err)}
+	}
+
+	if message.Recommend != nil {
+		slog.DebugContext(ctx, "Solicitud enviada al nodo", "node", nodeIP, "shard", message.Recommend.Shard, "favorites", message.Recommend.FavoriteMovieIDs)
 	}
 
-	fmt.Printf("Datos enviados al nodo %d: Películas favoritas: %v\n", nodeIndex+1, favoriteMovieIDs)
+	// Avisar al nodo si la solicitud se cancela y dejar de esperar su respuesta
+	stop := context.AfterFunc(ctx, func() {
+		encoder.Encode(NodeMessage{Type: MessageCancel})
+		conn.Close()
+	})
+	defer stop()
 
-	// Recibir recomendaciones del nodo
-	var recommendations []int
-	decoder := gob.NewDecoder(conn)
-	if err := decoder.Decode(&recommendations); err != nil {
-		fmt.Println("Error al recibir recomendaciones del nodo:", err)
-		wg.Done()
-		return
+	// Recibir la respuesta del nodo. La espera del primer byte (red y cálculo
+	// en el nodo) se mide aparte de la decodificación.
+	reader := bufio.NewReader(conn)
+	_, waitSpan := tracer.Start(ctx, "server.wait_node")
+	_, err = reader.Peek(1)
+	waitSpan.End()
+	var response NodeResponse
+	if err == nil {
+		_, decodeSpan := tracer.Start(ctx, "server.decode")
+		err = gob.NewDecoder(reader).Decode(&response)
+		decodeSpan.End()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			slog.InfoContext(ctx, "Solicitud al nodo interrumpida", "node", nodeIP, "reason", ctx.Err())
+			return nodeResult{node: nodeIP, err: contextError(ctx, nodeIP)}
+		}
+		slog.WarnContext(ctx, "Error al recibir la respuesta del nodo", "node", nodeIP, "error", err)
+		return nodeResult{node: nodeIP, err: nodeConnectionError(nodeIP, err)}
+	}
+
+	if response.Error != nil {
+		slog.WarnContext(ctx, "El nodo devolvió un error", "node", nodeIP, "code", response.Error.Code, "error", response.Error.Message)
+		return nodeResult{node: nodeIP, response: response, err: &ServiceError{
+			Code:    response.Error.Code,
+			Message: response.Error.Message,
+			Node:    nodeIP,
+		}}
 	}
 
-	fmt.Printf("Recomendaciones recibidas del nodo %d: %v\n", nodeIndex+1, recommendations)
+	slog.DebugContext(ctx, "Respuesta recibida del nodo", "node", nodeIP, "type", message.Type, "shard", response.Shard)
+	return nodeResult{node: nodeIP, response: response}
+}
+
+// Traduce un error de red con un nodo a un error tipado
+func nodeConnectionError(nodeIP string, err error) *ServiceError {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return &ServiceError{
+			Code:    ErrNodeTimeout,
+			Message: fmt.Sprintf("el nodo no respondió en %v", nodeTimeout),
+			Node:    nodeIP,
+		}
+	}
+	return &ServiceError{Code: ErrNodeUnavailable, Message: err.Error(), Node: nodeIP}
+}
 
-	// Almacenar las recomendaciones en el mapa compartido
-	mu.Lock()
-	for _, movieID := range recommendations {
-		recommendationsCount[movieID]++
+// Traduce la cancelación o el vencimiento de una solicitud a un error tipado
+func contextError(ctx context.Context, nodeIP string) *ServiceError {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &ServiceError{Code: ErrDeadlineExceeded, Message: "venció el plazo de la solicitud", Node: nodeIP}
 	}
-	mu.Unlock()
+	return &ServiceError{Code: ErrCanceled, Message: "la solicitud fue cancelada", Node: nodeIP}
+}
 
-	wg.Done()
+// Parte de un plazo que se le da al siguiente salto (API → servidor → nodo).
+// El resto queda para responder con un error tipado si ese salto no termina.
+func hopBudget(timeout time.Duration) time.Duration {
+	return timeout - min(timeout/10, time.Second)
 }
 
 // Función para verificar si un nodo está disponible
 func checkNodeHealth(nodeIP string) bool {
-	conn, err := net.DialTimeout("tcp", nodeIP, 2*time.Second)
+	_, err := probeNode(nodeIP)
+	return err == nil
+}
+
+// Pide al nodo su estado. Un nodo que acepta conexiones pero no atiende
+// mensajes (por ejemplo, detenido o sin memoria) no responde a tiempo y
+// cuenta como caído.
+func probeNode(nodeIP string) (*NodeReport, error) {
+	conn, err := net.DialTimeout("tcp", nodeIP, healthCheckTimeout)
 	if err != nil {
-		return false
-	}
-	conn.Close()
-	return true
-}
-
-// Función para redirigir la tarea a otro nodo disponible
-func handleReassignment(favoriteMovieIDs []int, ratingData RatingData) {
-	for _, nodeIP := range nodeIPs {
-		if checkNodeHealth(nodeIP) {
-			conn, err := net.Dial("tcp", nodeIP)
-			if err == nil {
-				// Si el nodo está disponible, enviar los datos
-				wg.Add(1)
-				go handleNodeConnection(conn, favoriteMovieIDs, ratingData, 0) // El índice de nodo es irrelevante aquí
-				return
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(healthCheckTimeout))
+
+	if err := gob.NewEncoder(conn).Encode(NodeMessage{Type: MessageHealth}); err != nil {
+		return nil, err
+	}
+	var response NodeResponse
+	if err := gob.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, err
+	}
+	if response.Error != nil {
+		return nil, fmt.Errorf("%s: %s", response.Error.Code, response.Error.Message)
+	}
+	if response.Report == nil {
+		return nil, errors.New("el nodo no informó su estado")
+	}
+	return response.Report, nil
+}
+
+// Función para redirigir la tarea a otra copia viva del shard. No se usan
+// nodos sin copia: el shard que recibirían no se actualiza ni se borra
+// después. busy indica que el nodo que falló estaba ocupado; si tampoco hay
+// otra copia libre, se responde node_busy.
+func handleReassignment(ctx context.Context, payload NodeRequest, failedNodeIP string, busy bool) nodeResult {
+	for _, nodeIP := range otherReplicas(payload.Shard, failedNodeIP) {
+		if ctx.Err() != nil {
+			return nodeResult{node: failedNodeIP, err: contextError(ctx, failedNodeIP)}
+		}
+		if !checkNodeHealth(nodeIP) {
+			continue
+		}
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", nodeIP)
+		if err == nil {
+			// Si el nodo está disponible, enviar los datos
+			result := queryShard(ctx, conn, payload)
+			if result.err != nil && result.err.Code == ErrNodeBusy {
+				busy = true
+				continue
 			}
+			return result
 		}
 	}
-	fmt.Println("No hay nodos disponibles para reasignar la tarea.")
-	wg.Done()
+	if busy {
+		slog.WarnContext(ctx, "Todas las copias disponibles del shard están ocupadas", "shard", payload.Shard)
+		return nodeResult{node: failedNodeIP, err: &ServiceError{
+			Code:    ErrNodeBusy,
+			Message: "todas las copias disponibles del shard están ocupadas",
+			Node:    failedNodeIP,
+		}}
+	}
+	slog.WarnContext(ctx, "No hay otra copia disponible del shard para reasignar la tarea", "shard", payload.Shard)
+	return nodeResult{node: failedNodeIP, err: &ServiceError{
+		Code:    ErrNodeUnavailable,
+		Message: "no hay otra copia disponible del shard para reasignar la tarea",
+		Node:    failedNodeIP,
+	}}
 }
 
 // Función que maneja la conexión con la API
 func handleAPIConnection(conn net.Conn) {
 	defer conn.Close()
 
+	// Métricas del mensaje: tipo, resultado, duración y bytes
+	start := time.Now()
+	metered := &meteredConn{Conn: conn}
+	conn = metered
+	kind, code := "unknown", ""
+	var span trace.Span
+	defer func() {
+		if span != nil {
+			span.SetAttributes(attribute.String("code", code))
+			span.End()
+		}
+		apiRequests.WithLabelValues(kind, code).Inc()
+		apiRequestDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+		apiPayloadBytes.WithLabelValues("received").Add(float64(metered.received.Load()))
+		apiPayloadBytes.WithLabelValues("sent").Add(float64(metered.sent.Load()))
+	}()
+
 	// Configura el timeout para la conexión
 	//  conn.SetDeadline(time.Now().Add(600 * time.Second))
 
-	// Recibir los IDs de películas favoritas desde la API
-	var favoriteMovieIDs []int
+	// Recibir la solicitud desde la API
+	var message APIMessage
 	decoder := json.NewDecoder(conn)
-	if err := decoder.Decode(&favoriteMovieIDs); err != nil {
-		fmt.Println("Error al decodificar IDs de películas favoritas desde la API:", err)
+	if err := decoder.Decode(&message); err != nil {
+		slog.Warn("Error al decodificar la solicitud desde la API", "error", err)
+		code = writeAPIResponse(conn, RecommendationResponse{Error: &ServiceError{
+			Code:    ErrBadRequest,
+			Message: "no se pudo decodificar la solicitud",
+		}})
 		return
 	}
 
-	fmt.Println("Películas favoritas recibidas desde la API:", favoriteMovieIDs)
+	kind = message.Type
+	if kind == "" {
+		kind = "recommend"
+	}
 
-	// Iniciar la conexión con los nodos clientes
-	wg.Add(len(nodeIPs))
-	for i, nodeIP := range nodeIPs {
-		// Cargar el dataset correspondiente
-		// ratingData, err := loadNetflixData(nodeDatasets[i])
-		/*if err != nil {
-			fmt.Printf("Error al cargar dataset %s: %v\n", nodeDatasets[i], err)
-			wg.Done()
-			continue
-		}*/
+	// Mensajes de otros coordinadores
+	if message.Type == MessageVote || message.Type == MessageHeartbeat || message.Type == MessageResign {
+		code = writeAPIResponse(conn, handleLeaseMessage(message.Type, message.Lease))
+		return
+	}
 
-		// Conectar a cada nodo según su IP en la bitácora
-		conn, err := net.Dial("tcp", nodeIP)
-		if err != nil {
-			fmt.Printf("Error al conectar con el nodo %s: %v\n", nodeIP, err)
-			handleReassignment(favoriteMovieIDs, ratingData)
-			wg.Done()
-			continue
+	// Tramo de la solicitud, hijo del que envió la API. Los registros llevan
+	// el ID de la solicitud que generó la API.
+	traceCtx, span := tracer.Start(contextWithTraceParent(requestsCtx, message.TraceParent), "server."+kind, trace.WithSpanKind(trace.SpanKindServer))
+	traceCtx = withRequestID(traceCtx, message.RequestID)
+	span.SetAttributes(attribute.String("request.id", message.RequestID))
+	recordSpan(traceCtx, "server.decode_request", start, time.Now())
+
+	// Solo el líder atiende solicitudes; la API reintenta con el que se indica
+	if !isLeader() {
+		code = writeAPIResponse(conn, RecommendationResponse{RequestID: message.RequestID, Error: notLeaderError()})
+		return
+	}
+
+	// Un nodo avisa que se apaga
+	if message.Type == MessageLeave {
+		nodeLeaving(message.Node)
+		code = writeAPIResponse(conn, LeaveResponse{Node: message.Node})
+		return
+	}
+
+	// Estado del clúster para los operadores, que la API expone en /cluster
+	if message.Type == MessageCluster {
+		code = writeAPIResponse(conn, clusterStatus())
+		return
+	}
+
+	apiInFlight.Add(1)
+	defer apiInFlight.Add(-1)
+
+	if message.Type == "ratings" {
+		slog.InfoContext(traceCtx, "Calificaciones recibidas desde la API", "ratings", len(message.Ratings))
+		response := ingestRatings(traceCtx, message.Ratings)
+		response.RequestID = message.RequestID
+		code = writeAPIResponse(conn, response)
+		return
+	}
+
+	request := message.RecommendationRequest
+	slog.InfoContext(traceCtx, "Solicitud de recomendaciones recibida desde la API", "favorites", len(request.MovieIDs))
+	slog.DebugContext(traceCtx, "Películas favoritas", "movie_ids", request.MovieIDs)
+
+	// Plazo de la solicitud según lo que le queda en la API
+	timeout := nodeTimeout
+	if message.TimeoutMs > 0 {
+		timeout = hopBudget(time.Duration(message.TimeoutMs) * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(traceCtx, timeout)
+	defer cancel()
+	go watchAPIConnection(ctx, conn, cancel)
+
+	if len(request.MovieIDs) == 0 {
+		code = writeAPIResponse(conn, RecommendationResponse{RequestID: request.RequestID, Error: &ServiceError{
+			Code:    ErrBadRequest,
+			Message: "la solicitud no contiene películas favoritas",
+		}})
+		return
+	}
+
+	// Crear el paquete con las favoritas y lo que los nodos necesitan del
+	// dataset completo, salvo que la respuesta ya esté en la caché
+	_, prepareSpan := tracer.Start(ctx, "server.prepare")
+	dataMu.RLock()
+	serviceErr := validateRequest(&request)
+	var payload NodeRequest
+	var unknownMovieIDs []int
+	var fallback string
+	var cacheKeyValue string
+	var cached RecommendationResponse
+	var hit bool
+	if serviceErr == nil && recommendationCache.enabled() {
+		cacheKeyValue = cacheKey(request, datasetVersion)
+		if !message.NoCache {
+			cached, hit = recommendationCache.get(cacheKeyValue)
 		}
+	}
+	if serviceErr == nil && !hit {
+		payload, unknownMovieIDs, fallback, serviceErr = dataset.nodeRequest(request)
+	}
+	dataMu.RUnlock()
+	prepareSpan.SetAttributes(attribute.Bool("cache.hit", hit))
+	prepareSpan.End()
+	if len(unknownMovieIDs) > 0 {
+		slog.InfoContext(ctx, "Películas favoritas que no están en los datos", "movie_ids", unknownMovieIDs)
+	}
+	if fallback != "" {
+		slog.InfoContext(ctx, "Arranque en frío", "algorithm", fallback)
+	}
+	if serviceErr != nil {
+		slog.InfoContext(ctx, "Solicitud rechazada", "code", serviceErr.Code, "error", serviceErr.Message)
+		code = writeAPIResponse(conn, RecommendationResponse{RequestID: request.RequestID, UnknownMovieIDs: unknownMovieIDs, Error: serviceErr})
+		return
+	}
+	if hit {
+		slog.InfoContext(ctx, "Solicitud atendida desde la caché")
+		cached.RequestID = request.RequestID
+		cached.Cached = true
+		code = writeAPIResponse(conn, cached)
+		return
+	}
+
+	// Consultar cada shard con el nodo que es su dueño. Si la API pide los
+	// resultados parciales, se envía cada shard apenas responde.
+	results := make([]nodeResult, len(nodeIPs))
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	for shard := range nodeIPs {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+
+			shardPayload := payload
+			shardPayload.Shard = shard
+			if payload.Fallback != "" {
+				shardPayload.MovieYears = catalog.shardYears(shard)
+			}
+
+			// Si el dueño tarda, se consulta también a otro nodo
+			shardCtx, shardSpan := tracer.Start(ctx, "server.query_shard")
+			shardSpan.SetAttributes(attribute.Int("shard", shard))
+			results[shard] = queryShardHedged(shardCtx, shardPayload)
+			if err := results[shard].err; err != nil {
+				shardSpan.SetStatus(codes.Error, err.Message)
+			}
+			shardSpan.End()
 
-		go handleNodeConnection(conn, favoriteMovieIDs, ratingData, i)
+			if message.Stream && ctx.Err() == nil {
+				partial := partialResult(shard, results[shard], request)
+				writeMu.Lock()
+				writeAPIResponse(conn, partial)
+				writeMu.Unlock()
+			}
+		}(shard)
 	}
 
 	// Esperar a que todos los nodos terminen de enviar recomendaciones
 	wg.Wait()
 
-	fmt.Println("Todas las recomendaciones han sido recibidas.")
+	// Si la API se desconectó nadie espera la respuesta
+	if errors.Is(ctx.Err(), context.Canceled) {
+		slog.InfoContext(ctx, "Solicitud cancelada por la API")
+		code = ErrCanceled
+		return
+	}
+
+	slog.DebugContext(ctx, "Todas las recomendaciones han sido recibidas")
 
 	// Recopilar y enviar las recomendaciones al cliente API
-	finalRecommendations := gatherFinalRecommendations()
-	response, _ := json.Marshal(finalRecommendations)
-	conn.Write(response)
+	_, gatherSpan := tracer.Start(ctx, "server.gather")
+	response := gatherFinalRecommendations(results, request)
+	gatherSpan.End()
+	response.RequestID = request.RequestID
+	response.Algorithm = request.Algorithm
+	response.Weights = request.Weights
+	response.UnknownMovieIDs = unknownMovieIDs
+	response.ColdStart = fallback
+	if fallback != "" && request.Algorithm == AlgorithmEnsemble && response.Error == nil {
+		response.Warnings = append(response.Warnings, ServiceError{
+			Code:    ErrColdStart,
+			Message: fmt.Sprintf("ninguna favorita tiene calificaciones suficientes: item-knn y user-knn se reemplazaron por %s", fallback),
+		})
+	}
+
+	// Solo se guardan las respuestas completas; la clave incluye la versión
+	// del dataset, así una carga de calificaciones no deja resultados viejos
+	if cacheKeyValue != "" && !message.NoStore && response.Error == nil && !response.Degraded {
+		recommendationCache.put(cacheKeyValue, response)
+	}
+	_, writeSpan := tracer.Start(ctx, "server.write_response")
+	code = writeAPIResponse(conn, response)
+	writeSpan.End()
+}
+
+// La API no envía nada más después de la solicitud: si cierra la conexión
+// antes de recibir la respuesta, su cliente se desconectó o venció su plazo
+// y se cancela el trabajo pendiente en los nodos
+func watchAPIConnection(ctx context.Context, conn net.Conn, cancel context.CancelFunc) {
+	conn.Read(make([]byte, 1))
+	if ctx.Err() == nil {
+		slog.InfoContext(ctx, "La API cerró la conexión de la solicitud; se cancela")
+	}
+	cancel()
+}
+
+// Completa los valores por defecto de los parámetros de la solicitud y
+// verifica que sean válidos para los datos cargados
+func validateRequest(request *RecommendationRequest) *ServiceError {
+	// Las favoritas repetidas no cuentan dos veces: se quitan y se ordenan,
+	// así la solicitud que llega a los nodos es la misma que da la clave de
+	// la caché
+	request.MovieIDs = slices.Clone(request.MovieIDs)
+	slices.Sort(request.MovieIDs)
+	request.MovieIDs = slices.Compact(request.MovieIDs)
+
+	if request.Algorithm == "" {
+		request.Algorithm = AlgorithmItemKNN
+	}
+	switch {
+	case request.Algorithm == AlgorithmEnsemble:
+		if request.Weights == nil {
+			request.Weights = ensembleWeights
+		}
+		if err := validateEnsembleWeights(request.Weights); err != nil {
+			return &ServiceError{Code: ErrBadRequest, Message: err.Error()}
+		}
+	case request.Algorithm == AlgorithmItemKNN, request.Algorithm == AlgorithmUserKNN, baselineAlgorithms[request.Algorithm]:
+		request.Weights = nil
+	default:
+		return &ServiceError{Code: ErrBadRequest, Message: fmt.Sprintf("algoritmo desconocido: %s", request.Algorithm)}
+	}
+
+	if request.Search == "" {
+		request.Search = SearchExact
+	}
+	if request.Search != SearchExact && request.Search != SearchApproximate {
+		return &ServiceError{Code: ErrBadRequest, Message: fmt.Sprintf("búsqueda desconocida: %s", request.Search)}
+	}
+
+	if request.Diversity < 0 || request.Diversity > 1 {
+		return &ServiceError{Code: ErrBadRequest, Message: "diversity debe estar entre 0 y 1"}
+	}
+
+	if request.ColdStart == "" {
+		request.ColdStart = coldStartStrategy
+	}
+	if request.ColdStart != ColdStartNone && !baselineAlgorithms[request.ColdStart] {
+		return &ServiceError{
+			Code:    ErrBadRequest,
+			Message: fmt.Sprintf("estrategia de arranque en frío desconocida: %s", request.ColdStart),
+		}
+	}
+
+	if len(dataset.data.Ratings) == 0 {
+		return &ServiceError{Code: ErrDatasetNotLoaded, Message: "el servidor no tiene datos de calificación cargados"}
+	}
+	if request.HalfLifeDays < 0 {
+		return &ServiceError{Code: ErrBadRequest, Message: "halfLifeDays no puede ser negativo"}
+	}
+	needsDates := request.Algorithm == AlgorithmTrending || request.Weights[AlgorithmTrending] > 0 || request.HalfLifeDays > 0
+	if needsDates && dataset.latest == 0 {
+		return &ServiceError{Code: ErrDatesNotLoaded, Message: "el dataset no incluye las fechas de las calificaciones"}
+	}
+	return nil
+}
+
+// Envía la respuesta serializada como JSON a la API y devuelve su resultado
+// para las métricas
+func writeAPIResponse(conn net.Conn, response any) string {
+	data, _ := json.Marshal(response)
+	conn.Write(data)
+	return responseCode(response)
+}
+
+// Resultado de una respuesta: el código de su error, "degraded" o "ok"
+func responseCode(response any) string {
+	var serviceErr *ServiceError
+	var degraded bool
+	switch r := response.(type) {
+	case RecommendationResponse:
+		serviceErr, degraded = r.Error, r.Degraded
+	case RatingsResponse:
+		serviceErr, degraded = r.Error, r.Degraded
+	}
+	switch {
+	case serviceErr != nil:
+		return serviceErr.Code
+	case degraded:
+		return "degraded"
+	}
+	return "ok"
+}
+
+// Reúne los candidatos de todos los shards y los ordena por puntuación; en
+// modo ensamble se combinan las puntuaciones según los pesos. Si se pidió
+// diversidad, los candidatos se reordenan al final. Si falta algún shard,
+// la respuesta se marca como degradada.
+func gatherFinalRecommendations(results []nodeResult, request RecommendationRequest) RecommendationResponse {
+	scores := make(map[int]float64)
+	var failures []ServiceError
+	for _, result := range results {
+		if result.err != nil {
+			failures = append(failures, *result.err)
+			continue
+		}
+		// Los shards no comparten películas y las puntuaciones son comparables
+		for _, candidates := range result.response.Scores {
+			for _, candidate := range candidates {
+				scores[candidate.MovieID] = candidate.Score
+			}
+		}
+	}
+
+	// Ningún nodo respondió: se devuelve el error más representativo
+	if len(failures) == len(results) {
+		return RecommendationResponse{Error: summarizeFailures(failures)}
+	}
+
+	if request.Algorithm == AlgorithmEnsemble {
+		scores = blendScores(results, request.Weights)
+	}
+	sortedRecommendations := []int{}
+	switch {
+	case request.Diversity > 0:
+		sortedRecommendations = append(sortedRecommendations, diversifyRecommendations(scores, request.Diversity, recommendationLimit)...)
+	case request.Algorithm == AlgorithmEnsemble:
+		sortedRecommendations = append(sortedRecommendations, sortMoviesByScore(scores, recommendationLimit)...)
+	default:
+		// Sin diversidad se devuelven todas las recomendaciones de los nodos
+		sortedRecommendations = append(sortedRecommendations, sortMoviesByScore(scores, len(scores))...)
+	}
+
+	response := RecommendationResponse{MovieIDs: sortedRecommendations}
+	if len(failures) > 0 {
+		response.Degraded = true
+		response.Warnings = append([]ServiceError{{
+			Code:    ErrPartialResults,
+			Message: fmt.Sprintf("respondieron %d de %d shards", len(results)-len(failures), len(results)),
+		}}, failures...)
+	}
+	return response
 }
 
-// Reúne las recomendaciones basadas en frecuencia y las ordena
-func gatherFinalRecommendations() []int {
-	var sortedRecommendations []int
-	mu.Lock()
-	for movieID := range recommendationsCount {
-		sortedRecommendations = append(sortedRecommendations, movieID)
+// Mejores películas de un solo shard, ordenadas como la respuesta final
+func partialResult(shard int, result nodeResult, request RecommendationRequest) PartialResult {
+	response := gatherFinalRecommendations([]nodeResult{result}, request)
+	partial := PartialResult{
+		Type:      MessagePartial,
+		RequestID: request.RequestID,
+		Shard:     shard,
+		Node:      result.node,
+		MovieIDs:  response.MovieIDs,
+		Error:     response.Error,
+	}
+	if partial.MovieIDs == nil {
+		partial.MovieIDs = []int{}
+	}
+	return partial
+}
+
+// Ordena las películas por puntuación (de mayor a menor, los empates por ID)
+// y devuelve como máximo limit
+func sortMoviesByScore(scores map[int]float64, limit int) []int {
+	movieIDs := make([]int, 0, len(scores))
+	for movieID := range scores {
+		movieIDs = append(movieIDs, movieID)
+	}
+	sort.Slice(movieIDs, func(i, j int) bool {
+		a, b := movieIDs[i], movieIDs[j]
+		if scores[a] != scores[b] {
+			return scores[a] > scores[b]
+		}
+		return a < b
+	})
+	if len(movieIDs) > limit {
+		movieIDs = movieIDs[:limit]
+	}
+	return movieIDs
+}
+
+// Devuelve las claves del conjunto en orden ascendente
+func sortedKeys(set map[int]bool) []int {
+	var keys []int
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// Elige el error a reportar cuando fallan todos los nodos. Los errores de
+// la solicitud y de datos (película desconocida, dataset sin cargar) tienen
+// prioridad sobre los de red porque describen mejor la causa.
+func summarizeFailures(failures []ServiceError) *ServiceError {
+	priority := []string{ErrBadRequest, ErrUnknownMovie, ErrDatasetNotLoaded, ErrDatesNotLoaded, ErrDeadlineExceeded, ErrNodeBusy, ErrNodeTimeout}
+	for _, code := range priority {
+		for _, failure := range failures {
+			if failure.Code == code {
+				return &ServiceError{Code: failure.Code, Message: failure.Message}
+			}
+		}
+	}
+	return &ServiceError{
+		Code:    ErrNodeUnavailable,
+		Message: fmt.Sprintf("ninguno de los %d nodos pudo responder", len(failures)),
 	}
-	mu.Unlock()
-	return sortedRecommendations
 }
 
 func main() {
+	flag.Parse()
+	slog.SetDefault(newLogger())
+
+	// Crear los tramos de las trazas y exportarlos
+	initTracing()
+
+	// Exponer las métricas, la salud y el estado del clúster. /readyz
+	// responde que no está listo hasta que termine la carga de los datos.
+	if *evaluateSplit == "" {
+		go serveHTTP()
+	}
+
 	// Cargar los datos
-	fmt.Println("Cargando datos...")
-	ratingData, err = loadNetflixData(nodeDatasets[0])
+	slog.Info("Cargando datos")
+	// La instantánea más reciente y el WAL tienen prioridad sobre el dataset
+	// original, ya que incluyen las calificaciones agregadas después. El WAL
+	// se lee sin modificarlo porque puede estar usándolo el líder; este
+	// coordinador lo abre si es elegido.
+	index, version, err := loadDatasetReadOnly(walDir, nodeDatasets[0])
 	if err != nil {
-		fmt.Printf("Error al cargar dataset %s: %v\n", nodeDatasets[0], err)
+		slog.Error("Error al cargar el dataset", "file", nodeDatasets[0], "error", err)
 		os.Exit(1)
 	}
-	fmt.Println("Datos cargados exitosamente.")
+	dataMu.Lock()
+	dataset = index
+	datasetVersion = version
+	for shard := range shardVersions {
+		shardVersions[shard] = version
+	}
+	dataMu.Unlock()
+	slog.Info("Datos cargados", "users_with_dates", len(index.data.Dates), "version", version)
+
+	// El catálogo es opcional: sin él el arranque en frío no filtra por año
+	catalog, err = loadCatalog(catalogFile)
+	if err != nil {
+		slog.Warn("Catálogo no disponible", "file", catalogFile, "error", err)
+	} else {
+		slog.Info("Catálogo cargado", "movies", len(catalog.Titles))
+	}
+
+	// En modo evaluación se miden los algoritmos y se termina
+	if *evaluateSplit != "" {
+		if err := runEvaluation(*evaluateSplit); err != nil {
+			slog.Error("Error en la evaluación", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Iniciar servidor en el puerto 9002
-	listener, err := net.Listen("tcp", "172.20.0.5:9002")
+	listener, err := net.Listen("tcp", coordinatorAddr)
 	if err != nil {
-		fmt.Println("Error al iniciar el servidor:", err)
+		slog.Error("Error al iniciar el servidor", "error", err)
 		os.Exit(1)
 	}
 	defer listener.Close()
 
-	fmt.Println("Servidor escuchando en el puerto 9002")
+	slog.Info("Servidor escuchando", "address", coordinatorAddr, "coordinators", strings.Join(coordinators, ","))
+
+	// Elegir el líder entre los coordinadores. El líder envía a cada nodo
+	// las películas de su shard cuando arranca el clúster.
+	go runElection()
+
+	// Guardar periódicamente el WAL en una instantánea del dataset
+	go runWALCompaction()
+
+	// Informar cuántas consultas necesitaron un respaldo
+	go runHedgeStats()
+
+	// Informar los aciertos de la caché de recomendaciones
+	go runCacheStats()
+
+	// Revisar los nodos y copiar los shards de los que mueran
+	go runHealthChecks()
+
+	// Dejar de aceptar conexiones al recibir SIGTERM o SIGINT
+	go closeOnSignal(listener)
 
 	// Escuchar por conexiones entrantes desde la API
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println("Error al aceptar conexión de la API:", err)
+			if shuttingDown.Load() {
+				break
+			}
+			slog.Warn("Error al aceptar conexión de la API", "error", err)
 			continue
 		}
 
 		// Manejar cada conexión de la API en una goroutine
-		go handleAPIConnection(conn)
+		apiConnections.Add(1)
+		go func() {
+			defer apiConnections.Done()
+			handleAPIConnection(conn)
+		}()
 	}
+
+	// Terminar las solicitudes en curso antes de salir
+	shutdown()
 }
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Tipos de mensaje que el servidor envía a los nodos
+const (
+	MessageRecommend = "recommend"  // Solicitud de recomendaciones sobre un shard
+	MessageLoadShard = "load_shard" // Carga (o recarga) completa de un shard
+	MessageRatings   = "ratings"    // Calificaciones nuevas de un shard
+	MessageCancel    = "cancel"     // El servidor ya no espera la respuesta en curso
+	MessageHealth    = "health"     // Chequeo de salud: el nodo informa sus shards y su carga
+	MessageDropShard = "drop_shard" // Borra un shard que el nodo ya no tiene asignado
+)
+
+// El nodo perdió alguna actualización del shard y debe recargarlo
+const ErrStaleShard = "stale_shard"
+
+// Tiempo entre intentos de enviar los shards al iniciar el servidor
+const shardRetryInterval = 5 * time.Second
+
+// Películas de un shard con sus calificaciones
+type ShardData struct {
+	Shard   int
+	Version int64
+	Vectors map[int]map[int]float64 // Película → usuario → calificación
+	Dates   map[int]map[int]int64   // Película → usuario → fecha
+}
+
+// Calificaciones nuevas de un shard. El nodo solo las aplica si su copia
+// del shard está en BaseVersion; Version es la versión resultante.
+type RatingDelta struct {
+	Shard       int
+	BaseVersion int64
+	Version     int64
+	Ratings     []Rating
+}
+
+// Mensaje que el servidor envía a un nodo; solo va el campo de su tipo
+type NodeMessage struct {
+	Type        string
+	RequestID   string // Solicitud de la API que originó el mensaje, para los registros
+	TraceParent string // Contexto de la traza del mensaje (W3C traceparent)
+	Recommend   *NodeRequest
+	Shard       *ShardData
+	Delta       *RatingDelta
+}
+
+// Versión del dataset, que aumenta con cada carga de calificaciones, y
+// versión del dataset en la que cambió cada shard por última vez. Las
+// protege dataMu.
+var (
+	datasetVersion int64
+	shardVersions  = make([]int64, len(nodeIPs))
+)
+
+// Serializa las cargas de calificaciones y los envíos de shards para que
+// cada nodo reciba las actualizaciones en orden
+var ingestMu sync.Mutex
+
+// Shard al que pertenece una película: el de su nodo en el anillo. Hay un
+// shard por nodo.
+func shardOf(movieID int) int {
+	return movieRing.owner(movieID)
+}
+
+// Versión actual de un shard
+func currentShardVersion(shard int) int64 {
+	dataMu.RLock()
+	defer dataMu.RUnlock()
+	return shardVersions[shard]
+}
+
+// Copia las películas de un shard para enviarlas a un nodo
+func buildShardData(shard int) ShardData {
+	dataMu.RLock()
+	defer dataMu.RUnlock()
+
+	data := ShardData{
+		Shard:   shard,
+		Version: shardVersions[shard],
+		Vectors: make(map[int]map[int]float64),
+		Dates:   make(map[int]map[int]int64),
+	}
+	for movieID, vector := range dataset.vectors {
+		if shardOf(movieID) != shard {
+			continue
+		}
+		data.Vectors[movieID] = make(map[int]float64, len(vector))
+		for userID, rating := range vector {
+			data.Vectors[movieID][userID] = rating
+			if date, ok := dataset.data.Dates[userID][movieID]; ok {
+				if data.Dates[movieID] == nil {
+					data.Dates[movieID] = make(map[int]int64)
+				}
+				data.Dates[movieID][userID] = date
+			}
+		}
+	}
+	return data
+}
+
+// Envía un mensaje a un nodo y espera su respuesta
+func sendNodeMessage(ctx context.Context, nodeIP string, message NodeMessage) nodeResult {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", nodeIP)
+	if err != nil {
+		slog.WarnContext(ctx, "Error al conectar con el nodo", "node", nodeIP, "error", err)
+		if ctx.Err() != nil {
+			return nodeResult{node: nodeIP, err: contextError(ctx, nodeIP)}
+		}
+		return nodeResult{node: nodeIP, err: nodeConnectionError(nodeIP, err)}
+	}
+	return handleNodeConnection(ctx, conn, message)
+}
+
+// Envía un shard completo a un nodo
+func pushShard(nodeIP string, shard int) *ServiceError {
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+	return pushShardLocked(nodeIP, shard)
+}
+
+// Igual que pushShard, con ingestMu ya tomado
+func pushShardLocked(nodeIP string, shard int) *ServiceError {
+	data := buildShardData(shard)
+	slog.Info("Enviando el shard", "shard", shard, "version", data.Version, "movies", len(data.Vectors), "node", nodeIP)
+	return sendNodeMessage(context.Background(), nodeIP, NodeMessage{Type: MessageLoadShard, Shard: &data}).err
+}
+
+// Pide a un nodo que borre su copia de un shard que ya no tiene asignado
+func dropShard(nodeIP string, shard int) {
+	slog.Info("Borrando la copia del shard", "shard", shard, "node", nodeIP)
+	if serviceErr := sendNodeMessage(context.Background(), nodeIP, NodeMessage{Type: MessageDropShard, Shard: &ShardData{Shard: shard}}).err; serviceErr != nil {
+		slog.Warn("No se pudo borrar la copia del shard", "shard", shard, "node", nodeIP, "code", serviceErr.Code, "error", serviceErr.Message)
+	}
+}
+
+// Envía cada shard a sus copias al iniciar. Los nodos pueden arrancar
+// después que el servidor, así que se reintenta hasta lograrlo o hasta que
+// el shard se copie en otro nodo.
+func distributeShards() {
+	for shard := range nodeIPs {
+		for _, nodeIP := range replicasOf(shard) {
+			go func(shard int, nodeIP string) {
+				for isReplica(shard, nodeIP) {
+					serviceErr := pushShard(nodeIP, shard)
+					if serviceErr == nil {
+						return
+					}
+					slog.Warn("No se pudo enviar el shard; se reintentará", "shard", shard, "node", nodeIP, "error", serviceErr.Message, "retry_in", shardRetryInterval)
+					time.Sleep(shardRetryInterval)
+				}
+			}(shard, nodeIP)
+		}
+	}
+}
+
+// Pide recomendaciones sobre un shard a un nodo ya conectado. Si el nodo no
+// tiene el shard o lo tiene desactualizado, se le envía y se reintenta,
+// salvo que haya dejado de ser una de sus copias. El envío del shard no
+// depende de ctx porque lo aprovechan otras solicitudes.
+func queryShard(ctx context.Context, conn net.Conn, payload NodeRequest) nodeResult {
+	nodeIP := conn.RemoteAddr().String()
+	result := handleNodeConnection(ctx, conn, NodeMessage{Type: MessageRecommend, Recommend: &payload})
+
+	stale := result.err == nil && result.response.Version < currentShardVersion(payload.Shard)
+	if result.err != nil && (result.err.Code == ErrDatasetNotLoaded || result.err.Code == ErrStaleShard) {
+		stale = true
+	}
+	if !stale || !isReplica(payload.Shard, nodeIP) {
+		return result
+	}
+
+	if serviceErr := pushShard(nodeIP, payload.Shard); serviceErr != nil {
+		return nodeResult{node: nodeIP, err: serviceErr}
+	}
+	return sendNodeMessage(ctx, nodeIP, NodeMessage{Type: MessageRecommend, Recommend: &payload})
+}
+
+// Valida las calificaciones recibidas y las convierte al formato interno.
+// Sin fecha se usa la actual, salvo que el dataset no tenga fechas.
+func parseRatings(inputs []RatingInput, withDates bool) ([]Rating, *ServiceError) {
+	if len(inputs) == 0 {
+		return nil, &ServiceError{Code: ErrBadRequest, Message: "la solicitud no contiene calificaciones"}
+	}
+	now := time.Now().Unix()
+	ratings := make([]Rating, 0, len(inputs))
+	for i, input := range inputs {
+		if input.UserID <= 0 || input.MovieID <= 0 {
+			return nil, &ServiceError{Code: ErrBadRequest, Message: fmt.Sprintf("calificación %d: userId y movieId deben ser positivos", i)}
+		}
+		if input.Rating < 1 || input.Rating > 5 {
+			return nil, &ServiceError{Code: ErrBadRequest, Message: fmt.Sprintf("calificación %d: rating debe estar entre 1 y 5", i)}
+		}
+		rating := Rating{UserID: input.UserID, MovieID: input.MovieID, Rating: input.Rating}
+		if input.Date != "" {
+			date, ok := parseRatingDate(input.Date)
+			if !ok {
+				return nil, &ServiceError{Code: ErrBadRequest, Message: fmt.Sprintf("calificación %d: fecha inválida: %s", i, input.Date)}
+			}
+			rating.Date = date
+		} else if withDates {
+			rating.Date = now
+		}
+		ratings = append(ratings, rating)
+	}
+	return ratings, nil
+}
+
+// Agrega las calificaciones al dataset del servidor y envía a cada copia de
+// un shard las de ese shard. Si una copia no recibe su parte, el shard se le
+// reenvía completo en su próxima consulta; si ninguna la recibe, la
+// respuesta se marca como degradada.
+func ingestRatings(ctx context.Context, inputs []RatingInput) RatingsResponse {
+	dataMu.RLock()
+	withDates := dataset.latest != 0
+	loaded := datasetLoaded()
+	dataMu.RUnlock()
+	if !loaded {
+		return RatingsResponse{Error: &ServiceError{Code: ErrDatasetNotLoaded, Message: "el servidor no tiene datos de calificación cargados"}}
+	}
+
+	ratings, serviceErr := parseRatings(inputs, withDates)
+	if serviceErr != nil {
+		return RatingsResponse{Error: serviceErr}
+	}
+
+	_, waitSpan := tracer.Start(ctx, "server.wait_ingest")
+	ingestMu.Lock()
+	waitSpan.End()
+	defer ingestMu.Unlock()
+
+	// La concesión pudo vencer mientras se validaban las calificaciones
+	if !isLeader() {
+		return RatingsResponse{Error: notLeaderError()}
+	}
+
+	// Las calificaciones se guardan en el WAL antes de aplicarlas
+	dataMu.RLock()
+	version := datasetVersion + 1
+	dataMu.RUnlock()
+	_, walSpan := tracer.Start(ctx, "server.wal_append")
+	if err := logRatings(version, ratings); err != nil {
+		walSpan.SetStatus(codes.Error, err.Error())
+		walSpan.End()
+		slog.ErrorContext(ctx, "Error al escribir en el WAL", "error", err)
+		return RatingsResponse{Error: &ServiceError{
+			Code:    ErrStorageUnavailable,
+			Message: fmt.Sprintf("no se pudieron guardar las calificaciones: %v", err),
+		}}
+	}
+	walSpan.End()
+
+	// Actualizar el dataset y los índices, y agrupar por shard
+	dataMu.Lock()
+	byShard := make(map[int][]Rating)
+	for _, rating := range ratings {
+		dataset.addRating(rating)
+		shard := shardOf(rating.MovieID)
+		byShard[shard] = append(byShard[shard], rating)
+	}
+	datasetVersion = version
+	// Las respuestas guardadas ya no corresponden a la versión actual
+	recommendationCache.purge()
+	var deltas []RatingDelta
+	for shard, shardRatings := range byShard {
+		deltas = append(deltas, RatingDelta{Shard: shard, BaseVersion: shardVersions[shard], Version: version, Ratings: shardRatings})
+		shardVersions[shard] = version
+	}
+	dataMu.Unlock()
+
+	slog.InfoContext(ctx, "Calificaciones agregadas", "ratings", len(ratings), "version", version)
+
+	// Enviar a cada copia de un shard las calificaciones de ese shard
+	failures := make([][]*ServiceError, len(deltas))
+	var wg sync.WaitGroup
+	for i := range deltas {
+		replicas := replicasOf(deltas[i].Shard)
+		failures[i] = make([]*ServiceError, len(replicas))
+		for j, nodeIP := range replicas {
+			wg.Add(1)
+			go func(i, j int, nodeIP string) {
+				defer wg.Done()
+				delta := deltas[i]
+				result := sendNodeMessage(ctx, nodeIP, NodeMessage{Type: MessageRatings, Delta: &delta})
+				if result.err != nil && (result.err.Code == ErrDatasetNotLoaded || result.err.Code == ErrStaleShard) {
+					// El nodo se reinició o perdió una actualización: se le reenvía el shard
+					result.err = pushShardLocked(nodeIP, delta.Shard)
+				}
+				failures[i][j] = result.err
+			}(i, j, nodeIP)
+		}
+	}
+	wg.Wait()
+
+	response := RatingsResponse{Accepted: len(ratings), Version: version}
+	for _, shardFailures := range failures {
+		updated := false
+		for _, failure := range shardFailures {
+			if failure != nil {
+				response.Warnings = append(response.Warnings, *failure)
+			} else {
+				updated = true
+			}
+		}
+		if !updated {
+			response.Degraded = true
+		}
+	}
+	return response
+}
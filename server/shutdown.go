@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Apagado ordenado. Con SIGTERM o SIGINT el coordinador deja de aceptar
+// conexiones y, si es el líder, deja de serlo enseguida y cierra el WAL, así
+// otro coordinador atiende las solicitudes nuevas. Después espera hasta
+// shutdownTimeout a que terminen las solicitudes en curso. Las que no
+// terminan a tiempo se cancelan, y con ellas el trabajo en los nodos.
+var shutdownTimeout = time.Duration(getEnvInt("SHUTDOWN_TIMEOUT", 20)) * time.Second
+
+// Espera a que las solicitudes canceladas respondan antes de salir
+const cancelGracePeriod = time.Second
+
+var (
+	shuttingDown   atomic.Bool
+	apiConnections sync.WaitGroup // Conexiones de la API en curso
+
+	// Contexto de todas las solicitudes; se cancela si vence el plazo del apagado
+	requestsCtx, cancelRequests = context.WithCancel(context.Background())
+)
+
+// Cierra el listener al recibir la señal de apagado, para que el ciclo de
+// aceptación termine
+func closeOnSignal(listener net.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	slog.Info("Señal de apagado recibida; no se aceptan más conexiones", "signal", sig.String(), "inflight", apiInFlight.Load())
+	shuttingDown.Store(true)
+	listener.Close()
+}
+
+// Deja el liderazgo y espera las solicitudes en curso
+func shutdown() {
+	resign()
+	if !waitTimeout(&apiConnections, shutdownTimeout) {
+		slog.Warn("Venció el plazo del apagado; se cancelan las solicitudes en curso", "timeout", shutdownTimeout, "inflight", apiInFlight.Load())
+		cancelRequests()
+		waitTimeout(&apiConnections, cancelGracePeriod)
+	}
+
+	flushTraces()
+	slog.Info("Coordinador apagado", "coordinator", coordinatorAddr)
+}
+
+// Espera al grupo hasta el plazo; indica si terminó a tiempo
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MessageCluster = "cluster" // La API pide el estado del clúster
+	MessageLeave   = "leave"   // Un nodo avisa que se apaga
+)
+
+// Respuesta al aviso de apagado de un nodo
+type LeaveResponse struct {
+	Node  string        `json:"node"`
+	Error *ServiceError `json:"error,omitempty"`
+}
+
+// Trabajo en curso: solicitudes de la API que el coordinador está
+// atendiendo y mensajes enviados a cada nodo que esperan respuesta
+var (
+	apiInFlight  atomic.Int64
+	nodeInFlight = initialInFlight()
+)
+
+// Un contador por nodo. El mapa no cambia después de crearse.
+func initialInFlight() map[string]*atomic.Int64 {
+	counters := make(map[string]*atomic.Int64, len(nodeIPs))
+	for _, nodeIP := range nodeIPs {
+		counters[nodeIP] = &atomic.Int64{}
+	}
+	return counters
+}
+
+// Estado del clúster según este coordinador, para los operadores
+type ClusterStatus struct {
+	Coordinator    string        `json:"coordinator"`
+	Leader         string        `json:"leader,omitempty"` // Vacío durante una elección
+	Term           int64         `json:"term"`
+	Ready          bool          `json:"ready"` // Tiene el dataset cargado
+	DatasetVersion int64         `json:"datasetVersion"`
+	InFlight       int64         `json:"inFlight"` // Solicitudes de la API en curso
+	Shards         []ShardStatus `json:"shards"`
+	Nodes          []NodeStatus  `json:"nodes"`
+	Error          *ServiceError `json:"error,omitempty"`
+}
+
+// Copias y versión de un shard
+type ShardStatus struct {
+	Shard    int      `json:"shard"`
+	Version  int64    `json:"version"`  // Versión del dataset en la que cambió por última vez
+	Replicas []string `json:"replicas"` // En orden de preferencia
+}
+
+// Estado de un nodo según los chequeos de salud. Solo el líder revisa los
+// nodos; en los demás coordinadores LastSeen y Loaded quedan vacíos.
+type NodeStatus struct {
+	Address   string        `json:"address"`
+	Alive     bool          `json:"alive"`
+	LastSeen  *time.Time    `json:"lastSeen,omitempty"` // Último chequeo exitoso
+	Failures  int           `json:"failures,omitempty"` // Chequeos fallidos seguidos
+	LastError string        `json:"lastError,omitempty"`
+	Shards    []int         `json:"shards"`   // Shards de los que tiene una copia asignada
+	Loaded    map[int]int64 `json:"loaded"`   // Shards cargados en el nodo y su versión
+	InFlight  int64         `json:"inFlight"` // Mensajes del coordinador que esperan respuesta
+	Workers   int           `json:"workers,omitempty"`
+	Busy      int           `json:"busy"`   // Trabajadores calculando
+	Queued    int           `json:"queued"` // Solicitudes en la cola del nodo
+}
+
+// Reúne el estado del clúster
+func clusterStatus() ClusterStatus {
+	election.mu.Lock()
+	status := ClusterStatus{Coordinator: coordinatorAddr, Leader: election.leader, Term: election.term}
+	election.mu.Unlock()
+	status.InFlight = apiInFlight.Load()
+
+	dataMu.RLock()
+	status.Ready = datasetLoaded()
+	status.DatasetVersion = datasetVersion
+	versions := slices.Clone(shardVersions)
+	dataMu.RUnlock()
+
+	placementMu.RLock()
+	defer placementMu.RUnlock()
+	for shard, replicas := range shardReplicas {
+		status.Shards = append(status.Shards, ShardStatus{Shard: shard, Version: versions[shard], Replicas: slices.Clone(replicas)})
+	}
+	for _, nodeIP := range nodeIPs {
+		health := nodeStatus[nodeIP]
+		node := NodeStatus{
+			Address:   nodeIP,
+			Alive:     health.alive,
+			Failures:  health.failures,
+			LastError: health.lastError,
+			Shards:    []int{},
+			Loaded:    map[int]int64{},
+			InFlight:  nodeInFlight[nodeIP].Load(),
+		}
+		if !health.lastSeen.IsZero() {
+			lastSeen := health.lastSeen
+			node.LastSeen = &lastSeen
+		}
+		if report := health.report; report != nil {
+			node.Loaded, node.Workers, node.Busy, node.Queued = report.ShardVersions, report.Workers, report.Busy, report.Queued
+		}
+		for shard, replicas := range shardReplicas {
+			if slices.Contains(replicas, nodeIP) {
+				node.Shards = append(node.Shards, shard)
+			}
+		}
+		status.Nodes = append(status.Nodes, node)
+	}
+	return status
+}
+
+// Indica si el dataset está cargado. Se llama con dataMu tomado.
+func datasetLoaded() bool {
+	return len(dataset.data.Ratings) > 0
+}
+
+// El proceso está vivo y atiende HTTP
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// Listo una vez cargado el dataset. Los coordinadores que no son el líder
+// también están listos: responden not_leader y la API reintenta en el líder.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "shutting_down"})
+		return
+	}
+	dataMu.RLock()
+	ready, version := datasetLoaded(), datasetVersion
+	dataMu.RUnlock()
+	if !ready {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "not_ready", "reason": "el dataset no está cargado"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ready", "leader": isLeader(), "datasetVersion": version})
+}
+
+// Estado del clúster según este coordinador
+func handleCluster(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, clusterStatus())
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
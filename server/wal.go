@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directorio del registro de escritura anticipada (WAL) y de las
+// instantáneas del dataset. Debe estar en un volumen persistente.
+var walDir = getEnv("WAL_DIR", "/var/my-data/wal")
+
+// Cada cuánto se compacta el WAL en una instantánea del dataset
+var walCompactInterval = time.Duration(getEnvInt("WAL_COMPACT_MINUTES", 10)) * time.Minute
+
+// Nombre del WAL dentro de walDir
+const walFileName = "ratings.wal"
+
+// Las instantáneas se llaman snapshot-<versión>.csv
+const snapshotPrefix = "snapshot-"
+
+// Tamaño de la cabecera de cada registro: longitud y CRC-32 del contenido
+const walHeaderSize = 8
+
+// Tamaño de cada calificación dentro de un registro
+const walRatingSize = 32
+
+// Registro del WAL: una carga de calificaciones y la versión del dataset
+// que resulta de aplicarla
+type walRecord struct {
+	Version int64
+	Ratings []Rating
+}
+
+// WAL de solo escritura al final. Cada registro se escribe con una sola
+// llamada y se sincroniza con el disco antes de aplicarlo en memoria.
+type writeAheadLog struct {
+	mu   sync.Mutex
+	file walFile
+	size int64 // Bytes de los registros aceptados
+	// Error de un registro rechazado que no se pudo quitar del archivo; desde
+	// entonces se rechazan todas las cargas
+	broken error
+}
+
+// Operaciones del archivo que usa el WAL; en las pruebas se reemplaza para
+// simular errores del disco
+type walFile interface {
+	io.Writer
+	io.Seeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+}
+
+// WAL del servidor; nil si no se pudo abrir
+var ratingsLog *writeAheadLog
+
+// Serializa un registro: longitud (4 bytes), CRC-32 (4 bytes) y contenido
+// (versión, cantidad de calificaciones y cada calificación)
+func encodeWALRecord(record walRecord) []byte {
+	payload := make([]byte, 12+walRatingSize*len(record.Ratings))
+	binary.LittleEndian.PutUint64(payload[0:], uint64(record.Version))
+	binary.LittleEndian.PutUint32(payload[8:], uint32(len(record.Ratings)))
+	for i, rating := range record.Ratings {
+		offset := 12 + i*walRatingSize
+		binary.LittleEndian.PutUint64(payload[offset:], uint64(rating.UserID))
+		binary.LittleEndian.PutUint64(payload[offset+8:], uint64(rating.MovieID))
+		binary.LittleEndian.PutUint64(payload[offset+16:], math.Float64bits(rating.Rating))
+		binary.LittleEndian.PutUint64(payload[offset+24:], uint64(rating.Date))
+	}
+
+	buffer := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buffer[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buffer[4:], crc32.ChecksumIEEE(payload))
+	copy(buffer[walHeaderSize:], payload)
+	return buffer
+}
+
+// Lee los registros válidos del WAL. Se detiene en el primer registro
+// incompleto o con checksum inválido, que es lo que deja un proceso
+// interrumpido a mitad de una escritura, y devuelve hasta dónde llegan los
+// registros válidos.
+func readWALRecords(reader io.Reader) ([]walRecord, int64, error) {
+	var records []walRecord
+	var offset int64
+	buffered := bufio.NewReader(reader)
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(buffered, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, offset, nil
+			}
+			return records, offset, err
+		}
+		length := binary.LittleEndian.Uint32(header[0:])
+		checksum := binary.LittleEndian.Uint32(header[4:])
+		if length < 12 || (length-12)%walRatingSize != 0 {
+			return records, offset, nil
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(buffered, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, offset, nil
+			}
+			return records, offset, err
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return records, offset, nil
+		}
+
+		record := walRecord{Version: int64(binary.LittleEndian.Uint64(payload[0:]))}
+		count := int(binary.LittleEndian.Uint32(payload[8:]))
+		if 12+count*walRatingSize != int(length) {
+			return records, offset, nil
+		}
+		for i := 0; i < count; i++ {
+			field := payload[12+i*walRatingSize:]
+			record.Ratings = append(record.Ratings, Rating{
+				UserID:  int(int64(binary.LittleEndian.Uint64(field[0:]))),
+				MovieID: int(int64(binary.LittleEndian.Uint64(field[8:]))),
+				Rating:  math.Float64frombits(binary.LittleEndian.Uint64(field[16:])),
+				Date:    int64(binary.LittleEndian.Uint64(field[24:])),
+			})
+		}
+		records = append(records, record)
+		offset += int64(walHeaderSize) + int64(length)
+	}
+}
+
+// Abre el WAL, devuelve sus registros válidos y descarta lo que quedó de
+// una escritura interrumpida para que los registros nuevos queden contiguos
+func openWAL(path string) (*writeAheadLog, []walRecord, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, validSize, err := readWALRecords(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if info.Size() > validSize {
+		slog.Warn("WAL: se descartan los bytes de un registro incompleto o dañado", "bytes", info.Size()-validSize)
+		if err := file.Truncate(validSize); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+	if _, err := file.Seek(validSize, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return &writeAheadLog{file: file, size: validSize}, records, nil
+}
+
+// Agrega un registro al final del WAL y espera a que llegue al disco
+func (w *writeAheadLog) append(record walRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.broken != nil {
+		return w.broken
+	}
+	data := encodeWALRecord(record)
+	n, err := w.file.Write(data)
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		// El registro se rechaza: se quita lo que se haya escrito de él para
+		// que no se aplique al recuperar el WAL ni quede antes de los
+		// registros siguientes
+		if rollbackErr := w.rollback(); rollbackErr != nil {
+			w.broken = fmt.Errorf("no se pudo descartar un registro rechazado del WAL: %w", rollbackErr)
+			slog.Error("WAL: se rechazan las cargas hasta reiniciar", "error", w.broken)
+		}
+		return err
+	}
+	w.size += int64(n)
+	return nil
+}
+
+// Vuelve el archivo al final del último registro aceptado
+func (w *writeAheadLog) rollback() error {
+	if err := w.file.Truncate(w.size); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(w.size, io.SeekStart); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// Vacía el WAL después de guardar su contenido en una instantánea
+func (w *writeAheadLog) reset() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.size = 0
+	return w.file.Sync()
+}
+
+// Cierra el archivo del WAL
+func (w *writeAheadLog) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// Busca la instantánea más reciente del directorio
+func latestSnapshot(dir string) (string, int64, bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", 0, false
+	}
+	var bestPath string
+	var bestVersion int64 = -1
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, ".csv") {
+			continue
+		}
+		version, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), ".csv"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if version > bestVersion {
+			bestPath, bestVersion = filepath.Join(dir, name), version
+		}
+	}
+	return bestPath, bestVersion, bestVersion >= 0
+}
+
+// Escribe el dataset completo como instantánea, con el mismo formato que
+// los datasets originales. Se escribe en un archivo temporal que se
+// renombra al final, así una instantánea nunca queda a medias.
+func writeSnapshot(dir string, version int64, data RatingData) (string, error) {
+	path := filepath.Join(dir, fmt.Sprintf("%s%d.csv", snapshotPrefix, version))
+	temporary := path + ".tmp"
+	file, err := os.Create(temporary)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	writer.WriteString("MovieID,CustomerID,Rating,Date\n")
+	userIDs := make([]int, 0, len(data.Ratings))
+	for userID := range data.Ratings {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Ints(userIDs)
+	for _, userID := range userIDs {
+		for movieID, rating := range data.Ratings[userID] {
+			// Siempre cuatro columnas, como el encabezado; sin fecha la última
+			// queda vacía
+			fmt.Fprintf(writer, "%d,%d,%s,", movieID, userID, strconv.FormatFloat(rating, 'f', -1, 64))
+			if date, ok := data.Dates[userID][movieID]; ok {
+				writer.WriteString(strconv.FormatInt(date, 10))
+			}
+			writer.WriteByte('\n')
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(temporary, path); err != nil {
+		return "", err
+	}
+	syncDir(dir)
+	return path, nil
+}
+
+// Sincroniza el directorio para que los renombres sobrevivan a una caída
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Carga la instantánea más reciente (o el dataset original si no hay) y
+// aplica las calificaciones del WAL que aún no estaban en ella. Si el WAL
+// no se puede abrir, el servidor atiende con el dataset original pero no
+// acepta calificaciones nuevas.
+func recoverDataset(dir, baseFile string) (*datasetIndex, int64, *writeAheadLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		slog.Warn("WAL no disponible", "dir", dir, "error", err)
+		data, err := loadNetflixData(baseFile)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return newDatasetIndex(data), 0, nil, nil
+	}
+	removeTemporaries(dir)
+
+	index, version, err := loadSnapshot(dir, baseFile)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	wal, version := replayWAL(dir, index, version)
+	return index, version, wal, nil
+}
+
+// Pone al día el dataset que un coordinador cargó como seguidor cuando pasa
+// a ser líder. Si el líder anterior compactó el WAL desde entonces, se
+// recupera todo desde la instantánea nueva; si no, solo se aplican los
+// registros que faltan.
+func catchUpDataset(dir, baseFile string, index *datasetIndex, version int64) (*datasetIndex, int64, *writeAheadLog, error) {
+	if _, snapshotVersion, ok := latestSnapshot(dir); ok && snapshotVersion > version {
+		return recoverDataset(dir, baseFile)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		slog.Warn("WAL no disponible", "dir", dir, "error", err)
+		return index, version, nil, nil
+	}
+	removeTemporaries(dir)
+
+	wal, version := replayWAL(dir, index, version)
+	return index, version, wal, nil
+}
+
+// Carga el dataset como recoverDataset pero sin modificar el directorio del
+// WAL, que mientras tanto puede estar usando el líder
+func loadDatasetReadOnly(dir, baseFile string) (*datasetIndex, int64, error) {
+	var index *datasetIndex
+	var version int64
+	var err error
+	// Una compactación del líder puede borrar la instantánea entre que se
+	// busca y se abre; en ese caso se intenta con la nueva
+	for attempt := 0; attempt < 3; attempt++ {
+		index, version, err = loadSnapshot(dir, baseFile)
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.Open(filepath.Join(dir, walFileName))
+	if err != nil {
+		// Todavía no hay WAL
+		return index, version, nil
+	}
+	defer file.Close()
+	records, _, err := readWALRecords(file)
+	if err != nil {
+		slog.Warn("WAL: error al leer", "file", file.Name(), "error", err)
+	}
+	return index, applyWALRecords(index, version, records), nil
+}
+
+// Borra los restos de una compactación interrumpida
+func removeTemporaries(dir string) {
+	if temporaries, err := filepath.Glob(filepath.Join(dir, "*.tmp")); err == nil {
+		for _, temporary := range temporaries {
+			os.Remove(temporary)
+		}
+	}
+}
+
+// Carga la instantánea más reciente del directorio o, si no hay, el dataset
+// original
+func loadSnapshot(dir, baseFile string) (*datasetIndex, int64, error) {
+	file, version := baseFile, int64(0)
+	if snapshot, snapshotVersion, ok := latestSnapshot(dir); ok {
+		file, version = snapshot, snapshotVersion
+	}
+	data, err := loadNetflixData(file)
+	if err != nil {
+		return nil, 0, fmt.Errorf("al cargar %s: %w", file, err)
+	}
+	slog.Info("Dataset cargado", "file", file, "version", version)
+	return newDatasetIndex(data), version, nil
+}
+
+// Abre el WAL y aplica al índice los registros posteriores a su versión. Si
+// el WAL no se puede abrir devuelve nil y el índice queda como estaba.
+func replayWAL(dir string, index *datasetIndex, version int64) (*writeAheadLog, int64) {
+	wal, records, err := openWAL(filepath.Join(dir, walFileName))
+	if err != nil {
+		slog.Warn("WAL no disponible", "dir", dir, "error", err)
+		return nil, version
+	}
+	return wal, applyWALRecords(index, version, records)
+}
+
+// Aplica al índice los registros posteriores a su versión y devuelve la
+// versión resultante
+func applyWALRecords(index *datasetIndex, version int64, records []walRecord) int64 {
+	var replayed int
+	for _, record := range records {
+		// La instantánea ya incluye los registros hasta su versión
+		if record.Version <= version {
+			continue
+		}
+		for _, rating := range record.Ratings {
+			index.addRating(rating)
+		}
+		version = record.Version
+		replayed++
+	}
+	if replayed > 0 {
+		slog.Info("WAL: se aplicaron cargas de calificaciones", "batches", replayed, "version", version)
+	}
+	return version
+}
+
+// Guarda el dataset actual en una instantánea y vacía el WAL. Mientras
+// tanto no se aceptan calificaciones nuevas. El WAL está en un volumen
+// compartido: un líder cuya concesión venció no debe vaciarlo, aunque todavía
+// no haya cerrado su WAL, porque el líder nuevo puede haberle agregado cargas.
+func compactWAL() error {
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+
+	if ratingsLog == nil || !isLeader() {
+		return nil
+	}
+	ratingsLog.mu.Lock()
+	empty := ratingsLog.size == 0
+	ratingsLog.mu.Unlock()
+	if empty {
+		return nil
+	}
+
+	dataMu.RLock()
+	version := datasetVersion
+	path, err := writeSnapshot(walDir, version, dataset.data)
+	dataMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	// La concesión pudo vencer mientras se escribía la instantánea. Una
+	// instantánea de más no molesta: al recuperar se aplican encima las
+	// cargas posteriores del WAL.
+	if !isLeader() {
+		return nil
+	}
+	if err := ratingsLog.reset(); err != nil {
+		return err
+	}
+
+	// Las instantáneas anteriores ya no hacen falta
+	if snapshots, err := filepath.Glob(filepath.Join(walDir, snapshotPrefix+"*.csv")); err == nil {
+		for _, snapshot := range snapshots {
+			if snapshot != path {
+				os.Remove(snapshot)
+			}
+		}
+	}
+	slog.Info("WAL compactado", "snapshot", path, "version", version)
+	return nil
+}
+
+// Compacta el WAL periódicamente
+func runWALCompaction() {
+	if walCompactInterval <= 0 {
+		return
+	}
+	for range time.Tick(walCompactInterval) {
+		if err := compactWAL(); err != nil {
+			slog.Error("Error al compactar el WAL", "error", err)
+		}
+	}
+}
+
+// Escribe una carga de calificaciones en el WAL antes de aplicarla
+func logRatings(version int64, ratings []Rating) error {
+	if ratingsLog == nil {
+		return errors.New("el WAL no está disponible")
+	}
+	return ratingsLog.append(walRecord{Version: version, Ratings: ratings})
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Calificaciones deterministas de la carga con la versión dada, para poder
+// verificar lo que se recupera del WAL
+func testRecord(version int64) walRecord {
+	record := walRecord{Version: version}
+	for i := 0; i < 64; i++ {
+		record.Ratings = append(record.Ratings, Rating{
+			UserID:  int(version)*1000 + i,
+			MovieID: i%17 + 1,
+			Rating:  float64(i%5) + 1,
+			Date:    1136073600 + version,
+		})
+	}
+	return record
+}
+
+// Verifica que los registros sean las cargas 1..n completas y en orden
+func checkRecords(t *testing.T, records []walRecord) {
+	t.Helper()
+	for i, record := range records {
+		want := testRecord(int64(i + 1))
+		if record.Version != want.Version {
+			t.Fatalf("registro %d: versión %d, se esperaba %d", i, record.Version, want.Version)
+		}
+		if len(record.Ratings) != len(want.Ratings) {
+			t.Fatalf("registro %d: %d calificaciones, se esperaban %d", i, len(record.Ratings), len(want.Ratings))
+		}
+		for j := range want.Ratings {
+			if record.Ratings[j] != want.Ratings[j] {
+				t.Fatalf("registro %d, calificación %d: %+v, se esperaba %+v", i, j, record.Ratings[j], want.Ratings[j])
+			}
+		}
+	}
+}
+
+func TestWALAppendAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), walFileName)
+	wal, records, err := openWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("WAL nuevo con %d registros", len(records))
+	}
+	for version := int64(1); version <= 10; version++ {
+		if err := wal.append(testRecord(version)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wal.close()
+
+	wal, records, err = openWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.close()
+	if len(records) != 10 {
+		t.Fatalf("se recuperaron %d registros, se esperaban 10", len(records))
+	}
+	checkRecords(t, records)
+}
+
+func TestWALDiscardsTornAndCorruptTail(t *testing.T) {
+	tests := []struct {
+		name  string
+		tail  func(record []byte) []byte
+		valid int
+	}{
+		{"cabecera incompleta", func(record []byte) []byte { return record[:5] }, 3},
+		{"contenido incompleto", func(record []byte) []byte { return record[:len(record)-7] }, 3},
+		{"checksum inválido", func(record []byte) []byte {
+			corrupt := append([]byte(nil), record...)
+			corrupt[len(corrupt)-1] ^= 0xFF
+			return corrupt
+		}, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), walFileName)
+			var data []byte
+			for version := int64(1); version <= 3; version++ {
+				data = append(data, encodeWALRecord(testRecord(version))...)
+			}
+			validSize := len(data)
+			data = append(data, test.tail(encodeWALRecord(testRecord(4)))...)
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			wal, records, err := openWAL(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != test.valid {
+				t.Fatalf("se recuperaron %d registros, se esperaban %d", len(records), test.valid)
+			}
+			checkRecords(t, records)
+			if info, _ := os.Stat(path); info.Size() != int64(validSize) {
+				t.Fatalf("el WAL mide %d bytes después de recuperarlo, se esperaban %d", info.Size(), validSize)
+			}
+
+			// Lo que se agrega después queda a continuación de los registros válidos
+			if err := wal.append(testRecord(4)); err != nil {
+				t.Fatal(err)
+			}
+			wal.close()
+			wal, records, err = openWAL(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.close()
+			if len(records) != 4 {
+				t.Fatalf("se recuperaron %d registros después de agregar uno, se esperaban 4", len(records))
+			}
+			checkRecords(t, records)
+		})
+	}
+}
+
+// Archivo del WAL cuyas sincronizaciones fallan mientras failSync sea
+// mayor que cero
+type failingSyncFile struct {
+	*os.File
+	failSync int
+}
+
+var errSync = errors.New("error de E/S simulado")
+
+func (f *failingSyncFile) Sync() error {
+	if f.failSync > 0 {
+		f.failSync--
+		return errSync
+	}
+	return f.File.Sync()
+}
+
+// Un registro que no llega al disco se rechaza y se quita del archivo: no
+// se recupera al reabrir el WAL y el siguiente queda a continuación del
+// último aceptado
+func TestWALDiscardsRecordWhenSyncFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), walFileName)
+	wal, _, err := openWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for version := int64(1); version <= 2; version++ {
+		if err := wal.append(testRecord(version)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := &failingSyncFile{File: wal.file.(*os.File), failSync: 1}
+	wal.file = file
+
+	if err := wal.append(testRecord(99)); !errors.Is(err, errSync) {
+		t.Fatalf("error %v, se esperaba el de la sincronización", err)
+	}
+	if info, _ := os.Stat(path); info.Size() != wal.size {
+		t.Fatalf("el WAL mide %d bytes después del rechazo, se esperaban %d", info.Size(), wal.size)
+	}
+	if err := wal.append(testRecord(3)); err != nil {
+		t.Fatalf("se rechazó el registro siguiente: %v", err)
+	}
+	wal.close()
+
+	wal, records, err := openWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.close()
+	if len(records) != 3 {
+		t.Fatalf("se recuperaron %d registros, se esperaban 3", len(records))
+	}
+	checkRecords(t, records)
+}
+
+// Si tampoco se puede descartar el registro rechazado, el WAL no acepta más
+// cargas
+func TestWALRejectsAppendsAfterFailedRollback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), walFileName)
+	wal, _, err := openWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.close()
+	wal.file = &failingSyncFile{File: wal.file.(*os.File), failSync: 2}
+
+	if err := wal.append(testRecord(1)); !errors.Is(err, errSync) {
+		t.Fatalf("error %v, se esperaba el de la sincronización", err)
+	}
+	if err := wal.append(testRecord(1)); !errors.Is(err, errSync) {
+		t.Fatalf("error %v, se esperaba que el WAL rechazara las cargas", err)
+	}
+}
+
+// Proceso auxiliar que escribe cargas en el WAL sin parar hasta que lo
+// matan. Solo se ejecuta cuando TestWALSurvivesKill lo lanza.
+func TestWALWriterProcess(t *testing.T) {
+	path := os.Getenv("WAL_WRITER_PATH")
+	if path == "" {
+		t.Skip("solo se ejecuta como proceso auxiliar")
+	}
+	wal, records, err := openWAL(path)
+	if err != nil {
+		os.Exit(2)
+	}
+	for version := int64(len(records) + 1); ; version++ {
+		if err := wal.append(testRecord(version)); err != nil {
+			os.Exit(3)
+		}
+	}
+}
+
+func TestWALSurvivesKill(t *testing.T) {
+	if testing.Short() {
+		t.Skip("lanza procesos auxiliares")
+	}
+	path := filepath.Join(t.TempDir(), walFileName)
+
+	var previous int
+	for round := 0; round < 3; round++ {
+		// Matar al escritor a mitad de su trabajo
+		writer := exec.Command(os.Args[0], "-test.run=^TestWALWriterProcess$")
+		writer.Env = append(os.Environ(), "WAL_WRITER_PATH="+path)
+		if err := writer.Start(); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			info, err := os.Stat(path)
+			if err == nil && info.Size() > int64(previous+20)*int64(len(encodeWALRecord(testRecord(1)))) {
+				break
+			}
+			if time.Now().After(deadline) {
+				writer.Process.Kill()
+				t.Fatal("el proceso auxiliar no escribió en el WAL")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		writer.Process.Kill()
+		writer.Wait()
+
+		// Todo lo recuperado son cargas completas, en orden y sin huecos
+		wal, records, err := openWAL(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wal.close()
+		if len(records) <= previous {
+			t.Fatalf("ronda %d: se recuperaron %d registros, antes había %d", round, len(records), previous)
+		}
+		checkRecords(t, records)
+		previous = len(records)
+	}
+}
+
+func TestRecoverDatasetFromSnapshotAndWAL(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "dataset.csv")
+	if err := os.WriteFile(base, []byte("MovieID,CustomerID,Rating,Date\n1,1,3,2005-12-26\n2,1,4,2005-10-04\n1,2,5,2005-11-01\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sin instantánea se parte del dataset original
+	index, version, wal, err := recoverDataset(dir, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 || index.count != 3 {
+		t.Fatalf("versión %d con %d calificaciones, se esperaba versión 0 con 3", version, index.count)
+	}
+	wal.append(walRecord{Version: 1, Ratings: []Rating{{UserID: 3, MovieID: 2, Rating: 2, Date: 1136073600}}})
+	wal.append(walRecord{Version: 2, Ratings: []Rating{{UserID: 1, MovieID: 1, Rating: 1, Date: 1136073601}}})
+
+	// La compactación guarda la versión 2 y vacía el WAL
+	index.addRating(Rating{UserID: 3, MovieID: 2, Rating: 2, Date: 1136073600})
+	index.addRating(Rating{UserID: 1, MovieID: 1, Rating: 1, Date: 1136073601})
+	if _, err := writeSnapshot(dir, 2, index.data); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.reset(); err != nil {
+		t.Fatal(err)
+	}
+	wal.append(walRecord{Version: 3, Ratings: []Rating{{UserID: 4, MovieID: 3, Rating: 4.5, Date: 1136073602}}})
+	wal.close()
+
+	index, version, wal, err = recoverDataset(dir, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.close()
+	if version != 3 {
+		t.Fatalf("versión recuperada %d, se esperaba 3", version)
+	}
+	want := map[[2]int]float64{{1, 1}: 1, {1, 2}: 4, {2, 1}: 5, {3, 2}: 2, {4, 3}: 4.5}
+	if index.count != len(want) {
+		t.Fatalf("se recuperaron %d calificaciones, se esperaban %d", index.count, len(want))
+	}
+	for key, rating := range want {
+		if got := index.data.Ratings[key[0]][key[1]]; got != rating {
+			t.Fatalf("usuario %d, película %d: calificación %v, se esperaba %v", key[0], key[1], got, rating)
+		}
+	}
+	if index.data.Dates[1][1] != 1136073601 {
+		t.Fatalf("fecha recuperada %d, se esperaba 1136073601", index.data.Dates[1][1])
+	}
+}
+
+// Las instantáneas conservan las calificaciones con y sin fecha
+func TestSnapshotRoundTripWithoutDates(t *testing.T) {
+	undated := RatingData{
+		Ratings: map[int]map[int]float64{1: {1: 3, 2: 4}, 2: {1: 5}},
+		Dates:   map[int]map[int]int64{},
+	}
+	mixed := RatingData{
+		Ratings: map[int]map[int]float64{1: {1: 3, 2: 4.5}, 2: {1: 5}, 3: {7: 1}},
+		Dates:   map[int]map[int]int64{1: {2: 1136073600}, 3: {7: 1136073601}},
+	}
+	for name, data := range map[string]RatingData{"sin fechas": undated, "mixtas": mixed} {
+		path, err := writeSnapshot(t.TempDir(), 1, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := loadNetflixData(path)
+		if err != nil {
+			t.Fatalf("%s: error al cargar la instantánea: %v", name, err)
+		}
+		if len(loaded.Ratings) != len(data.Ratings) {
+			t.Fatalf("%s: se cargaron %d usuarios, se esperaban %d", name, len(loaded.Ratings), len(data.Ratings))
+		}
+		for userID, ratings := range data.Ratings {
+			for movieID, rating := range ratings {
+				if got, ok := loaded.Ratings[userID][movieID]; !ok || got != rating {
+					t.Errorf("%s: usuario %d, película %d: calificación %v, se esperaba %v", name, userID, movieID, got, rating)
+				}
+				date, dated := data.Dates[userID][movieID]
+				if got, ok := loaded.Dates[userID][movieID]; ok != dated || got != date {
+					t.Errorf("%s: usuario %d, película %d: fecha %d (%v), se esperaba %d (%v)", name, userID, movieID, got, ok, date, dated)
+				}
+			}
+		}
+	}
+}
+
+// Un error de lectura a mitad del archivo no deja un dataset truncado
+func TestLoadNetflixDataReportsMalformedRows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dataset.csv")
+	if err := os.WriteFile(path, []byte("MovieID,CustomerID,Rating,Date\n1,1,3,2005-12-26\n2,1\n1,2,5,2005-11-01\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadNetflixData(path); err == nil {
+		t.Fatal("se esperaba un error por la fila con menos columnas")
+	}
+}